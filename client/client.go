@@ -2,34 +2,42 @@ package main
 
 import (
 	"bufio"
-	"bytes"
 	"context"
 	"encoding/json"
+	"flag"
 	"fmt"
+	"image"
 	"io"
 	"log"
 	"math/rand"
 	"net"
 	"os"
-	"os/exec"
+	"path/filepath"
+	"slices"
 	"strconv"
 	"strings"
+	"sync"
 	"time"
+	"unicode"
+	"unicode/utf8"
 
 	_ "image/png"
 
 	"github.com/chromedp/chromedp"
 	"github.com/eiannone/keyboard"
+	"golang.org/x/term"
+
+	"pokemon/protocol"
 )
 
 // ----------------------------------------------------------------------------------
 // GLOBAL VARIABLES & DATA MODELS
 // ----------------------------------------------------------------------------------
 
-// Board dimensions
+// Board dimensions, as reported by the server on login
 var (
-	ROWS, COLS = 10, 18
-	BOARD      = make([][]string, ROWS)
+	ROWS, COLS int
+	BOARD      [][]string
 )
 
 // Player
@@ -38,13 +46,41 @@ var (
 	X, Y           int
 	ENEMIES        = make(map[string]string) // Map from "x-y" -> "enemyUsername"
 	DRAWBOARD      = true                    // If true, redraw board
-	pokeBalls      []Pokemon                 // All captured Pokemons
+	PAUSED         = false                   // If true, an overlay owns the screen
+	SPECTATING     = false                   // If true, we are watching a battle
+	LEADERBOARD    = false                   // If true, the leaderboard is on screen
+	HELP           = false                   // If true, the help is on screen
+	CATCHES        = false                   // If true, the catch history is on screen
+	COLOR          = false                   // If true, draw the board with ANSI colors
+	OFFLINE        = false                   // If true, there is no server and nothing is sent
+	FOG_RADIUS     = 0                       // If positive, only tiles this close to us are drawn
+	EMOJI          = false                   // If true, types are shown with an emoji
+	CENTER         = false                   // If true, the title and board are centered in the terminal
+	FAST           = false                   // If true, battle animations are skipped
+	pokeBalls      []Pokemon                 // Our party, the Pokemon we carry and battle with
+	box            []Pokemon                 // Caught Pokemon that don't fit in the party
+	PARTY_SIZE     = 0                       // Most Pokemon the party holds, 0 for no limit; set by the server
 	chosenPokemons []Pokemon                 // Pokemons chosen for battle
 	currentPokemon = 0                       // Index of currently chosen Pokemon
-	returnPokemon  []Pokemon
-	isReplay       bool = false
+	isReplay       = false
 )
 
+// PASSWORD is kept to log back in after a lost connection
+var PASSWORD string
+
+// offlineRand lays out the -offline board, see -seed
+var offlineRand = rand.New(rand.NewSource(time.Now().UnixNano()))
+
+// lastMove is when the last move was sent, see MOVE_THROTTLE
+var lastMove time.Time
+
+// LeaderboardEntry is one row of the leaderboard the server sends
+type LeaderboardEntry struct {
+	Username string `json:"username"`
+	Pokemon  int    `json:"pokemon"`
+	Exp      int    `json:"exp"`
+}
+
 // Pokemon struct to match pokedex.json
 type Pokemon struct {
 	ID    string            `json:"id"`
@@ -52,10 +88,170 @@ type Pokemon struct {
 	Types []string          `json:"types"`
 	Stats map[string]string `json:"stats"`
 	Exp   string            `json:"exp"`
+	MaxHP int               `json:"maxHP,omitempty"` // HP to restore after a battle
+	Moves []protocol.Move   `json:"moves,omitempty"`
 }
 
 var POKEMONS []Pokemon // All possible Pokemon loaded from pokedex.json
 
+// ANSI color escapes used by colorize
+const (
+	COLOR_RED    = "\033[31m"
+	COLOR_GREEN  = "\033[32m"
+	COLOR_YELLOW = "\033[33m"
+	COLOR_BLUE   = "\033[34m"
+	COLOR_PURPLE = "\033[35m"
+	COLOR_CYAN   = "\033[36m"
+	COLOR_DIM    = "\033[90m"
+	COLOR_RESET  = "\033[0m"
+)
+
+// typeStyle is how typeBadge shows a type
+type typeStyle struct {
+	emoji string
+	color string
+}
+
+// TYPE_BADGES has a typeStyle for each of protocol.TYPES
+var TYPE_BADGES = map[string]typeStyle{
+	"normal":   {"⚪", COLOR_DIM},
+	"fire":     {"🔥", COLOR_RED},
+	"water":    {"💧", COLOR_BLUE},
+	"electric": {"⚡", COLOR_YELLOW},
+	"grass":    {"🌿", COLOR_GREEN},
+	"ice":      {"❄️", COLOR_CYAN},
+	"fighting": {"🥊", COLOR_RED},
+	"poison":   {"☠️", COLOR_PURPLE},
+	"ground":   {"⛰️", COLOR_YELLOW},
+	"flying":   {"🪶", COLOR_CYAN},
+	"psychic":  {"🔮", COLOR_PURPLE},
+	"bug":      {"🐛", COLOR_GREEN},
+	"rock":     {"🪨", COLOR_YELLOW},
+	"ghost":    {"👻", COLOR_PURPLE},
+	"dragon":   {"🐉", COLOR_BLUE},
+	"dark":     {"🌑", COLOR_DIM},
+	"steel":    {"⚙️", COLOR_DIM},
+	"fairy":    {"🧚", COLOR_PURPLE},
+}
+
+// MOVE_THROTTLE is the shortest time between two moves; key presses that
+// come in faster, e.g. from a held arrow key, are dropped instead of flooding
+// the server
+const MOVE_THROTTLE = 100 * time.Millisecond
+
+// MOVE_KEYS maps letter keys to the row and column step they move the player,
+// next to the arrow keys
+var MOVE_KEYS = map[rune][2]int{
+	'w': {-1, 0},
+	's': {1, 0},
+	'a': {0, -1},
+	'd': {0, 1},
+}
+
+// control is a key binding or battle command as shown by showHelp
+type control struct {
+	keys   string
+	action string
+}
+
+// CONTROLS are the keys of the main loop in main; keep them in sync
+var CONTROLS = []control{
+	{"arrows / WASD", "move, step on a Pokemon to catch it"},
+	{"p", "open the pokedex"},
+	{"l", "show the leaderboard"},
+	{"r", "radar: where is the nearest Pokemon"},
+	{"v", "spectate a battle"},
+	{"x", "release a Pokemon"},
+	{"i", "your stats"},
+	{"c", "your latest catches"},
+	{"b", "move Pokemon between your party and box"},
+	{"/", "admin command"},
+	{"h / ?", "this help"},
+	{"ESC", "exit"},
+}
+
+// BATTLE_ACTIONS are what can be typed on your turn in a battle
+var BATTLE_ACTIONS = []control{
+	{"1 / attack", "pick a move and attack"},
+	{"2 <n> / switch <n>", "switch to your Pokemon number n"},
+	{"3 / surrender", "give up the battle"},
+}
+
+// SERVER_ADDR is where the game server listens
+const SERVER_ADDR = "localhost:8080"
+
+// After losing the connection the client tries RECONNECT_ATTEMPTS times to log
+// back in, waiting RECONNECT_BACKOFF before the first attempt and twice as
+// long before each next one
+const (
+	RECONNECT_ATTEMPTS = 5
+	RECONNECT_BACKOFF  = time.Second
+
+	// SESSION_TIMEOUT is how long the server keeps the session of a client
+	// that went quiet (its PING_INTERVAL + PONG_TIMEOUT); until then logins
+	// are refused with ALREADY_LOGGED_IN
+	SESSION_TIMEOUT   = 20 * time.Second
+	ALREADY_LOGGED_IN = "failed: already logged in"
+
+	// RECONNECTED is passed to handleServerMessage with the new Welcome after
+	// logging back in. It is neither a tile nor a valid username, so no server
+	// message clashes
+	RECONNECTED = "_reconnected"
+)
+
+// The board -offline fabricates: its size, how many Pokemon and enemies are
+// on it and how many Pokemon the player starts with
+const (
+	OFFLINE_ROWS, OFFLINE_COLS = 10, 18
+	OFFLINE_POKEMON            = 12
+	OFFLINE_ENEMIES            = 3
+	OFFLINE_CAUGHT             = 6
+)
+
+// TITLE_ART is the logo drawTitle shows above the board
+var TITLE_ART = []string{
+	"                                  ,'\\",
+	"    _.----.        ____         ,'  _\\   ___    ___     ____",
+	"_,-'       `.     |    |  /`.   \\,-'    |   \\  /   |   |    \\  |`.",
+	"\\      __    \\    '-.  | /   `.  ___    |    \\/    |   '-.   \\ |  |",
+	" \\.    \\ \\   |  __  |  |/    ,','_  `.  |          | __  |    \\|  |",
+	"   \\    \\/   /,' _`.|      ,' / / / /   |          ,' _`.|     |  |",
+	"    \\     ,-'/  / \\ \\    ,'   | \\/ / ,`.|         /  / \\ \\  |     |",
+	"     \\    \\ |   \\_/  |   `-.  \\    `'  /|  |    ||   \\_/  | |\\    |",
+	"      \\    \\ \\      /       `-.`.___,-' |  |\\  /| \\      /  | |   |",
+	"       \\    \\ `.__,'|  |`-._    `|      |__| \\/ |  `.__,'|  | |   |",
+	"        \\_.-'       |__|    `-._ |              '-.|     '-.| |   |",
+	"                                `'                            '-._|",
+}
+
+// MAX_TEAM_SIZE is the largest battle team, matching the server
+const MAX_TEAM_SIZE = 3
+
+// POKEDEX_PAGE_SIZE is the number of Pokemon shown per page of the pokedex view
+const POKEDEX_PAGE_SIZE = 2
+
+// HP_BAR_WIDTH is how many characters a full HP bar takes
+const HP_BAR_WIDTH = 20
+
+// Stat bars of drawStats: MAX_STAT, the highest base stat, fills all of
+// STAT_BAR_WIDTH characters so no bar wraps
+const (
+	MAX_STAT       = 255
+	STAT_BAR_WIDTH = 50
+)
+
+// Battle animations, skipped with -fast
+const (
+	DAMAGE_ANIMATION = 1500 * time.Millisecond // How long an HP bar takes to drain
+	ANIMATION_FRAMES = 30
+)
+
+// Pokemon images
+const (
+	IMAGE_DIR  = "../pokemon_images" // Where pokemon_images saves the sprites
+	ASCII_RAMP = "@%#*+=-:. "        // Characters from darkest to brightest
+)
+
 // ----------------------------------------------------------------------------------
 // UTILITY & HELPER FUNCTIONS
 // ----------------------------------------------------------------------------------
@@ -121,6 +317,128 @@ func isNumber(str string) bool {
 	return err == nil
 }
 
+// newPokemon returns a copy of a pokedex entry with its own Stats map and its
+// MaxHP set, so battle damage never leaks back into POKEMONS.
+func newPokemon(p Pokemon) Pokemon {
+	stats := make(map[string]string, len(p.Stats))
+	for k, v := range p.Stats {
+		stats[k] = v
+	}
+	p.Stats = stats
+	if p.MaxHP == 0 {
+		p.MaxHP, _ = strconv.Atoi(stats["HP"])
+	}
+	return p
+}
+
+// chooseMove shows the moves of p and reads the player's pick. It reports
+// false if the player went back to the action menu instead.
+func chooseMove(p Pokemon, scanner *bufio.Scanner) (int, bool) {
+	moves := protocol.MovesOf(p.Moves, p.Types)
+	// The server only knows the first MAX_MOVES moves
+	if len(moves) > protocol.MAX_MOVES {
+		moves = moves[:protocol.MAX_MOVES]
+	}
+	fmt.Println("\nMoves:")
+	for i, move := range moves {
+		fmt.Printf("%d) %s (%s, power %d)\n", i+1, move.Name, move.Type, move.Power)
+	}
+	fmt.Print("Choose a move (Enter to go back) => ")
+	if !scanner.Scan() {
+		return 0, false
+	}
+	choice, err := strconv.Atoi(strings.TrimSpace(scanner.Text()))
+	if err != nil || choice < 1 || choice > len(moves) {
+		return 0, false
+	}
+	return choice - 1, true
+}
+
+// findPokemon returns the pokemons whose name contains query or that have a
+// type equal to query, ignoring case.
+func findPokemon(pokemons []Pokemon, query string) []Pokemon {
+	query = strings.ToLower(strings.TrimSpace(query))
+	var found []Pokemon
+	for _, pokemon := range pokemons {
+		if strings.Contains(strings.ToLower(pokemon.Name), query) || slices.ContainsFunc(pokemon.Types, func(t string) bool {
+			return strings.EqualFold(t, query)
+		}) {
+			found = append(found, pokemon)
+		}
+	}
+	return found
+}
+
+// pokemonByID looks up a Pokemon in POKEMONS by its ID field. Scraped data
+// can have gaps, so a Pokemon's position in the slice says nothing about its ID.
+func pokemonByID(id string) (Pokemon, bool) {
+	id = strings.TrimSpace(id)
+	for _, pokemon := range POKEMONS {
+		if pokemon.ID == id {
+			return pokemon, true
+		}
+	}
+	return Pokemon{}, false
+}
+
+// isTerminal reports whether f is attached to a terminal rather than a file
+// or a pipe.
+func isTerminal(f *os.File) bool {
+	info, err := f.Stat()
+	return err == nil && info.Mode()&os.ModeCharDevice != 0
+}
+
+// colorize wraps text in the given ANSI color when COLOR is enabled. The
+// escape bytes take up no space on screen, so callers must pad text before
+// coloring it, never after.
+func colorize(text, color string) string {
+	if !COLOR {
+		return text
+	}
+	return color + text + COLOR_RESET
+}
+
+// typeBadge shows a type in its color with its emoji in front, e.g. "🔥 Fire".
+// Without COLOR and EMOJI, or for an unknown type, it is just the type.
+func typeBadge(t string) string {
+	style, ok := TYPE_BADGES[strings.ToLower(t)]
+	if !ok {
+		return t
+	}
+	badge := colorize(t, style.color)
+	if EMOJI {
+		badge = style.emoji + " " + badge
+	}
+	return badge
+}
+
+// inSight reports whether the tile at (x, y) is close enough to the player to
+// be drawn. With fog of war disabled every tile is in sight.
+func inSight(x, y int) bool {
+	if FOG_RADIUS <= 0 {
+		return true
+	}
+	return abs(x-X) <= FOG_RADIUS && abs(y-Y) <= FOG_RADIUS
+}
+
+// abs returns the absolute value of n.
+func abs(n int) int {
+	if n < 0 {
+		return -n
+	}
+	return n
+}
+
+// hasFlag checks whether a comma-separated flag list contains the given flag.
+func hasFlag(flags, flag string) bool {
+	for _, f := range strings.Split(flags, ",") {
+		if f == flag {
+			return true
+		}
+	}
+	return false
+}
+
 // loadPokemons loads Pokemon data from a JSON file and returns the slice of Pokemon.
 func loadPokemons(filename string) []Pokemon {
 
@@ -143,31 +461,55 @@ func loadPokemons(filename string) []Pokemon {
 	return pokemons
 }
 
-// clearScreen uses Windows' CLS command to clear the console.
+// clearScreen clears the console using the ANSI "cursor home + erase display"
+// sequence, which works on any VT100-compatible terminal (Linux, macOS and
+// Windows Terminal alike).
 func clearScreen() {
-	cmd := exec.Command("cmd", "/c", "cls")
-	cmd.Stdout = os.Stdout
-	_ = cmd.Run()
+	fmt.Print("\033[H\033[2J")
+}
+
+// centerMargin returns the spaces that center something width columns wide
+// in the terminal. It asks for the terminal width every time, so a resized
+// window is picked up on the next redraw. Without CENTER, or when the width is
+// unknown, there is no margin.
+func centerMargin(width int) string {
+	if !CENTER {
+		return ""
+	}
+	termWidth, _, err := term.GetSize(int(os.Stdout.Fd()))
+	if err != nil {
+		return ""
+	}
+	return marginFor(termWidth, width)
+}
+
+// marginFor returns the spaces that center width columns in termWidth.
+func marginFor(termWidth, width int) string {
+	if termWidth <= width {
+		return ""
+	}
+	return strings.Repeat(" ", (termWidth-width)/2)
 }
 
 // drawTitle prints the ASCII Pokemon title logo.
 func drawTitle() {
-	fmt.Println("                                  ,'\\")
-	fmt.Println("    _.----.        ____         ,'  _\\   ___    ___     ____")
-	fmt.Println("_,-'       `.     |    |  /`.   \\,-'    |   \\  /   |   |    \\  |`.")
-	fmt.Println("\\      __    \\    '-.  | /   `.  ___    |    \\/    |   '-.   \\ |  |")
-	fmt.Println(" \\.    \\ \\   |  __  |  |/    ,','_  `.  |          | __  |    \\|  |")
-	fmt.Println("   \\    \\/   /,' _`.|      ,' / / / /   |          ,' _`.|     |  |")
-	fmt.Println("    \\     ,-'/  / \\ \\    ,'   | \\/ / ,`.|         /  / \\ \\  |     |")
-	fmt.Println("     \\    \\ |   \\_/  |   `-.  \\    `'  /|  |    ||   \\_/  | |\\    |")
-	fmt.Println("      \\    \\ \\      /       `-.`.___,-' |  |\\  /| \\      /  | |   |")
-	fmt.Println("       \\    \\ `.__,'|  |`-._    `|      |__| \\/ |  `.__,'|  | |   |")
-	fmt.Println("        \\_.-'       |__|    `-._ |              '-.|     '-.| |   |")
-	fmt.Println("                                `'                            '-._|")
+	width := 0
+	for _, line := range TITLE_ART {
+		width = max(width, utf8.RuneCountInString(line))
+	}
+	margin := centerMargin(width)
+	for _, line := range TITLE_ART {
+		fmt.Println(margin + line)
+	}
 }
 
 // drawBoard redraws the current BOARD in ASCII format.
 func drawBoard(board [][]string) {
+	// Nothing to draw until the server has sent the board size
+	if len(board) == 0 {
+		return
+	}
+
 	clearScreen()
 	drawTitle()
 
@@ -176,29 +518,38 @@ func drawBoard(board [][]string) {
 		return "+" + strings.Repeat("---+", length)
 	}
 
-	for _, row := range board {
-		fmt.Println(horizontalLine(len(row)))
+	// Each cell is "|" and three columns, plus the closing "|"
+	margin := centerMargin(4*len(board[0]) + 1)
+
+	for x, row := range board {
+		fmt.Println(margin + horizontalLine(len(row)))
 
-		for _, cell := range row {
-			if cell == "" {
+		fmt.Print(margin)
+		for y, cell := range row {
+			if !inSight(x, y) {
+				// Fog of war: the server still sends everything, we just don't show it
+				fmt.Printf("| %s ", colorize("░", COLOR_DIM))
+			} else if cell == "" {
 				fmt.Print("|   ")
 			} else {
 				// Could be a Pokemon ID (numbers) or a Player
 				if isNumber(cell) {
-					fmt.Printf("| %s ", "?") // Hide numeric ID behind '?'
+					fmt.Printf("| %s ", colorize("?", COLOR_YELLOW)) // Hide numeric ID behind '?'
+				} else if cell == protocol.DESPAWNING {
+					fmt.Printf("| %s ", colorize("!", COLOR_DIM)) // Catch it quick, it's about to go
 				} else {
 					// It's either me (USERNAME) or an enemy
 					if cell == USERNAME {
-						fmt.Printf("| %s ", "☻") // My avatar
+						fmt.Printf("| %s ", colorize("☻", COLOR_GREEN)) // My avatar
 					} else {
-						fmt.Printf("| %s ", "☠") // Another player's avatar
+						fmt.Printf("| %s ", colorize("☠", COLOR_RED)) // Another player's avatar
 					}
 				}
 			}
 		}
 		fmt.Println("|")
 	}
-	fmt.Println(horizontalLine(len(board[0])))
+	fmt.Println(margin + horizontalLine(len(board[0])))
 }
 
 // drawCongrats prints a congrats message (used when you catch a new Pokemon).
@@ -214,7 +565,11 @@ func drawCongrats() {
 // drawStats prints a Pokemon’s stats with ASCII bars.
 func drawStats(pokemon Pokemon) {
 	fmt.Println("Pokemon Name:", pokemon.Name)
-	fmt.Printf("Types: %s\n", strings.Join(pokemon.Types, " "))
+	badges := make([]string, len(pokemon.Types))
+	for i, t := range pokemon.Types {
+		badges[i] = typeBadge(t)
+	}
+	fmt.Printf("Types: %s\n", strings.Join(badges, " "))
 	fmt.Println()
 
 	// Display each stat as a bar of █
@@ -228,15 +583,143 @@ func drawStats(pokemon Pokemon) {
 		if label == "Sp Def" {
 			label = "SPECIAL DEFENSE"
 		}
-		fmt.Printf("%-16s ", label+":")
-		for i := 0; i < val; i++ {
-			fmt.Print("█")
-		}
-		fmt.Println()
+		fmt.Printf("%-16s %s %d\n", label+":", scaledBar(val, MAX_STAT, STAT_BAR_WIDTH), val)
 		fmt.Println()
 	}
 }
 
+// scaledBar draws val as a bar of █ that is width characters long when val
+// is max. Values outside 0 to max are drawn as an empty or a full bar.
+func scaledBar(val, max, width int) string {
+	if max <= 0 || val <= 0 {
+		return ""
+	}
+	val = min(val, max)
+	return strings.Repeat("█", (val*width+max/2)/max)
+}
+
+// hpBar draws current HP as a bar of █ filled in proportion to max, followed
+// by the numbers, e.g. "█████░░░░░░░░░░░░░░░ 12/45". HP below 0 is shown as 0.
+func hpBar(current, max int) string {
+	if current < 0 {
+		current = 0
+	}
+	if max <= 0 {
+		max = current
+	}
+	bar := scaledBar(current, max, HP_BAR_WIDTH)
+	if bar == "" && current > 0 {
+		bar = "█" // still standing, however barely
+	}
+	return fmt.Sprintf("%s%s %d/%d", bar, strings.Repeat("░", HP_BAR_WIDTH-utf8.RuneCountInString(bar)), current, max)
+}
+
+// hpLabel is hpBar for the Pokemon's current HP, or "(fainted)" once it has
+// none left.
+func hpLabel(p Pokemon) string {
+	hp, _ := strconv.Atoi(p.Stats["HP"])
+	if hp <= 0 {
+		return "(fainted)"
+	}
+	return hpBar(hp, p.MaxHP)
+}
+
+// animateDamage drains the Pokemon's hpBar from fromHP down to toHP over
+// DAMAGE_ANIMATION. With -fast only the final bar is drawn.
+func animateDamage(pokemonName string, fromHP, toHP, maxHP int) {
+	toHP = max(toHP, 0)
+	frames := ANIMATION_FRAMES
+	if FAST {
+		frames = 1
+	}
+	width := utf8.RuneCountInString(hpBar(fromHP, maxHP))
+	for i := 1; i <= frames; i++ {
+		hp := fromHP - (fromHP-toHP)*i/frames
+		// Pad to the starting width so shorter numbers leave nothing behind
+		bar := hpBar(hp, maxHP)
+		fmt.Printf("\r%-16s %s%s", pokemonName+":", bar, strings.Repeat(" ", max(width-utf8.RuneCountInString(bar), 0)))
+		if !FAST {
+			time.Sleep(DAMAGE_ANIMATION / ANIMATION_FRAMES)
+		}
+	}
+	fmt.Println()
+	if !FAST {
+		// Leave the result on screen for a moment
+		time.Sleep(DAMAGE_ANIMATION / 3)
+	}
+}
+
+// pokemonImagePath returns where the sprite downloaded by pokemon_images for
+// the given Pokemon ID is stored. Sprites are named by zero-padded National
+// Dex ID, e.g. pokemon_025.png.
+func pokemonImagePath(id string) string {
+	if n, err := strconv.Atoi(id); err == nil {
+		id = fmt.Sprintf("%03d", n)
+	}
+	return filepath.Join(IMAGE_DIR, "pokemon_"+id+".png")
+}
+
+// renderImageASCII loads a PNG and renders it as ASCII art that is 'width'
+// characters wide, mapping darker pixels to denser characters. Transparent
+// pixels are left blank.
+func renderImageASCII(path string, width int) (string, error) {
+	file, err := os.Open(path)
+	if err != nil {
+		return "", err
+	}
+	defer file.Close()
+
+	img, _, err := image.Decode(file)
+	if err != nil {
+		return "", err
+	}
+
+	bounds := img.Bounds()
+	if width <= 0 || bounds.Dx() == 0 || bounds.Dy() == 0 {
+		return "", fmt.Errorf("cannot render %s at width %d", path, width)
+	}
+
+	// Terminal cells are roughly twice as tall as they are wide
+	cellW := float64(bounds.Dx()) / float64(width)
+	cellH := cellW * 2
+	height := int(float64(bounds.Dy()) / cellH)
+	if height < 1 {
+		height = 1
+	}
+
+	var sb strings.Builder
+	for row := 0; row < height; row++ {
+		for col := 0; col < width; col++ {
+			// Average the luminance and alpha of every pixel in this cell
+			x0 := bounds.Min.X + int(float64(col)*cellW)
+			y0 := bounds.Min.Y + int(float64(row)*cellH)
+			x1 := max(x0+1, bounds.Min.X+int(float64(col+1)*cellW))
+			y1 := max(y0+1, bounds.Min.Y+int(float64(row+1)*cellH))
+
+			var lum, alpha, count float64
+			for y := y0; y < y1 && y < bounds.Max.Y; y++ {
+				for x := x0; x < x1 && x < bounds.Max.X; x++ {
+					r, g, b, a := img.At(x, y).RGBA()
+					lum += 0.299*float64(r) + 0.587*float64(g) + 0.114*float64(b)
+					alpha += float64(a)
+					count++
+				}
+			}
+			if count == 0 || alpha/count < 0x8000 {
+				sb.WriteByte(' ')
+				continue
+			}
+
+			// Colors are alpha-premultiplied, so normalize by alpha
+			brightness := lum / alpha
+			idx := int(brightness * float64(len(ASCII_RAMP)-1))
+			sb.WriteByte(ASCII_RAMP[min(max(idx, 0), len(ASCII_RAMP)-1)])
+		}
+		sb.WriteByte('\n')
+	}
+	return sb.String(), nil
+}
+
 // ----------------------------------------------------------------------------------
 // FUNCTIONS TO DISPLAY/SHOW NEW POKEMON & BATTLE-RELATED SCENES
 // ----------------------------------------------------------------------------------
@@ -250,11 +733,14 @@ func showNewPokemon(pokemon Pokemon) {
 	drawStats(pokemon)
 
 	// Then show Pokemon image
-	//////////////////////////////////////////////////////////////
-	//////////////////////////////////////////////////////////////
+	if art, err := renderImageASCII(pokemonImagePath(pokemon.ID), 40); err == nil {
+		fmt.Println(art)
+	}
 
-	// Add this Pokemon to pokeBalls
-	pokeBalls = append(pokeBalls, pokemon)
+	// Add this Pokemon to the party, or the box if the party is full
+	if storeCaught(newPokemon(pokemon)) {
+		fmt.Println("Your party is full, " + pokemon.Name + " was sent to your box.")
+	}
 
 	// Pause a bit
 	time.Sleep(2 * time.Second)
@@ -277,39 +763,130 @@ func displayDeck() {
 		fmt.Print("\t", i+1)
 		fmt.Print(". " + pokeBalls[i].Name)
 
+		fmt.Println()
+		fmt.Println(typeSummary(pokeBalls[i]))
+		fmt.Println("\tHP " + hpLabel(pokeBalls[i]))
+
 		// Then show Pokemon image
-		//////////////////////////////////////////////////////////////
-		//////////////////////////////////////////////////////////////
+		if art, err := renderImageASCII(pokemonImagePath(pokeBalls[i].ID), 24); err == nil {
+			fmt.Println(art)
+		}
+	}
+}
 
-		fmt.Println()
+// typeSummary lists which types p hits super effectively and how every
+// attacking type fares against it, so the player can weigh matchups before
+// picking a team.
+func typeSummary(p Pokemon) string {
+	var strong, weak, resists, immune []string
+	for _, t := range protocol.TYPES {
+		for _, own := range p.Types {
+			if protocol.TypeMultiplier(own, []string{t}) > 1 {
+				strong = append(strong, t)
+				break
+			}
+		}
+		switch m := protocol.TypeMultiplier(t, p.Types); {
+		case m == 0:
+			immune = append(immune, t)
+		case m >= 4:
+			weak = append(weak, t+" (4x)")
+		case m > 1:
+			weak = append(weak, t)
+		case m < 1:
+			resists = append(resists, t)
+		}
+	}
+
+	list := func(types []string) string {
+		if len(types) == 0 {
+			return "-"
+		}
+		return strings.Join(types, ", ")
 	}
+	return fmt.Sprintf("\t   Strong vs: %s\n\t   Weak to:   %s\n\t   Resists:   %s\n\t   Immune to: %s",
+		list(strong), list(weak), list(resists), list(immune))
 }
 
 // ----------------------------------------------------------------------------------
 // SERVER COMMUNICATION & EVENT HANDLING
 // ----------------------------------------------------------------------------------
 
+// showPokedex pauses the board and pages through every Pokemon in pokeBalls
+// until the player presses ESC. It must be called from the goroutine that
+// owns the keyboard.
+func showPokedex() {
+	PAUSED = true
+	defer func() {
+		PAUSED = false
+		if DRAWBOARD {
+			drawBoard(BOARD)
+		}
+	}()
+
+	page := 0
+	for {
+		pages := (len(pokeBalls) + POKEDEX_PAGE_SIZE - 1) / POKEDEX_PAGE_SIZE
+		if page >= pages {
+			page = pages - 1
+		}
+		if page < 0 {
+			page = 0
+		}
+
+		clearScreen()
+		fmt.Println("POKEDEX")
+		fmt.Println("---------------------------------")
+		if len(pokeBalls) == 0 {
+			fmt.Println("You haven't caught any Pokemon yet.")
+		}
+		start := page * POKEDEX_PAGE_SIZE
+		for i := start; i < start+POKEDEX_PAGE_SIZE && i < len(pokeBalls); i++ {
+			fmt.Printf("#%d\n", i+1)
+			drawStats(pokeBalls[i])
+		}
+		fmt.Printf("Page %d/%d - left/right to browse, ESC to return\n", page+1, max(pages, 1))
+
+		char, key, err := keyboard.GetKey()
+		if err != nil {
+			return
+		}
+		switch {
+		case key == keyboard.KeyEsc:
+			return
+		case key == keyboard.KeyArrowRight || char == 'n':
+			page++
+		case key == keyboard.KeyArrowLeft || char == 'b':
+			page--
+		}
+	}
+}
+
 // readFromServer constantly reads data from the server, parses it, and updates local state.
-func readFromServer(conn net.Conn) {
+func readFromServer(conn *serverConn) {
+	// Messages are handled on their own goroutine so that pings are answered
+	// even while a handler is waiting for the player's input
+	messages := make(chan map[string]string, 1024)
+	go processServerMessages(conn, messages)
+
 	for {
-		buf := make([]byte, 2048)
-		n, err := conn.Read(buf)
+		// Every server message is a single length-prefixed frame
+		data, err := protocol.ReadFrame(conn)
 		if err != nil {
 			// If there's an error, likely the server closed connection
 			fmt.Println("Server disconnected.")
-			os.Exit(0)
-		}
-
-		data := bytes.TrimSpace(buf[:n])
-		if !json.Valid(data) {
-			// Try to repair the JSON
-			repairedJSON := repairJSON(data)
-			if json.Valid(repairedJSON) {
-				data = repairedJSON
-			} else {
-				fmt.Printf("Invalid JSON received: %s", string(data))
-				return
+			w, ok := conn.reconnect()
+			if !ok {
+				os.Exit(0)
 			}
+			// The party is reloaded with the battle state, on the goroutine
+			// that owns both
+			welcome, _ := json.Marshal(w)
+			messages <- map[string]string{RECONNECTED: string(welcome)}
+			for _, msg := range welcomeMessages(w) {
+				messages <- msg
+			}
+			continue
 		}
 
 		var locations map[string]string
@@ -324,24 +901,33 @@ func readFromServer(conn net.Conn) {
 			default:
 				fmt.Printf("JSON unmarshal error: %v", err)
 			}
-			return
+			// Skip the broken frame, the next one may be fine
+			fmt.Println()
+			continue
+		}
+
+		// Answer keepalive pings right away
+		if _, ok := locations["ping"]; ok && len(locations) == 1 {
+			conn.Write([]byte("pong\n"))
+			continue
 		}
 
+		messages <- locations
+	}
+}
+
+// processServerMessages handles the messages forwarded by readFromServer in
+// order and redraws the board after each one.
+func processServerMessages(conn net.Conn, messages <-chan map[string]string) {
+	for locations := range messages {
 		// Process the (key=location or command, value=some info) map
 		handleServerMessage(conn, locations)
-		if DRAWBOARD {
+		if DRAWBOARD && !PAUSED {
 			drawBoard(BOARD)
 		}
 	}
 }
 
-func repairJSON(data []byte) []byte {
-	// Remove any trailing }{ patterns
-	str := string(data)
-	str = strings.Replace(str, "}{", ",", -1)
-	return []byte(str)
-}
-
 // handleServerMessage goes through each key-value in the server message and acts accordingly.
 func handleServerMessage(conn net.Conn, locations map[string]string) {
 	for location, id := range locations {
@@ -352,6 +938,40 @@ func handleServerMessage(conn net.Conn, locations map[string]string) {
 		if loc == "battle" {
 			DRAWBOARD = false
 			handleBattleMessage(conn, val)
+		} else if loc == RECONNECTED {
+			// Format: the Welcome of the new login as JSON
+			resetSession()
+			var w protocol.Welcome
+			if err := json.Unmarshal([]byte(val), &w); err == nil {
+				loadParty(w)
+			}
+		} else if loc == "board" {
+			// Format: "rows-cols", sent once on login
+			resizeBoard(val)
+		} else if loc == "spectate" {
+			handleSpectateMessage(val)
+		} else if loc == "leaderboard" {
+			showLeaderboard(val)
+		} else if loc == "catches" {
+			showCatches(val)
+		} else if loc == "box" {
+			handleBoxReply(val)
+		} else if loc == "release" {
+			handleReleaseReply(val)
+		} else if loc == "admin" {
+			fmt.Println("Admin command " + val)
+		} else if loc == "catch" {
+			// Format: "<catcher>-<pokemonID>", someone beat us to a Pokemon
+			catcher, id, _ := strings.Cut(val, "-")
+			name := "the Pokemon"
+			if pokemon, ok := pokemonByID(id); ok {
+				name = pokemon.Name
+			}
+			fmt.Printf("Too slow! %s caught %s first.\n", catcher, name)
+		} else if loc == "server" && val == "shutdown" {
+			// The server is going away on purpose
+			fmt.Println("Server is shutting down")
+			os.Exit(0)
 		} else {
 			// 2) MAP UPDATES: Could be Pokemon spawn, player movement, or disconnection
 			handleMapUpdate(conn, loc, val)
@@ -380,40 +1000,113 @@ func handleServerMessage(conn net.Conn, locations map[string]string) {
 // 	// }
 // }
 
+// resetBattleState clears everything left over from the battle, so the next
+// one starts clean.
+func resetBattleState() {
+	chosenPokemons = nil
+	currentPokemon = 0
+}
+
+// addToTeam puts a copy of p into the battle team. pokeBalls is never touched
+// by a battle, so every Pokemon comes back from it at full health, win or
+// lose, and none can be lost or duplicated.
+func addToTeam(p Pokemon) {
+	chosenPokemons = append(chosenPokemons, newPokemon(p))
+}
+
+// applyAttack records that the team's Pokemon at index was left with hp,
+// removing it from the team once it faints.
+func applyAttack(index, hp int) {
+	if index < 0 || index >= len(chosenPokemons) {
+		return
+	}
+	if hp <= 0 {
+		chosenPokemons = append(chosenPokemons[:index], chosenPokemons[index+1:]...)
+		return
+	}
+	chosenPokemons[index].Stats["HP"] = strconv.Itoa(hp)
+}
+
+// parseAttacked parses an "attacked-HP-Damage-Index[-flag,flag...]" battle
+// message. It fails unless every number parses and Index is a Pokemon in
+// chosenPokemons, so callers can use the result without further checks.
+func parseAttacked(message string) (hp, damage, index int, flags string, err error) {
+	parts := strings.Split(message, "-")
+	if len(parts) != 4 && len(parts) != 5 {
+		return 0, 0, 0, "", fmt.Errorf("want 4 or 5 fields, got %d", len(parts))
+	}
+	if parts[0] != "attacked" {
+		return 0, 0, 0, "", fmt.Errorf("not an attacked message")
+	}
+	numbers := make([]int, 3)
+	for i, part := range parts[1:4] {
+		if numbers[i], err = strconv.Atoi(part); err != nil {
+			return 0, 0, 0, "", err
+		}
+	}
+	hp, damage, index = numbers[0], numbers[1], numbers[2]
+	if index < 0 || index >= len(chosenPokemons) {
+		return 0, 0, 0, "", fmt.Errorf("index %d is not in a team of %d", index, len(chosenPokemons))
+	}
+	if damage < 0 {
+		return 0, 0, 0, "", fmt.Errorf("negative damage %d", damage)
+	}
+	if len(parts) == 5 {
+		flags = parts[4]
+	}
+	return hp, damage, index, flags, nil
+}
+
+// sendBattleAction sends a battle action on behalf of USERNAME.
+func sendBattleAction(conn net.Conn, action protocol.BattleAction) {
+	action.Player = USERNAME
+	line, err := protocol.EncodeBattleAction(action)
+	checkError(err)
+	sendCommand(conn, string(line))
+}
+
+// sendCommand writes a line to the server. A broken connection isn't fatal,
+// the reader is already logging back in, so the player is only told that the
+// command didn't reach the server.
+func sendCommand(conn net.Conn, line string) {
+	if _, err := conn.Write([]byte(line)); err != nil {
+		fmt.Println("Not sent, the connection to the server is down:", err)
+	}
+}
+
 // handleBattleMessage processes messages that come in with a "battle" key.
 func handleBattleMessage(conn net.Conn, message string) {
 
 	if strings.HasPrefix(message, "attacked") {
-		// Format: "attacked-HP-DameReceived-Index"
-		parts := strings.Split(message, "-")
-		damage, _ := strconv.Atoi(parts[2])
-		receivedIndex, _ := strconv.Atoi(parts[3])
-		if len(parts) >= 3 {
-			newHP, _ := strconv.Atoi(parts[1])
-			attackedIndex, _ := strconv.Atoi(parts[3])
-			if newHP <= 0 && attackedIndex < len(chosenPokemons) {
-				if len(chosenPokemons) > 0 {
-					clearScreen()
-					fmt.Println("You has been attacked!!!")
-					fmt.Println(chosenPokemons[receivedIndex].Name, " receive ", damage, " Damage!!!!")
-				}
-				time.Sleep(2 * time.Second)
-				clearScreen()
-
-				// Remove the fainted Pokemon
-				chosenPokemons = append(chosenPokemons[:attackedIndex], chosenPokemons[attackedIndex+1:]...)
-			} else if attackedIndex < len(chosenPokemons) {
-				if len(chosenPokemons) > 0 {
-					clearScreen()
-					fmt.Println("You has been attacked!!!")
-					fmt.Println(chosenPokemons[receivedIndex].Name, " receive ", damage, " Damage!!!!")
-				}
-				time.Sleep(2 * time.Second)
-				clearScreen()
+		// Format: "attacked-HP-DameReceived-Index[-flag,flag...]"
+		newHP, damage, attackedIndex, flags, err := parseAttacked(message)
+		if err != nil {
+			log.Printf("Ignoring malformed battle message %q: %v", message, err)
+			return
+		}
 
-				chosenPokemons[attackedIndex].Stats["HP"] = strconv.Itoa(newHP)
-			}
+		clearScreen()
+		fmt.Println("You has been attacked!!!")
+		if hasFlag(flags, "special") {
+			fmt.Println("Special attack!")
 		}
+		if hasFlag(flags, "crit") {
+			fmt.Println("Critical hit!")
+		}
+		fmt.Println(chosenPokemons[attackedIndex].Name, " receive ", damage, " Damage!!!!")
+		oldHP, _ := strconv.Atoi(chosenPokemons[attackedIndex].Stats["HP"])
+		animateDamage(chosenPokemons[attackedIndex].Name, oldHP, newHP, chosenPokemons[attackedIndex].MaxHP)
+		clearScreen()
+
+		// Fainted Pokemon are removed from the team
+		applyAttack(attackedIndex, newHP)
+
+	} else if strings.HasPrefix(message, "missed") {
+		// Format: "missed-Index"
+		clearScreen()
+		fmt.Println("The attack missed!")
+		time.Sleep(2 * time.Second)
+		clearScreen()
 
 	} else if message == USERNAME {
 		// Means it's my turn
@@ -425,8 +1118,7 @@ func handleBattleMessage(conn net.Conn, message string) {
 
 			if len(chosenPokemons) == 0 {
 				fmt.Println("You have no more Pokemon left!")
-				time.Sleep(time.Second)
-				conn.Write([]byte("surrender-" + USERNAME + "\n"))
+				sendBattleAction(conn, protocol.BattleAction{Action: protocol.ACTION_SURRENDER})
 				return
 			}
 
@@ -436,10 +1128,11 @@ func handleBattleMessage(conn net.Conn, message string) {
 
 			fmt.Println("Alive Pokemons:")
 			for i := range chosenPokemons {
-				fmt.Printf("%d) %s (HP: %s)\n", i+1, chosenPokemons[i].Name, chosenPokemons[i].Stats["HP"])
+				fmt.Printf("%d) %-12s %s\n", i+1, chosenPokemons[i].Name, hpLabel(chosenPokemons[i]))
 			}
-			fmt.Printf("\nYou are currently using: %s (HP: %s)\n", chosenPokemons[currentPokemon].Name, chosenPokemons[currentPokemon].Stats["HP"])
-			fmt.Println("Choose action: \"1. attack\" or \"2. switch <index>\"")
+			fmt.Printf("\nYou are currently using: %s %s\n", chosenPokemons[currentPokemon].Name, hpLabel(chosenPokemons[currentPokemon]))
+			fmt.Println("Choose action:")
+			printControls(BATTLE_ACTIONS)
 			fmt.Print("=> ")
 			var action string
 			scanner := bufio.NewScanner(os.Stdin)
@@ -447,8 +1140,19 @@ func handleBattleMessage(conn net.Conn, message string) {
 				action = scanner.Text()
 			}
 
-			if strings.HasPrefix(action, "1") || strings.HasPrefix(action, "attack") {
-				conn.Write([]byte("battle-" + USERNAME + "-" + strconv.Itoa(currentPokemon) + "*attack\n"))
+			if strings.HasPrefix(action, "3") || strings.HasPrefix(action, "surrender") {
+				// Give up right away; the server answers with the victory
+				// message that returns us to the map
+				fmt.Println("You surrendered!")
+				sendBattleAction(conn, protocol.BattleAction{Action: protocol.ACTION_SURRENDER})
+				return
+			} else if strings.HasPrefix(action, "1") || strings.HasPrefix(action, "attack") {
+				move, ok := chooseMove(chosenPokemons[currentPokemon], scanner)
+				if !ok {
+					clearScreen()
+					continue
+				}
+				sendBattleAction(conn, protocol.BattleAction{Action: protocol.ACTION_ATTACK, Index: currentPokemon, Move: move})
 				isLooping = false
 				break
 			} else if strings.HasPrefix(action, "switch") || strings.HasPrefix(action, "2") {
@@ -459,7 +1163,7 @@ func handleBattleMessage(conn net.Conn, message string) {
 						currentPokemon = idx - 1
 						clearScreen()
 						fmt.Println("You switch your pokemon to " + chosenPokemons[currentPokemon].Name + "!")
-						conn.Write([]byte("battle-" + USERNAME + "-" + strconv.Itoa(currentPokemon) + "*switch\n"))
+						sendBattleAction(conn, protocol.BattleAction{Action: protocol.ACTION_SWITCH, Index: currentPokemon})
 					} else if idx >= 1 && idx <= len(chosenPokemons) && idx == currentPokemon+1 {
 						clearScreen()
 						fmt.Println("You are using this pokemon, please try again!!")
@@ -476,95 +1180,418 @@ func handleBattleMessage(conn net.Conn, message string) {
 	} else if message == "wait" {
 		clearScreen()
 		fmt.Println("It is your opponent's turn. Please wait...")
+	} else if message == "invalid-move" {
+		// The server doesn't know the move we picked, our turn comes again
+		fmt.Println("That move can't be used, choose again.")
+		time.Sleep(2 * time.Second)
+	} else if strings.HasPrefix(message, "rejected-") {
+		// Format: "rejected-<pokemonID>", the server doesn't think we own it
+		fmt.Println("The server rejected Pokemon", strings.TrimPrefix(message, "rejected-")+": you don't own it.")
+	} else if strings.HasPrefix(message, "timeout_") {
+		// Format: "timeout_<username>", the server attacked on their behalf
+		player := strings.TrimPrefix(message, "timeout_")
+		if player == USERNAME {
+			fmt.Println("\nYou took too long! Your Pokemon attacked automatically.")
+		} else {
+			fmt.Println(player, "took too long! Their Pokemon attacked automatically.")
+		}
+		time.Sleep(2 * time.Second)
 	} else if strings.HasPrefix(message, "victory_") {
 		parts := strings.Split(message, "_")
 
 		if parts[1] == USERNAME {
 			fmt.Println("Congratulation!! You are VICTORY!!")
-			pokeBalls = append(returnPokemon, pokeBalls...)
-			returnPokemon = nil
-			time.Sleep(3 * time.Second)
-			clearScreen()
-			drawTitle()
-			DRAWBOARD = true
-
-			return
 		} else {
 			fmt.Println("Sorry!! You are Lost, Try Harder next time!!")
-			pokeBalls = append(returnPokemon, pokeBalls...)
-			returnPokemon = nil
-			time.Sleep(3 * time.Second)
-			clearScreen()
-			drawTitle()
-			DRAWBOARD = true
-
-			return
 		}
+		resetBattleState()
+		time.Sleep(3 * time.Second)
+		clearScreen()
+		drawTitle()
+		DRAWBOARD = true
+
+		return
 	} else {
 		// "message" is the other player's username -> meaning a new battle started
-		displayDeck()
-		fmt.Println("You are battling against:", message)
-		fmt.Println("Select 3 of your Pokemons: ")
-		fmt.Println("---------------------------------")
-
 		chosenPokemons = []Pokemon{}
-		isColl := false
+		chosenIndexes := make(map[int]bool) // pokeBalls indexes picked so far
+
+		// Players who haven't caught MAX_TEAM_SIZE Pokemon yet battle with fewer
+		teamSize := min(MAX_TEAM_SIZE, len(pokeBalls))
+		if teamSize == 0 {
+			fmt.Println("You have no Pokemon to battle with!")
+			sendBattleAction(conn, protocol.BattleAction{Action: protocol.ACTION_SURRENDER})
+			return
+		}
+
+		// pokeBalls is left untouched while choosing so the numbering stays stable
+		showSelection := func() {
+			displayDeck()
+			fmt.Println("You are battling against:", message)
+			fmt.Printf("Select up to %d of your Pokemons (type \"done\" to finish early): \n", teamSize)
+			fmt.Println("---------------------------------")
+			if len(chosenPokemons) > 0 {
+				fmt.Println("You choosed: ")
+				for i := range chosenPokemons {
+					fmt.Println("\t ", i+1, ". "+chosenPokemons[i].Name)
+				}
+			}
+		}
+		showSelection()
 
-		for len(chosenPokemons) < 3 {
+		for len(chosenPokemons) < teamSize {
 			fmt.Print("Name: ")
 			scanner := bufio.NewScanner(os.Stdin)
 			if !scanner.Scan() {
 				continue
 			}
-			DeckIDSc := scanner.Text()
-			var DeckID int
-			foundID := false
-			foundName := false
-
-			if isNumber(DeckIDSc) {
-				DeckID, _ = strconv.Atoi(DeckIDSc)
-				DeckID--
-
-				if DeckID >= len(pokeBalls) || DeckID < 0 {
-					foundID = false
-				} else {
-					for _, p := range pokeBalls {
-						if pokeBalls[DeckID].Name == p.Name {
-							chosenPokemons = append(chosenPokemons, p)
-							returnPokemon = append(returnPokemon, p)
-							pokeBalls = append(pokeBalls[:DeckID], pokeBalls[DeckID+1:]...)
-							// Let the server know which Pokemon ID we’re submitting
-							conn.Write([]byte("battle-" + USERNAME + "-" + p.ID + "\n"))
-							foundID = true
-
-							clearScreen()
-							displayDeck()
-							fmt.Println("You are battling against:", message)
-							fmt.Println("Select 3 of your Pokemons: ")
-							fmt.Println("---------------------------------")
-							fmt.Println("You choosed: ")
-							for i := range chosenPokemons {
-								fmt.Println("\t ", i+1, ". "+chosenPokemons[i].Name)
-							}
-							break
-						}
-					}
+			DeckIDSc := strings.TrimSpace(scanner.Text())
+			if DeckIDSc == "done" {
+				if len(chosenPokemons) == 0 {
+					fmt.Println("Choose at least one Pokemon first!")
+					continue
 				}
-				time.Sleep(1 * time.Second)
-			}
-			if isColl {
-				fmt.Println("You already chose this Pokemon!")
+				break
+			}
+			if !isNumber(DeckIDSc) {
+				fmt.Println("Your input Pokemon not Found!")
+				continue
 			}
 
-			if !foundID && !foundName {
+			DeckID, _ := strconv.Atoi(DeckIDSc)
+			DeckID--
+			if DeckID >= len(pokeBalls) || DeckID < 0 {
 				fmt.Println("Your input Pokemon not Found!")
+				continue
 			}
+			if chosenIndexes[DeckID] {
+				fmt.Println("You already chose this Pokemon!")
+				continue
+			}
+
+			chosenIndexes[DeckID] = true
+			p := pokeBalls[DeckID]
+			addToTeam(p)
+			// Let the server know which Pokemon ID we’re submitting
+			sendBattleAction(conn, protocol.BattleAction{Action: protocol.ACTION_SUBMIT, Pokemon: p.ID})
+
+			clearScreen()
+			showSelection()
 		}
+
+		// Tell the server our team is complete
+		sendBattleAction(conn, protocol.BattleAction{Action: protocol.ACTION_DONE})
+
 		clearScreen()
 		fmt.Println("Waiting for opponent to submit Pokemons...")
 	}
 }
 
+// onBoard reports whether x, y is a tile on the BOARD.
+func onBoard(x, y int) bool {
+	return x >= 0 && x < len(BOARD) && y >= 0 && y < len(BOARD[x])
+}
+
+// resizeBoard allocates an empty BOARD with the "rows-cols" size the server
+// reported.
+func resizeBoard(size string) {
+	parts := strings.Split(size, "-")
+	if len(parts) != 2 {
+		fmt.Println("Invalid board size from server:", size)
+		return
+	}
+	rows, errRows := strconv.Atoi(parts[0])
+	cols, errCols := strconv.Atoi(parts[1])
+	if errRows != nil || errCols != nil || rows < 1 || cols < 1 {
+		fmt.Println("Invalid board size from server:", size)
+		return
+	}
+
+	ROWS, COLS = rows, cols
+	BOARD = make([][]string, ROWS)
+	for i := range BOARD {
+		BOARD[i] = make([]string, COLS)
+	}
+}
+
+// spectatorHP shows the HP of a Pokemon in a spectated battle, which the
+// server sends without its max HP, as "(HP: 12)" or "(fainted)".
+func spectatorHP(hp string) string {
+	if n, err := strconv.Atoi(hp); err == nil && n <= 0 {
+		return "(fainted)"
+	}
+	return "(HP: " + hp + ")"
+}
+
+// handleSpectateMessage renders the state of the battle we are watching.
+// Spectators are read-only, so no action prompts are shown.
+func handleSpectateMessage(message string) {
+	var update protocol.SpectatorUpdate
+	if err := json.Unmarshal([]byte(message), &update); err != nil {
+		fmt.Println("Invalid spectator update:", err)
+		return
+	}
+
+	clearScreen()
+	if update.Battle != "" {
+		fmt.Printf("Spectating battle %s: %s vs %s\n", update.Battle, update.P1, update.P2)
+		fmt.Println("---------------------------------")
+		fmt.Println(update.P1 + ":")
+		for _, p := range update.TeamP1 {
+			fmt.Printf("\t%s %s\n", p.Name, spectatorHP(p.HP))
+		}
+		fmt.Println(update.P2 + ":")
+		for _, p := range update.TeamP2 {
+			fmt.Printf("\t%s %s\n", p.Name, spectatorHP(p.HP))
+		}
+		fmt.Println("---------------------------------")
+	}
+	fmt.Println(update.Event)
+
+	if update.Over {
+		// Back to the board once the battle is over
+		time.Sleep(3 * time.Second)
+		SPECTATING = false
+		PAUSED = false
+		return
+	}
+	fmt.Println("Press ESC to stop watching.")
+}
+
+// showLeaderboard draws the leaderboard the server sent as a table. It stays
+// on screen until the player presses a key.
+func showLeaderboard(message string) {
+	var entries []LeaderboardEntry
+	if err := json.Unmarshal([]byte(message), &entries); err != nil {
+		fmt.Println("Invalid leaderboard:", err)
+		return
+	}
+
+	clearScreen()
+	fmt.Println("LEADERBOARD")
+	fmt.Println("-------------------------------------------")
+	fmt.Printf("%-4s %-20s %7s %8s\n", "#", "Player", "Pokemon", "EXP")
+	for i, entry := range entries {
+		name := fmt.Sprintf("%-20s", entry.Username)
+		if entry.Username == USERNAME {
+			name = colorize(name, COLOR_GREEN)
+		}
+		fmt.Printf("%-4d %s %7d %8d\n", i+1, name, entry.Pokemon, entry.Exp)
+	}
+	fmt.Println("-------------------------------------------")
+	fmt.Println("Press any key to return.")
+}
+
+// printControls prints one control per line with the keys in a column.
+func printControls(controls []control) {
+	for _, c := range controls {
+		fmt.Printf("  %-20s %s\n", c.keys, c.action)
+	}
+}
+
+// showHelp draws the controls and battle commands. Like the leaderboard it
+// stays on screen until the player presses a key.
+func showHelp() {
+	clearScreen()
+	fmt.Println("HELP")
+	fmt.Println("-------------------------------------------")
+	printControls(CONTROLS)
+	fmt.Println()
+	fmt.Println("In battle, on your turn:")
+	printControls(BATTLE_ACTIONS)
+	fmt.Println("-------------------------------------------")
+	fmt.Println("Press any key to return.")
+}
+
+// showCatches draws the catch history the server sent, oldest first. It
+// stays on screen until the player presses a key.
+func showCatches(message string) {
+	var catches []protocol.CatchRecord
+	if err := json.Unmarshal([]byte(message), &catches); err != nil {
+		fmt.Println("Invalid catch history:", err)
+		return
+	}
+
+	clearScreen()
+	fmt.Println("YOUR LATEST CATCHES")
+	fmt.Println("-------------------------------------------")
+	if len(catches) == 0 {
+		fmt.Println("Nothing caught yet.")
+	}
+	for _, catch := range catches {
+		name := "#" + catch.Pokemon
+		if pokemon, ok := pokemonByID(catch.Pokemon); ok {
+			name = pokemon.Name
+		}
+		fmt.Printf("%-16s %-14s at %s\n", catch.Time.Local().Format("Jan 02 15:04"), name, catch.At)
+	}
+	fmt.Println("-------------------------------------------")
+	fmt.Println("Press any key to return.")
+}
+
+// promptDigits shows prompt and reads digits from the keyboard, finished with
+// Enter. It must be called from the goroutine that owns the keyboard.
+func promptDigits(prompt string) string {
+	fmt.Print(prompt)
+	id := ""
+	for {
+		char, key, err := keyboard.GetKey()
+		if err != nil || key == keyboard.KeyEnter || key == keyboard.KeyEsc {
+			fmt.Println()
+			return id
+		}
+		if char >= '0' && char <= '9' {
+			id += string(char)
+			fmt.Print(string(char))
+		}
+	}
+}
+
+// promptLine shows prompt and reads a line of text from the keyboard,
+// finished with Enter. It must be called from the goroutine that owns the
+// keyboard.
+func promptLine(prompt string) string {
+	fmt.Print(prompt)
+	line := ""
+	for {
+		char, key, err := keyboard.GetKey()
+		if err != nil || key == keyboard.KeyEnter || key == keyboard.KeyEsc {
+			fmt.Println()
+			return line
+		}
+		if key == keyboard.KeySpace {
+			char = ' '
+		}
+		if unicode.IsPrint(char) {
+			line += string(char)
+			fmt.Print(string(char))
+		}
+	}
+}
+
+// promptRelease asks which Pokemon to release and, once the player confirms,
+// asks the server to release it. It must be called from the goroutine that
+// owns the keyboard.
+func promptRelease(conn net.Conn) {
+	PAUSED = true
+	defer func() { PAUSED = false }()
+
+	if len(pokeBalls) == 0 {
+		fmt.Println("You have no Pokemon to release.")
+		return
+	}
+	for i, pokemon := range pokeBalls {
+		fmt.Printf("%d. %s\n", i+1, pokemon.Name)
+	}
+	choice, err := strconv.Atoi(promptDigits("Number of the Pokemon to release: "))
+	if err != nil || choice < 1 || choice > len(pokeBalls) {
+		fmt.Println("No such Pokemon.")
+		return
+	}
+
+	pokemon := pokeBalls[choice-1]
+	fmt.Printf("Release %s? It can't be undone. (y/n) ", pokemon.Name)
+	char, _, err := keyboard.GetKey()
+	fmt.Println()
+	if err != nil || unicode.ToLower(char) != 'y' {
+		fmt.Println(pokemon.Name + " stays with you.")
+		return
+	}
+	sendCommand(conn, "release-"+pokemon.ID+"\n")
+}
+
+// storeCaught puts a newly caught Pokemon in the party, or in the box when
+// the party already holds PARTY_SIZE Pokemon, the way the server does. It
+// reports whether the Pokemon went to the box.
+func storeCaught(p Pokemon) bool {
+	if PARTY_SIZE > 0 && len(pokeBalls) >= PARTY_SIZE {
+		box = append(box, p)
+		return true
+	}
+	pokeBalls = append(pokeBalls, p)
+	return false
+}
+
+// promptBox lists the party and the box and asks which Pokemon to move from
+// one to the other, e.g. "d 2" puts the second Pokemon of the party in the
+// box and "w 1" takes the first one out of the box. The server answers with a
+// "box" message.
+func promptBox(conn net.Conn) {
+	PAUSED = true
+	defer func() { PAUSED = false }()
+
+	partyTitle := "Party:"
+	if PARTY_SIZE > 0 {
+		partyTitle = fmt.Sprintf("Party (%d/%d):", len(pokeBalls), PARTY_SIZE)
+	}
+	fmt.Println(partyTitle)
+	for i, pokemon := range pokeBalls {
+		fmt.Printf("\t%d. %s\n", i+1, pokemon.Name)
+	}
+	fmt.Println("Box:")
+	for i, pokemon := range box {
+		fmt.Printf("\t%d. %s\n", i+1, pokemon.Name)
+	}
+
+	command, number, _ := strings.Cut(promptLine("d <n> to put party Pokemon n in the box, w <n> to take box Pokemon n out: "), " ")
+	choice, err := strconv.Atoi(strings.TrimSpace(number))
+	switch {
+	case err != nil:
+		fmt.Println("No such Pokemon.")
+	case command == "d" && choice >= 1 && choice <= len(pokeBalls):
+		sendCommand(conn, "box-deposit-"+pokeBalls[choice-1].ID+"\n")
+	case command == "w" && choice >= 1 && choice <= len(box):
+		sendCommand(conn, "box-withdraw-"+box[choice-1].ID+"\n")
+	default:
+		fmt.Println("No such Pokemon.")
+	}
+}
+
+// handleBoxReply applies the server's answer to promptBox: "ok-deposit-<id>"
+// or "ok-withdraw-<id>" moves the Pokemon, "failed: <reason>" says why not.
+func handleBoxReply(val string) {
+	if reason, failed := strings.CutPrefix(val, "failed: "); failed {
+		fmt.Println("Can't do that: " + reason)
+		return
+	}
+	from, to := &pokeBalls, &box
+	id, ok := strings.CutPrefix(val, "ok-deposit-")
+	if !ok {
+		from, to = &box, &pokeBalls
+		if id, ok = strings.CutPrefix(val, "ok-withdraw-"); !ok {
+			return
+		}
+	}
+	for i, pokemon := range *from {
+		if pokemon.ID == id {
+			*from = append((*from)[:i], (*from)[i+1:]...)
+			*to = append(*to, pokemon)
+			fmt.Println("Moved " + pokemon.Name + ".")
+			return
+		}
+	}
+}
+
+// handleReleaseReply removes a released Pokemon from pokeBalls once the
+// server confirmed it. The reply is "ok-<pokemonID>" or "rejected-<pokemonID>".
+func handleReleaseReply(val string) {
+	if id, ok := strings.CutPrefix(val, "rejected-"); ok {
+		fmt.Printf("Pokemon %s can't be released while it is in your battle team.\n", id)
+		return
+	}
+	id, ok := strings.CutPrefix(val, "ok-")
+	if !ok {
+		return
+	}
+	for i, pokemon := range pokeBalls {
+		if pokemon.ID == id {
+			pokeBalls = append(pokeBalls[:i], pokeBalls[i+1:]...)
+			fmt.Println("Released " + pokemon.Name + ". Bye bye!")
+			return
+		}
+	}
+}
+
 // handleMapUpdate deals with location-based updates, such as spawning Pokemon,
 // moving players, or removing disconnected enemies.
 func handleMapUpdate(conn net.Conn, location, val string) {
@@ -579,7 +1606,9 @@ func handleMapUpdate(conn net.Conn, location, val string) {
 				if len(coords) == 2 {
 					ex, _ := strconv.Atoi(coords[0])
 					ey, _ := strconv.Atoi(coords[1])
-					BOARD[ex][ey] = ""
+					if onBoard(ex, ey) {
+						BOARD[ex][ey] = ""
+					}
 				}
 				delete(ENEMIES, eneLoc)
 				break
@@ -594,17 +1623,20 @@ func handleMapUpdate(conn net.Conn, location, val string) {
 		// Not an x-y location, might be the user’s name
 		if location == USERNAME && isNumber(val) {
 			// Means we just caught a Pokemon with ID=val
-			catchIndex, _ := strconv.Atoi(val)
-			if catchIndex >= 0 && catchIndex < len(POKEMONS) {
-				go showNewPokemon(POKEMONS[catchIndex])
+			if pokemon, ok := pokemonByID(val); ok {
+				go showNewPokemon(pokemon)
 				DRAWBOARD = false
 			}
 		}
 		return
 	}
 
-	x, _ := strconv.Atoi(parts[0])
-	y, _ := strconv.Atoi(parts[1])
+	x, errX := strconv.Atoi(parts[0])
+	y, errY := strconv.Atoi(parts[1])
+	if errX != nil || errY != nil || !onBoard(x, y) {
+		fmt.Printf("Ignoring update for invalid tile %q\n", location)
+		return
+	}
 
 	// If val is empty, it means the board tile is now cleared
 	if val == "" {
@@ -612,8 +1644,9 @@ func handleMapUpdate(conn net.Conn, location, val string) {
 		return
 	}
 
-	// If val is a number, it's a Pokemon ID placed on the board
-	if isNumber(val) {
+	// If val is a number, it's a Pokemon ID placed on the board; a Pokemon
+	// about to despawn is marked as such
+	if isNumber(val) || val == protocol.DESPAWNING {
 		BOARD[x][y] = val
 		return
 	}
@@ -622,7 +1655,9 @@ func handleMapUpdate(conn net.Conn, location, val string) {
 	if val == USERNAME {
 		// My position changed
 		// Clear old position
-		BOARD[X][Y] = ""
+		if onBoard(X, Y) {
+			BOARD[X][Y] = ""
+		}
 		X, Y = x, y
 		BOARD[X][Y] = USERNAME
 	} else {
@@ -634,7 +1669,9 @@ func handleMapUpdate(conn net.Conn, location, val string) {
 				if len(coords) == 2 {
 					ex, _ := strconv.Atoi(coords[0])
 					ey, _ := strconv.Atoi(coords[1])
-					BOARD[ex][ey] = ""
+					if onBoard(ex, ey) {
+						BOARD[ex][ey] = ""
+					}
 				}
 				delete(ENEMIES, eneLoc)
 				break
@@ -646,26 +1683,322 @@ func handleMapUpdate(conn net.Conn, location, val string) {
 	}
 }
 
-// ----------------------------------------------------------------------------------
-// MAIN FUNCTION
-// ----------------------------------------------------------------------------------
+// nearestPokemon finds the Pokemon tile closest to (x, y) by Manhattan
+// distance and returns the row and column steps to it. Ties go to the tile
+// found first, scanning row by row.
+func nearestPokemon(board [][]string, x, y int) (dx, dy, dist int, found bool) {
+	for row := range board {
+		for col, cell := range board[row] {
+			if !isNumber(cell) && cell != protocol.DESPAWNING {
+				continue
+			}
+			d := abs(row-x) + abs(col-y)
+			if !found || d < dist {
+				dx, dy, dist, found = row-x, col-y, d, true
+			}
+		}
+	}
+	return dx, dy, dist, found
+}
 
-func main() {
-	rand.Seed(time.Now().UnixNano())
+// compassDirection names the direction of a step of dx rows and dy columns,
+// with rows growing to the south, e.g. "NE".
+func compassDirection(dx, dy int) string {
+	direction := ""
+	if dx < 0 {
+		direction += "N"
+	} else if dx > 0 {
+		direction += "S"
+	}
+	if dy < 0 {
+		direction += "W"
+	} else if dy > 0 {
+		direction += "E"
+	}
+	return direction
+}
+
+// showRadar prints the direction of and distance to the nearest Pokemon
+// below the board.
+func showRadar() {
+	dx, dy, dist, found := nearestPokemon(BOARD, X, Y)
+	switch {
+	case !found:
+		fmt.Println("No Pokemon on the board right now.")
+	case dist == 1:
+		fmt.Printf("Nearest Pokemon: 1 tile %s\n", compassDirection(dx, dy))
+	default:
+		fmt.Printf("Nearest Pokemon: %d tiles %s\n", dist, compassDirection(dx, dy))
+	}
+}
+
+// typeBreakdown counts pokemons by type, in the order of protocol.TYPES, e.g.
+// "grass 2, poison 1". Pokemon with two types count towards both.
+func typeBreakdown(pokemons []Pokemon) string {
+	counts := make(map[string]int)
+	for _, pokemon := range pokemons {
+		for _, t := range pokemon.Types {
+			counts[strings.ToLower(t)]++
+		}
+	}
+	var parts []string
+	for _, t := range protocol.TYPES {
+		if counts[t] > 0 {
+			parts = append(parts, fmt.Sprintf("%s %d", t, counts[t]))
+		}
+	}
+	if len(parts) == 0 {
+		return "none"
+	}
+	return strings.Join(parts, ", ")
+}
+
+// showStats prints who and where the player is and what they have caught,
+// all from local state. Nothing is shown during a battle.
+func showStats() {
+	if !DRAWBOARD {
+		return
+	}
+	fmt.Printf("Player: %s at %d,%d\n", USERNAME, X, Y)
+	fmt.Printf("Pokemon: %d in the party, %d in the box\n", len(pokeBalls), len(box))
+	fmt.Printf("By type: %s\n", typeBreakdown(slices.Concat(pokeBalls, box)))
+}
+
+// move steps the player dx rows and dy columns if that stays on the board,
+// and tells the server the new position. Moves closer together than
+// MOVE_THROTTLE are dropped.
+func move(conn net.Conn, dx, dy int) {
+	if !onBoard(X+dx, Y+dy) || time.Since(lastMove) < MOVE_THROTTLE {
+		return
+	}
+	lastMove = time.Now()
+	BOARD[X][Y] = ""
+	X += dx
+	Y += dy
+	BOARD[X][Y] = USERNAME
+	sendCommand(conn, strconv.Itoa(X)+"-"+strconv.Itoa(Y)+"\n")
+
+	// Online the server's echo of the move redraws the board
+	if OFFLINE {
+		drawBoard(BOARD)
+	}
+}
+
+// serverConn is the connection to the server. It outlives the underlying TCP
+// connection: after a reconnect, reads and writes go to the new one.
+type serverConn struct {
+	net.Conn // the current connection, guarded by mu
+
+	mu sync.Mutex
+}
+
+// current returns the connection in use.
+func (c *serverConn) current() net.Conn {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	return c.Conn
+}
+
+func (c *serverConn) Read(b []byte) (int, error) {
+	return c.current().Read(b)
+}
+
+// Write sends b to the server. Writes during a reconnect go to the dead
+// connection and fail, so the caller knows its command was dropped; logging
+// back in resyncs the board.
+func (c *serverConn) Write(b []byte) (int, error) {
+	return c.current().Write(b)
+}
+
+// reconnect replaces the lost connection by logging back in with the cached
+// credentials, backing off between attempts. The player keeps the Pokemon
+// they had; the server welcomes us with the board again as on any login. It
+// returns that welcome and reports whether it succeeded. The lock is only
+// taken to swap the connection, so writes fail fast instead of waiting.
+func (c *serverConn) reconnect() (protocol.Welcome, bool) {
+	c.current().Close()
+
+	// The server keeps us logged in until it notices the old connection is
+	// gone, so those refusals don't use up attempts
+	staleUntil := time.Now().Add(SESSION_TIMEOUT)
+	backoff := RECONNECT_BACKOFF
+	for attempt := 1; attempt <= RECONNECT_ATTEMPTS; {
+		fmt.Printf("Reconnecting in %v (attempt %d/%d)...\n", backoff, attempt, RECONNECT_ATTEMPTS)
+		time.Sleep(backoff)
+
+		conn, w, err := connect(USERNAME, PASSWORD, false)
+		if err != nil {
+			fmt.Println(err)
+			if w.Result == ALREADY_LOGGED_IN && time.Now().Before(staleUntil) {
+				fmt.Println("Waiting for the server to close the old session...")
+				continue
+			}
+			attempt++
+			backoff *= 2
+			continue
+		}
 
-	// Connect to the server
-	conn, err := net.Dial("tcp", "localhost:8080")
+		c.mu.Lock()
+		c.Conn = conn
+		c.mu.Unlock()
+		return w, true
+	}
+	fmt.Println("Could not reconnect to the server.")
+	return protocol.Welcome{}, false
+}
+
+// resetSession forgets everything that ended with the old connection: a
+// battle, or anything we were watching. It runs on the goroutine that
+// handles server messages, which owns the battle state.
+func resetSession() {
+	resetBattleState()
+	SPECTATING, LEADERBOARD, HELP, CATCHES, PAUSED, DRAWBOARD = false, false, false, false, false, true
+	ENEMIES = make(map[string]string)
+}
+
+// connect dials the server and logs in, registering the account first if
+// asked. It returns the connection and the server's welcome.
+func connect(username, password string, register bool) (net.Conn, protocol.Welcome, error) {
+	var w protocol.Welcome
+	conn, err := net.Dial("tcp", SERVER_ADDR)
 	if err != nil {
-		fmt.Println("Error connecting to server:", err)
-		os.Exit(1)
+		return nil, w, fmt.Errorf("error connecting to server: %w", err)
 	}
 
-	defer conn.Close()
+	// Send username & password, announcing a registration first if needed,
+	// after the protocol version we speak
+	credentials := username + "\n" + password + "\n"
+	if register {
+		credentials = "register\n" + credentials
+	}
+	credentials = protocol.VERSION_PREFIX + strconv.Itoa(protocol.PROTOCOL_VERSION) + "\n" + credentials
+	if _, err := conn.Write([]byte(credentials)); err != nil {
+		conn.Close()
+		return nil, w, err
+	}
 
-	// Initialize the board
-	for i := range BOARD {
-		BOARD[i] = make([]string, COLS)
+	// The server answers with a single welcome frame
+	welcomeMsg, err := protocol.ReadFrame(conn)
+	if err != nil {
+		conn.Close()
+		return nil, w, err
+	}
+	if err := json.Unmarshal(welcomeMsg, &w); err != nil {
+		conn.Close()
+		return nil, w, fmt.Errorf("unexpected login reply: %w", err)
+	}
+	if w.Result != protocol.LOGIN_SUCCESSFUL {
+		conn.Close()
+		if w.Version != protocol.PROTOCOL_VERSION {
+			return nil, w, fmt.Errorf("the server speaks protocol version %d but this client speaks version %d, please update whichever is older", w.Version, protocol.PROTOCOL_VERSION)
+		}
+		if reason, found := strings.CutPrefix(w.Result, "failed: "); found {
+			// The server explained why, e.g. a registration with a taken username
+			return nil, w, fmt.Errorf("authentication failed: %s", reason)
+		}
+		return nil, w, fmt.Errorf("login failed, please check username/password")
+	}
+	return conn, w, nil
+}
+
+// loadParty replaces our party and box with the ones in the server's welcome
+// and returns the names of the party Pokemon. The server may have moved some
+// to the box since we last logged in, see PARTY_SIZE.
+func loadParty(w protocol.Welcome) []string {
+	PARTY_SIZE = w.Party
+	pokeBalls, box = nil, nil
+	var names []string
+	for _, id := range w.Pokemon {
+		if pokemon, ok := pokemonByID(id); ok {
+			pokeBalls = append(pokeBalls, newPokemon(pokemon))
+			names = append(names, pokemon.Name)
+		}
+	}
+	for _, id := range w.Box {
+		if pokemon, ok := pokemonByID(id); ok {
+			box = append(box, newPokemon(pokemon))
+		}
+	}
+	return names
+}
+
+// welcomeMessages turns a welcome into the server messages that set up the
+// board: its size first, then the players and the Pokemon on it. Players go
+// first since placing ourselves clears the tile we stood on before.
+func welcomeMessages(w protocol.Welcome) []map[string]string {
+	messages := []map[string]string{{"board": fmt.Sprintf("%d-%d", w.Rows, w.Cols)}}
+	for _, tiles := range []map[string]string{w.Players, w.Spawns} {
+		if len(tiles) > 0 {
+			messages = append(messages, tiles)
+		}
+	}
+	return messages
+}
+
+// offlineConn stands in for the server in -offline mode: everything written
+// to it is thrown away and nothing is ever read from it.
+func offlineConn() net.Conn {
+	client, server := net.Pipe()
+	go io.Copy(io.Discard, server)
+	return client
+}
+
+// randomFreeTile returns a random empty tile of the BOARD.
+func randomFreeTile() (int, int) {
+	for {
+		x, y := offlineRand.Intn(ROWS), offlineRand.Intn(COLS)
+		if BOARD[x][y] == "" {
+			return x, y
+		}
+	}
+}
+
+// setUpOfflineGame fabricates what the server would send on login: a board
+// with some Pokemon and enemies on it and a few caught Pokemon.
+func setUpOfflineGame() {
+	USERNAME = "offline"
+	resizeBoard(fmt.Sprintf("%d-%d", OFFLINE_ROWS, OFFLINE_COLS))
+	X, Y = randomFreeTile()
+	BOARD[X][Y] = USERNAME
+
+	for i := 1; i <= OFFLINE_ENEMIES; i++ {
+		x, y := randomFreeTile()
+		enemy := fmt.Sprintf("rival%d", i)
+		BOARD[x][y] = enemy
+		ENEMIES[fmt.Sprintf("%d-%d", x, y)] = enemy
+	}
+	if len(POKEMONS) == 0 {
+		return
 	}
+	for i := 0; i < OFFLINE_POKEMON; i++ {
+		x, y := randomFreeTile()
+		BOARD[x][y] = POKEMONS[offlineRand.Intn(len(POKEMONS))].ID
+	}
+	for i := 0; i < OFFLINE_CAUGHT; i++ {
+		pokeBalls = append(pokeBalls, newPokemon(POKEMONS[offlineRand.Intn(len(POKEMONS))]))
+	}
+}
+
+// ----------------------------------------------------------------------------------
+// MAIN FUNCTION
+// ----------------------------------------------------------------------------------
+
+func main() {
+	color := flag.Bool("color", isTerminal(os.Stdout), "draw the board with ANSI colors")
+	fog := flag.Int("fog", 0, "only reveal tiles within this many tiles of the player in each direction (0 shows the whole board)")
+	offline := flag.Bool("offline", false, "play on a made-up board without a server, for working on the UI; battles are disabled")
+	center := flag.Bool("center", false, "center the title and board in the terminal")
+	plain := flag.Bool("plain", false, "no colors or emoji, for terminals that can't show them")
+	fast := flag.Bool("fast", false, "skip battle animations")
+	seed := flag.Int64("seed", 0, "seed for the -offline board, to reproduce it (0 picks one)")
+	search := flag.String("search", "", "print the stats of the Pokemon in pokedex.json whose name or type matches, then exit")
+	flag.Parse()
+	COLOR = *color && !*plain
+	EMOJI = isTerminal(os.Stdout) && !*plain
+	CENTER = *center
+	FOG_RADIUS = *fog
+	OFFLINE = *offline
+	FAST = *fast
 
 	// Load all available Pokemons
 	POKEMONS = loadPokemons("pokedex.json")
@@ -673,109 +2006,180 @@ func main() {
 		fmt.Println("No Pokemons loaded. Check pokedex.json.")
 	}
 
-	// Authentication flow
-	scanner := bufio.NewScanner(os.Stdin)
-	fmt.Print("Username: ")
-	scanner.Scan()
-	username := scanner.Text()
-
-	fmt.Print("Password: ")
-	scanner.Scan()
-	password := scanner.Text()
-
-	// Send username & password
-	_, err = conn.Write([]byte(username + "\n"))
-	checkError(err)
-	_, err = conn.Write([]byte(password + "\n"))
+	// types.json is optional, the built-in type chart is used without it
+	chart, err := protocol.LoadTypeChart("types.json")
 	checkError(err)
+	protocol.TYPE_CHART = chart
 
-	// Get auth response
-	buf := make([]byte, 1024)
-	n, err := conn.Read(buf)
-	checkError(err)
+	if *search != "" {
+		found := findPokemon(POKEMONS, *search)
+		for _, pokemon := range found {
+			drawStats(pokemon)
+			fmt.Println()
+		}
+		fmt.Printf("%d Pokemon match %q\n", len(found), *search)
+		return
+	}
 
-	// If authenticated
-	if strings.TrimSpace(string(buf[:n])) == "successful" {
+	var conn *serverConn
+	if OFFLINE {
+		// The seed is always shown so the same board can be had again with -seed
+		if *seed == 0 {
+			*seed = time.Now().UnixNano()
+		}
+		offlineRand = rand.New(rand.NewSource(*seed))
+		setUpOfflineGame()
+		conn = &serverConn{Conn: offlineConn()}
+		drawBoard(BOARD)
+		fmt.Println("Random seed:", *seed)
+	} else {
+		// Authentication flow
+		scanner := bufio.NewScanner(os.Stdin)
+		fmt.Print("Login or register? (l/r): ")
+		scanner.Scan()
+		register := strings.HasPrefix(strings.ToLower(strings.TrimSpace(scanner.Text())), "r")
 
-		// Read second message: the 3 random Pokemon indexes
-		n, err = conn.Read(buf)
-		checkError(err)
+		fmt.Print("Username: ")
+		scanner.Scan()
+		username := scanner.Text()
 
-		// Possibly: "8-12-41"
-		pokemonIndexes := strings.Split(strings.TrimSpace(string(buf[:n])), "-")
+		fmt.Print("Password: ")
+		scanner.Scan()
+		password := scanner.Text()
 
-		// Show User Pokemon
-		for _, idxStr := range pokemonIndexes {
-			idx, err := strconv.Atoi(idxStr)
-			if err == nil && idx >= 0 && idx < len(POKEMONS) {
-				showNewPokemon(POKEMONS[idx-1])
-			}
+		tcpConn, w, err := connect(username, password, register)
+		if err != nil {
+			fmt.Println(err)
+			os.Exit(1)
 		}
+		conn = &serverConn{Conn: tcpConn}
 
 		// Mark the global username
-		USERNAME = username
+		USERNAME, PASSWORD = username, password
 
-		for !isReplay {
+		// Our Pokemon go straight into the pokeBalls; 'p' shows them in full
+		names := loadParty(w)
 
-			go readFromServer(conn)
+		// Set up the board the way the server sees it
+		for _, msg := range welcomeMessages(w) {
+			handleServerMessage(conn, msg)
+		}
+		drawBoard(BOARD)
+		fmt.Println("Your Pokemon:", strings.Join(names, ", "))
+	}
+	defer conn.Close()
 
-			// Keyboard input for controlling movement
-			if err := keyboard.Open(); err != nil {
-				fmt.Println("Failed to open keyboard:", err)
-				return
+	for !isReplay {
+
+		go readFromServer(conn)
+
+		// Keyboard input for controlling movement
+		if err := keyboard.Open(); err != nil {
+			fmt.Println("Failed to open keyboard:", err)
+			return
+		}
+		defer keyboard.Close()
+
+		fmt.Println("Use arrow keys or WASD to move, 'h' for help, ESC to exit.")
+
+		// Main game loop: read keyboard and move around
+		for {
+			char, key, err := keyboard.GetKey()
+			checkError(err)
+
+			// While watching a battle, ESC only stops watching
+			if SPECTATING {
+				if key == keyboard.KeyEsc {
+					SPECTATING = false
+					PAUSED = false
+					sendCommand(conn, "unspectate\n")
+					drawBoard(BOARD)
+				}
+				continue
 			}
-			defer keyboard.Close()
 
-			fmt.Println("Use arrow keys to move, ESC to exit.")
+			// Any key closes the leaderboard, the help or the catch history
+			if LEADERBOARD || HELP || CATCHES {
+				LEADERBOARD, HELP, CATCHES = false, false, false
+				PAUSED = false
+				drawBoard(BOARD)
+				continue
+			}
 
-			// Main game loop: read keyboard and move around
-			for {
-				_, key, err := keyboard.GetKey()
-				checkError(err)
+			if char == 'h' || char == '?' {
+				// PAUSED keeps board updates from drawing over the help
+				PAUSED = true
+				HELP = true
+				showHelp()
+				continue
+			}
 
-				switch key {
-				case keyboard.KeyArrowUp:
-					if X > 0 {
-						BOARD[X][Y] = ""
-						X--
-						BOARD[X][Y] = USERNAME
-						_, err := conn.Write([]byte(strconv.Itoa(X) + "-" + strconv.Itoa(Y) + "\n"))
-						checkError(err)
-					}
-				case keyboard.KeyArrowDown:
-					if X < ROWS-1 {
-						BOARD[X][Y] = ""
-						X++
-						BOARD[X][Y] = USERNAME
-						_, err := conn.Write([]byte(strconv.Itoa(X) + "-" + strconv.Itoa(Y) + "\n"))
-						checkError(err)
-					}
-				case keyboard.KeyArrowLeft:
-					if Y > 0 {
-						BOARD[X][Y] = ""
-						Y--
-						BOARD[X][Y] = USERNAME
-						_, err := conn.Write([]byte(strconv.Itoa(X) + "-" + strconv.Itoa(Y) + "\n"))
-						checkError(err)
-					}
-				case keyboard.KeyArrowRight:
-					if Y < COLS-1 {
-						BOARD[X][Y] = ""
-						Y++
-						BOARD[X][Y] = USERNAME
-						_, err := conn.Write([]byte(strconv.Itoa(X) + "-" + strconv.Itoa(Y) + "\n"))
-						checkError(err)
-					}
-				case keyboard.KeyEsc:
-					fmt.Println("Exiting game...")
-					return
+			if char == 'p' {
+				showPokedex()
+				continue
+			}
+			if char == 'l' {
+				PAUSED = true
+				LEADERBOARD = true
+				sendCommand(conn, "leaderboard\n")
+				continue
+			}
+			if char == 'b' {
+				promptBox(conn)
+				continue
+			}
+			if char == 'c' {
+				PAUSED = true
+				CATCHES = true
+				sendCommand(conn, "catches\n")
+				continue
+			}
+			if char == 'v' {
+				PAUSED = true
+				SPECTATING = true
+				sendCommand(conn, "spectate-"+promptDigits("Battle ID to spectate (Enter for a list): ")+"\n")
+				continue
+			}
+
+			if char == 'r' {
+				showRadar()
+				continue
+			}
+			if char == 'x' {
+				promptRelease(conn)
+				continue
+			}
+			if char == 'i' {
+				showStats()
+				continue
+			}
+			if char == '/' {
+				// Admin commands, e.g. "spawn-25-3-4"; the server refuses
+				// them from players who aren't admins
+				if command := promptLine("Admin command: "); command != "" {
+					sendCommand(conn, "admin-"+command+"\n")
 				}
+				continue
 			}
 
-		}
+			if step, ok := MOVE_KEYS[unicode.ToLower(char)]; ok {
+				move(conn, step[0], step[1])
+				continue
+			}
 
-	} else {
-		// If authentication failed
-		fmt.Println("Login failed. Please check username/password.")
+			switch key {
+			case keyboard.KeyArrowUp:
+				move(conn, -1, 0)
+			case keyboard.KeyArrowDown:
+				move(conn, 1, 0)
+			case keyboard.KeyArrowLeft:
+				move(conn, 0, -1)
+			case keyboard.KeyArrowRight:
+				move(conn, 0, 1)
+			case keyboard.KeyEsc:
+				fmt.Println("Exiting game...")
+				return
+			}
+		}
 	}
 }
@@ -0,0 +1,383 @@
+package main
+
+import (
+	"io"
+	"net"
+	"strings"
+	"testing"
+
+	"pokemon/protocol"
+)
+
+func TestTypeBreakdown(t *testing.T) {
+	pokemons := []Pokemon{
+		{Name: "Bulbasaur", Types: []string{"grass", "poison"}},
+		{Name: "Charmander", Types: []string{"Fire"}},
+		{Name: "Oddish", Types: []string{"grass", "poison"}},
+	}
+	if got, want := typeBreakdown(pokemons), "fire 1, grass 2, poison 2"; got != want {
+		t.Errorf("typeBreakdown = %q, want %q", got, want)
+	}
+	if got := typeBreakdown(nil); got != "none" {
+		t.Errorf("typeBreakdown(nil) = %q, want %q", got, "none")
+	}
+}
+
+func TestNearestPokemon(t *testing.T) {
+	board := func(rows ...[]string) [][]string { return rows }
+	tests := []struct {
+		name      string
+		board     [][]string
+		x, y      int
+		dx, dy    int
+		dist      int
+		found     bool
+		direction string
+	}{
+		{
+			name:  "empty board",
+			board: board([]string{"", ""}, []string{"me", "enemy"}),
+			x:     1, y: 0,
+		},
+		{
+			name:  "north east",
+			board: board([]string{"", "", "25"}, []string{"", "", ""}, []string{"me", "", ""}),
+			x:     2, y: 0,
+			dx: -2, dy: 2, dist: 4, found: true, direction: "NE",
+		},
+		{
+			name:  "closest wins",
+			board: board([]string{"1", "", ""}, []string{"", "", ""}, []string{"", "me", "4"}),
+			x:     2, y: 1,
+			dx: 0, dy: 1, dist: 1, found: true, direction: "E",
+		},
+		{
+			name:  "tie goes to the first row",
+			board: board([]string{"", "7", ""}, []string{"", "me", ""}, []string{"", "9", ""}),
+			x:     1, y: 1,
+			dx: -1, dy: 0, dist: 1, found: true, direction: "N",
+		},
+	}
+	for _, tt := range tests {
+		dx, dy, dist, found := nearestPokemon(tt.board, tt.x, tt.y)
+		if dx != tt.dx || dy != tt.dy || dist != tt.dist || found != tt.found {
+			t.Errorf("%s: nearestPokemon = (%d, %d, %d, %v), want (%d, %d, %d, %v)",
+				tt.name, dx, dy, dist, found, tt.dx, tt.dy, tt.dist, tt.found)
+		}
+		if found && compassDirection(dx, dy) != tt.direction {
+			t.Errorf("%s: direction = %q, want %q", tt.name, compassDirection(dx, dy), tt.direction)
+		}
+	}
+}
+
+func TestBattleConservesPokeBalls(t *testing.T) {
+	stats := func() map[string]string { return map[string]string{"HP": "40", "Speed": "50"} }
+	pokeBalls = []Pokemon{
+		newPokemon(Pokemon{ID: "1", Name: "Bulbasaur", Stats: stats()}),
+		newPokemon(Pokemon{ID: "4", Name: "Charmander", Stats: stats()}),
+		newPokemon(Pokemon{ID: "7", Name: "Squirtle", Stats: stats()}),
+	}
+	t.Cleanup(func() {
+		pokeBalls = nil
+		resetBattleState()
+	})
+
+	addToTeam(pokeBalls[2])
+	addToTeam(pokeBalls[0])
+
+	// Squirtle is hurt, then both faint one after the other
+	applyAttack(0, 10)
+	if chosenPokemons[0].Stats["HP"] != "10" {
+		t.Fatalf("Squirtle has %s HP after the hit, want 10", chosenPokemons[0].Stats["HP"])
+	}
+	applyAttack(0, 0)
+	applyAttack(0, 0)
+	if len(chosenPokemons) != 0 {
+		t.Fatalf("%d Pokemon left in the team after both fainted", len(chosenPokemons))
+	}
+	resetBattleState()
+
+	want := []string{"1", "4", "7"}
+	if len(pokeBalls) != len(want) {
+		t.Fatalf("have %d Pokemon after the battle, want %d", len(pokeBalls), len(want))
+	}
+	for i, p := range pokeBalls {
+		if p.ID != want[i] || p.Stats["HP"] != "40" {
+			t.Errorf("pokeBalls[%d] = %s with %s HP, want %s at full health", i, p.ID, p.Stats["HP"], want[i])
+		}
+	}
+}
+
+func TestParseAttacked(t *testing.T) {
+	chosenPokemons = []Pokemon{newPokemon(Pokemon{Name: "Bulbasaur", Stats: map[string]string{"HP": "45"}})}
+	defer func() { chosenPokemons = nil }()
+
+	hp, damage, index, flags, err := parseAttacked("attacked-30-15-0-crit,special")
+	if err != nil || hp != 30 || damage != 15 || index != 0 || flags != "crit,special" {
+		t.Errorf("parseAttacked = %d, %d, %d, %q, %v", hp, damage, index, flags, err)
+	}
+
+	bad := []string{
+		"attacked",
+		"attacked-30",
+		"attacked-30-15",
+		"attacked-x-15-0",
+		"attacked-30-y-0",
+		"attacked-30-15-z",
+		"attacked-30-15-1",
+		"attacked-30-15--1",
+		"attacked-30--15-0",
+		"attacked-30-15-0-crit-extra",
+	}
+	for _, message := range bad {
+		if _, _, _, _, err := parseAttacked(message); err == nil {
+			t.Errorf("parseAttacked(%q) succeeded, want an error", message)
+		}
+		// Malformed messages must leave the team alone
+		handleBattleMessage(nil, message)
+		if len(chosenPokemons) != 1 || chosenPokemons[0].Stats["HP"] != "45" {
+			t.Fatalf("%q changed the team to %+v", message, chosenPokemons)
+		}
+	}
+}
+
+func TestSetUpOfflineGame(t *testing.T) {
+	POKEMONS = []Pokemon{{ID: "1", Name: "Bulbasaur", Stats: map[string]string{"HP": "45"}}}
+	defer func() {
+		POKEMONS, BOARD, pokeBalls = nil, nil, nil
+		ENEMIES = make(map[string]string)
+	}()
+
+	setUpOfflineGame()
+	if BOARD[X][Y] != USERNAME {
+		t.Errorf("player tile %d,%d holds %q", X, Y, BOARD[X][Y])
+	}
+	pokemon := 0
+	for _, row := range BOARD {
+		for _, cell := range row {
+			if cell == "1" {
+				pokemon++
+			}
+		}
+	}
+	if pokemon != OFFLINE_POKEMON || len(ENEMIES) != OFFLINE_ENEMIES || len(pokeBalls) != OFFLINE_CAUGHT {
+		t.Errorf("offline board has %d Pokemon, %d enemies and %d caught", pokemon, len(ENEMIES), len(pokeBalls))
+	}
+}
+
+func TestFindPokemon(t *testing.T) {
+	pokemons := []Pokemon{
+		{ID: "1", Name: "Bulbasaur", Types: []string{"grass", "poison"}},
+		{ID: "4", Name: "Charmander", Types: []string{"fire"}},
+		{ID: "5", Name: "Charmeleon", Types: []string{"fire"}},
+		{ID: "23", Name: "Ekans", Types: []string{"poison"}},
+	}
+	tests := []struct {
+		query string
+		want  []string
+	}{
+		{"char", []string{"4", "5"}},
+		{"SAUR", []string{"1"}},
+		{"Poison", []string{"1", "23"}},
+		{"fir", nil}, // types must match whole
+		{"pikachu", nil},
+	}
+	for _, tt := range tests {
+		var got []string
+		for _, pokemon := range findPokemon(pokemons, tt.query) {
+			got = append(got, pokemon.ID)
+		}
+		if strings.Join(got, ",") != strings.Join(tt.want, ",") {
+			t.Errorf("findPokemon(%q) = %v, want %v", tt.query, got, tt.want)
+		}
+	}
+}
+
+func TestWelcomeMessages(t *testing.T) {
+	USERNAME = "ash"
+	X, Y = 1, 1 // where we stood before a reconnect
+	defer func() {
+		BOARD, USERNAME = nil, ""
+		ENEMIES = make(map[string]string)
+	}()
+
+	w := protocol.Welcome{
+		Result:  protocol.LOGIN_SUCCESSFUL,
+		Rows:    4,
+		Cols:    6,
+		Spawns:  map[string]string{"1-1": "25", "3-5": protocol.DESPAWNING},
+		Players: map[string]string{"2-3": "ash", "0-0": "misty"},
+	}
+	for _, msg := range welcomeMessages(w) {
+		handleServerMessage(nil, msg)
+	}
+	if len(BOARD) != 4 || len(BOARD[0]) != 6 {
+		t.Fatalf("board is %dx%d, want 4x6", len(BOARD), len(BOARD[0]))
+	}
+	if X != 2 || Y != 3 || BOARD[2][3] != "ash" {
+		t.Errorf("ash is at %d,%d, want 2,3", X, Y)
+	}
+	if BOARD[1][1] != "25" || BOARD[3][5] != protocol.DESPAWNING || ENEMIES["0-0"] != "misty" {
+		t.Errorf("board = %v, enemies = %v", BOARD, ENEMIES)
+	}
+}
+
+func TestHPBar(t *testing.T) {
+	tests := []struct {
+		current, max int
+		filled       int
+	}{
+		{45, 45, HP_BAR_WIDTH},
+		{0, 45, 0},
+		{1, 200, 1}, // alive Pokemon always show some HP
+		{30, 60, HP_BAR_WIDTH / 2},
+		{-5, 45, 0},
+		{50, 45, HP_BAR_WIDTH},
+		{12, 0, HP_BAR_WIDTH}, // unknown max HP
+	}
+	for _, tt := range tests {
+		bar := hpBar(tt.current, tt.max)
+		if filled := strings.Count(bar, "█"); filled != tt.filled || strings.Count(bar, "░") != HP_BAR_WIDTH-filled {
+			t.Errorf("hpBar(%d, %d) = %q, want %d of %d filled", tt.current, tt.max, bar, tt.filled, HP_BAR_WIDTH)
+		}
+	}
+}
+
+func TestTypeBadge(t *testing.T) {
+	defer func() { COLOR, EMOJI = false, false }()
+	for _, typ := range protocol.TYPES {
+		style, ok := TYPE_BADGES[typ]
+		if !ok || style.emoji == "" || style.color == "" {
+			t.Errorf("type %q has no badge", typ)
+			continue
+		}
+
+		COLOR, EMOJI = false, false
+		if got := typeBadge(strings.ToUpper(typ)); got != strings.ToUpper(typ) {
+			t.Errorf("plain typeBadge(%q) = %q, want the type as given", typ, got)
+		}
+		COLOR, EMOJI = true, true
+		if got, want := typeBadge(typ), style.emoji+" "+style.color+typ+COLOR_RESET; got != want {
+			t.Errorf("typeBadge(%q) = %q, want %q", typ, got, want)
+		}
+	}
+	if len(TYPE_BADGES) != len(protocol.TYPES) {
+		t.Errorf("%d type badges for %d types", len(TYPE_BADGES), len(protocol.TYPES))
+	}
+	if got := typeBadge("shadow"); got != "shadow" {
+		t.Errorf("typeBadge of an unknown type = %q, want it unchanged", got)
+	}
+}
+
+func TestScaledBar(t *testing.T) {
+	tests := []struct {
+		val, max, width int
+		want            int
+	}{
+		{0, MAX_STAT, STAT_BAR_WIDTH, 0},
+		{MAX_STAT, MAX_STAT, STAT_BAR_WIDTH, STAT_BAR_WIDTH},
+		{999, MAX_STAT, STAT_BAR_WIDTH, STAT_BAR_WIDTH}, // overflow never wraps
+		{-10, MAX_STAT, STAT_BAR_WIDTH, 0},
+		{51, MAX_STAT, STAT_BAR_WIDTH, 10},
+		{1, MAX_STAT, STAT_BAR_WIDTH, 0},
+		{10, 0, STAT_BAR_WIDTH, 0},
+	}
+	for _, tt := range tests {
+		bar := scaledBar(tt.val, tt.max, tt.width)
+		if got := strings.Count(bar, "█"); got != tt.want || len(bar) != got*len("█") {
+			t.Errorf("scaledBar(%d, %d, %d) = %q, want %d blocks", tt.val, tt.max, tt.width, bar, tt.want)
+		}
+	}
+}
+
+func TestHPLabel(t *testing.T) {
+	pokemon := func(hp string) Pokemon {
+		return Pokemon{Name: "Bulbasaur", Stats: map[string]string{"HP": hp}, MaxHP: 45}
+	}
+	for _, hp := range []string{"0", "-12"} {
+		if got := hpLabel(pokemon(hp)); got != "(fainted)" {
+			t.Errorf("hpLabel with HP %s = %q, want (fainted)", hp, got)
+		}
+		if got := spectatorHP(hp); got != "(fainted)" {
+			t.Errorf("spectatorHP(%q) = %q, want (fainted)", hp, got)
+		}
+	}
+	if got := hpLabel(pokemon("20")); !strings.HasSuffix(got, " 20/45") {
+		t.Errorf("hpLabel with HP 20 = %q, want a bar ending in 20/45", got)
+	}
+	if got := hpBar(-12, 45); strings.Contains(got, "-") {
+		t.Errorf("hpBar(-12, 45) = %q, want no negative HP", got)
+	}
+}
+
+func TestPartyAndBox(t *testing.T) {
+	PARTY_SIZE = 2
+	pokeBalls = []Pokemon{{ID: "1", Name: "Bulbasaur"}}
+	defer func() { PARTY_SIZE, pokeBalls, box = 0, nil, nil }()
+
+	if storeCaught(Pokemon{ID: "4", Name: "Charmander"}) || !storeCaught(Pokemon{ID: "7", Name: "Squirtle"}) {
+		t.Fatalf("party %v, box %v, want Squirtle alone in the box", pokeBalls, box)
+	}
+
+	handleBoxReply("ok-deposit-1")
+	handleBoxReply("failed: your party is full")
+	handleBoxReply("ok-withdraw-7")
+	handleBoxReply("ok-withdraw-99") // not in the box, ignored
+	var party, boxed []string
+	for _, p := range pokeBalls {
+		party = append(party, p.ID)
+	}
+	for _, p := range box {
+		boxed = append(boxed, p.ID)
+	}
+	if strings.Join(party, ",") != "4,7" || strings.Join(boxed, ",") != "1" {
+		t.Errorf("party %v, box %v, want [4 7] and [1]", party, boxed)
+	}
+}
+
+func TestMarginFor(t *testing.T) {
+	tests := []struct {
+		termWidth, width int
+		want             string
+	}{
+		{80, 41, strings.Repeat(" ", 19)},
+		{41, 41, ""},
+		{30, 41, ""},
+		{0, 41, ""},
+	}
+	for _, tt := range tests {
+		if got := marginFor(tt.termWidth, tt.width); got != tt.want {
+			t.Errorf("marginFor(%d, %d) = %q, want %q", tt.termWidth, tt.width, got, tt.want)
+		}
+	}
+}
+
+func TestServerConnWriteReportsErrors(t *testing.T) {
+	client, server := net.Pipe()
+	conn := &serverConn{Conn: client}
+	go io.Copy(io.Discard, server)
+
+	if _, err := conn.Write([]byte("1-2\n")); err != nil {
+		t.Fatalf("write to a live connection failed: %v", err)
+	}
+	server.Close()
+	client.Close()
+	if _, err := conn.Write([]byte("1-2\n")); err == nil {
+		t.Error("write to a closed connection reported success")
+	}
+}
+
+func TestLoadPartyReplacesStaleParty(t *testing.T) {
+	POKEMONS = []Pokemon{{ID: "1", Name: "Bulbasaur"}, {ID: "4", Name: "Charmander"}, {ID: "7", Name: "Squirtle"}}
+	pokeBalls = []Pokemon{{ID: "1", Name: "Bulbasaur"}, {ID: "4", Name: "Charmander"}, {ID: "7", Name: "Squirtle"}}
+	defer func() { POKEMONS, PARTY_SIZE, pokeBalls, box = nil, 0, nil, nil }()
+
+	// The server boxed Squirtle when we logged back in
+	names := loadParty(protocol.Welcome{Party: 2, Pokemon: []string{"1", "4"}, Box: []string{"7"}})
+	if strings.Join(names, ",") != "Bulbasaur,Charmander" || PARTY_SIZE != 2 {
+		t.Errorf("party %v with size %d, want Bulbasaur and Charmander with size 2", names, PARTY_SIZE)
+	}
+	if len(pokeBalls) != 2 || len(box) != 1 || box[0].ID != "7" {
+		t.Errorf("party %v, box %v, want Squirtle alone in the box", pokeBalls, box)
+	}
+}
@@ -3,14 +3,19 @@ package main
 import (
 	"context"
 	"encoding/json"
+	"flag"
 	"fmt"
 	"log"
 	"os"
-	"strings"
+	"path/filepath"
+	"slices"
+	"strconv"
+	"sync"
 	"time"
 
 	"github.com/chromedp/chromedp"
-	"github.com/gocolly/colly"
+
+	"pokemon/protocol"
 )
 
 type Pokemon struct {
@@ -19,60 +24,353 @@ type Pokemon struct {
 	Types []string          `json:"types"`
 	Stats map[string]string `json:"stats"`
 	EXP   string            `json:"exp"`
+
+	// DamageMultipliers maps an attacking type to the multiplier this Pokemon
+	// takes from it, e.g. "fire": "2x". Only non-neutral types are listed.
+	DamageMultipliers map[string]string `json:"damageMultipliers,omitempty"`
 }
 
-func main() {
-	// Create context
-	ctx, cancel := chromedp.NewContext(context.Background())
-	defer cancel()
+const (
+	MAX_ATTEMPTS    = 3                // attempts per Pokemon before giving up
+	RETRY_BACKOFF   = 2 * time.Second  // delay before the first retry, doubled each time
+	ATTEMPT_TIMEOUT = 60 * time.Second // time limit for a single attempt
+	LOAD_TIMEOUT    = 20 * time.Second // time limit for the page to show the Pokemon
+	FAILED_FILE     = "failed.json"    // IDs that could not be scraped
+	CHECKPOINT_SIZE = 10               // scraped Pokemon between checkpoints
+	POLITE_DELAY    = 2 * time.Second  // pause between two pages of the same worker
+	CLEAR_LINE      = "\r\033[K"       // moves to the start of the line and blanks it
+)
 
-	// Extend the timeout for our operations to 120 seconds
-	ctx, cancel = context.WithTimeout(ctx, 900*time.Second)
+// checkWritable makes sure a file can be created in the directory of path
+// before a long scrape is started.
+func checkWritable(path string) error {
+	probe, err := os.CreateTemp(filepath.Dir(path), ".pokedex-*")
+	if err != nil {
+		return err
+	}
+	probe.Close()
+	return os.Remove(probe.Name())
+}
+
+// printProgress overwrites the current line with how many of total Pokemon
+// are done and an estimate of the time left, based on the average time per
+// Pokemon so far. Other output must start with CLEAR_LINE to not run into it.
+func printProgress(done, total, lastID int, elapsed time.Duration) {
+	eta := "?"
+	if done > 0 {
+		eta = (elapsed / time.Duration(done) * time.Duration(total-done)).Round(time.Second).String()
+	}
+	fmt.Printf("%s[%d/%d] %3d%% | last ID %d | ETA %s", CLEAR_LINE, done, total, done*100/total, lastID, eta)
+}
+
+// scrapePokemon extracts a single Pokemon's data from pokedex.org.
+func scrapePokemon(ctx context.Context, id int) (Pokemon, error) {
+	ctx, cancel := context.WithTimeout(ctx, ATTEMPT_TIMEOUT)
 	defer cancel()
 
-	var pokemons []Pokemon
+	// Go on as soon as the data is on the page. The national ID must match,
+	// because a reused tab still shows the previous Pokemon for a moment.
+	loadCtx, cancelLoad := context.WithTimeout(ctx, LOAD_TIMEOUT)
+	defer cancelLoad()
+	err := chromedp.Run(loadCtx,
+		chromedp.Navigate(fmt.Sprintf("https://pokedex.org/#/pokemon/%d", id)),
+		chromedp.Poll(fmt.Sprintf(`parseInt(document.querySelector(".detail-header .detail-national-id")?.innerText.replace("#", "")) === %d`, id), nil,
+			chromedp.WithPollingTimeout(LOAD_TIMEOUT)),
+		chromedp.WaitVisible(".detail-panel-header"),
+		chromedp.WaitVisible(".detail-types span.monster-type"),
+		chromedp.WaitVisible(".detail-stats-row .stat-bar-fg"),
+	)
+	if err != nil {
+		return Pokemon{}, fmt.Errorf("page did not load: %w", err)
+	}
 
-	// Navigate and extract data from pokedex.org
-	for i := 1; i <= 200; i++ {
+	var pokemon Pokemon
+	err = chromedp.Run(ctx,
+		chromedp.Evaluate(`document.querySelector(".detail-header .detail-national-id").innerText.replace("#", "")`, &pokemon.ID),
+		chromedp.Evaluate(`document.querySelector(".detail-panel-header").innerText`, &pokemon.Name),
+		chromedp.Evaluate(`Array.from(document.querySelectorAll('.detail-types span.monster-type')).map(elem => elem.innerText)`, &pokemon.Types),
+		chromedp.Evaluate(`Object.fromEntries(Array.from(document.querySelectorAll('.detail-stats-row')).map(row => {
+			const label = row.querySelector('span:first-child').innerText;
+			const value = row.querySelector('.stat-bar-fg').innerText;
+			return [label, value];
+		}))`, &pokemon.Stats),
+		// Some pages don't render the "when attacked" section, which yields {}
+		chromedp.Evaluate(`Object.fromEntries(Array.from(document.querySelectorAll('.when-attacked-row')).map(row => {
+			const types = row.querySelectorAll('span.monster-type');
+			const multipliers = row.querySelectorAll('span.monster-multiplier');
+			return Array.from(types).map((type, index) => {
+				const key = type.innerText.trim().toLowerCase();
+				const value = multipliers[index]?.innerText.trim() || '';
+				return key && value ? [key, value] : null;
+			}).filter(pair => pair !== null);
+		}).flat())`, &pokemon.DamageMultipliers),
+	)
+	if err != nil {
+		return Pokemon{}, err
+	}
+	// A half-rendered page can miss stats; treat it as a failed attempt
+	if err := protocol.ValidateStats(pokemon.Stats); err != nil {
+		return Pokemon{}, err
+	}
+	if len(pokemon.DamageMultipliers) == 0 {
+		fmt.Printf("%sNo damage multipliers found for Pokemon ID %d\n", CLEAR_LINE, id)
+		pokemon.DamageMultipliers = nil
+	}
+	return pokemon, nil
+}
+
+// scrapeWithRetry calls scrapePokemon up to MAX_ATTEMPTS times, backing off
+// exponentially between attempts.
+func scrapeWithRetry(ctx context.Context, id int) (Pokemon, error) {
+	backoff := RETRY_BACKOFF
+	var err error
+	for attempt := 1; attempt <= MAX_ATTEMPTS; attempt++ {
 		var pokemon Pokemon
-		err := chromedp.Run(ctx,
-			chromedp.Navigate(fmt.Sprintf("https://pokedex.org/#/pokemon/%d", i)),
-			chromedp.Sleep(5*time.Second),
-			chromedp.Evaluate(`document.querySelector(".detail-header .detail-national-id").innerText.replace("#", "")`, &pokemon.ID),
-			chromedp.Evaluate(`document.querySelector(".detail-panel-header").innerText`, &pokemon.Name),
-			chromedp.Evaluate(`Array.from(document.querySelectorAll('.detail-types span.monster-type')).map(elem => elem.innerText)`, &pokemon.Types),
-			chromedp.Evaluate(`Object.fromEntries(Array.from(document.querySelectorAll('.detail-stats-row')).map(row => {
-				const label = row.querySelector('span:first-child').innerText;
-				const value = row.querySelector('.stat-bar-fg').innerText;
-				return [label, value];
-			}))`, &pokemon.Stats),
-			// chromedp.Evaluate(`Object.fromEntries(Array.from(document.querySelectorAll('.when-attacked-row')).map(row => {
-			// 	const types = row.querySelectorAll('span.monster-type');
-			// 	const multipliers = row.querySelectorAll('span.monster-multiplier');
-			// 	return Array.from(types).map((type, index) => {
-			// 		const key = type.innerText.trim();
-			// 		const value = multipliers[index]?.innerText.trim() || '';
-			// 		return key && value ? [key, value] : null;
-			// 	}).filter(pair => pair !== null);
-			// }).flat())`, &pokemon.DamageMultipliers),
-		)
-		if err != nil {
-			log.Fatalf("Failed to extract data for ID %d: %v", i, err)
+		pokemon, err = scrapePokemon(ctx, id)
+		if err == nil {
+			return pokemon, nil
+		}
+		if attempt < MAX_ATTEMPTS {
+			fmt.Printf("%sAttempt %d/%d for ID %d failed: %v (retrying in %v)\n", CLEAR_LINE, attempt, MAX_ATTEMPTS, id, err, backoff)
+			time.Sleep(backoff)
+			backoff *= 2
 		}
-		pokemons = append(pokemons, pokemon)
-		fmt.Printf("Crawled data for Pokemon ID %d\n", i)
 	}
+	return Pokemon{}, fmt.Errorf("ID %d failed after %d attempts: %w", id, MAX_ATTEMPTS, err)
+}
 
-	// Save to JSON file
-	file, err := os.Create("pokedex.json")
+// scrapeResult is the outcome of scraping the Pokemon with the given ID.
+type scrapeResult struct {
+	id      int
+	pokemon Pokemon
+	err     error
+}
+
+// scrapeAll scrapes ids with the given number of workers, each in its own
+// browser tab, and sends every outcome on the returned channel. The channel
+// is closed once all ids are done.
+func scrapeAll(ctx context.Context, ids []int, workers int) <-chan scrapeResult {
+	jobs := make(chan int)
+	results := make(chan scrapeResult)
+
+	var wg sync.WaitGroup
+	for w := 0; w < workers; w++ {
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			tabCtx, cancel := chromedp.NewContext(ctx)
+			defer cancel()
+			for id := range jobs {
+				pokemon, err := scrapeWithRetry(tabCtx, id)
+				results <- scrapeResult{id: id, pokemon: pokemon, err: err}
+				time.Sleep(POLITE_DELAY)
+			}
+		}()
+	}
+
+	go func() {
+		for _, id := range ids {
+			jobs <- id
+		}
+		close(jobs)
+	}()
+	go func() {
+		wg.Wait()
+		close(results)
+	}()
+	return results
+}
+
+// sortByID orders pokemons by numeric ID. Workers finish in any order.
+func sortByID(pokemons []Pokemon) {
+	slices.SortFunc(pokemons, func(a, b Pokemon) int {
+		idA, _ := strconv.Atoi(a.ID)
+		idB, _ := strconv.Atoi(b.ID)
+		return idA - idB
+	})
+}
+
+// writeJSON saves v as indented JSON to filename. The data is written to a
+// temporary file first so an interrupted run never leaves a truncated file.
+func writeJSON(filename string, v any) error {
+	file, err := os.CreateTemp(filepath.Dir(filename), ".pokedex-*")
 	if err != nil {
-		log.Fatal("Cannot create file", err)
+		return err
 	}
-	defer file.Close()
+	defer os.Remove(file.Name())
 
 	encoder := json.NewEncoder(file)
 	encoder.SetIndent("", "  ")
-	if err := encoder.Encode(pokemons); err != nil {
-		log.Fatal("Cannot encode to JSON", err)
+	if err := encoder.Encode(v); err != nil {
+		file.Close()
+		return err
+	}
+	if err := file.Close(); err != nil {
+		return err
+	}
+	return os.Rename(file.Name(), filename)
+}
+
+// loadExisting reads the Pokemon saved by a previous run. A missing file
+// simply means there is nothing to merge with. Malformed entries are skipped
+// with a warning, so they get replaced the next time their ID is scraped.
+func loadExisting(filename string) ([]Pokemon, error) {
+	data, err := os.ReadFile(filename)
+	if os.IsNotExist(err) {
+		return nil, nil
+	}
+	if err != nil {
+		return nil, err
+	}
+	var entries []json.RawMessage
+	if err := json.Unmarshal(data, &entries); err != nil {
+		return nil, err
+	}
+	var pokemons []Pokemon
+	for i, entry := range entries {
+		var pokemon Pokemon
+		if err := json.Unmarshal(entry, &pokemon); err != nil {
+			log.Printf("Skipping malformed entry %d in %s: %v", i, filename, err)
+			continue
+		}
+		if _, err := strconv.Atoi(pokemon.ID); err != nil {
+			log.Printf("Skipping entry %d in %s: invalid ID %q", i, filename, pokemon.ID)
+			continue
+		}
+		// A repeated ID keeps its last entry
+		pokemons = mergePokemon(pokemons, pokemon)
+	}
+	return pokemons, nil
+}
+
+// mergePokemon puts pokemon into pokemons, replacing the entry with the same
+// ID if there is one.
+func mergePokemon(pokemons []Pokemon, pokemon Pokemon) []Pokemon {
+	for i := range pokemons {
+		if pokemons[i].ID == pokemon.ID {
+			pokemons[i] = pokemon
+			return pokemons
+		}
+	}
+	return append(pokemons, pokemon)
+}
+
+// scrapedIDs returns the set of numeric IDs present in pokemons.
+func scrapedIDs(pokemons []Pokemon) map[int]bool {
+	ids := make(map[int]bool)
+	for _, pokemon := range pokemons {
+		if id, err := strconv.Atoi(pokemon.ID); err == nil {
+			ids[id] = true
+		}
+	}
+	return ids
+}
+
+func main() {
+	start := flag.Int("start", 1, "first Pokemon ID to scrape")
+	count := flag.Int("count", 200, "number of Pokemon to scrape")
+	out := flag.String("out", "pokedex.json", "output JSON file")
+	resume := flag.Bool("resume", false, "skip IDs already present in the output file")
+	workers := flag.Int("workers", 1, "number of browser tabs scraping at the same time")
+	headless := flag.Bool("headless", true, "run the browser without a window")
+	chromePath := flag.String("chrome-path", "", "Chrome or Chromium binary to use (default: look it up)")
+	userAgent := flag.String("user-agent", "", "User-Agent header to send (default: the browser's own)")
+	flag.Parse()
+
+	if *start < 1 || *count < 1 {
+		log.Fatalf("Invalid range: -start must be >= 1 and -count >= 1 (got start=%d, count=%d)", *start, *count)
+	}
+	if *workers < 1 {
+		log.Fatalf("Invalid -workers %d: must be at least 1", *workers)
+	}
+	if err := checkWritable(*out); err != nil {
+		log.Fatalf("Cannot write to %s: %v", *out, err)
+	}
+	end := *start + *count - 1
+
+	// New data is merged into what is already there, so the dex can be built
+	// up over several runs
+	pokemons, err := loadExisting(*out)
+	if err != nil {
+		log.Fatalf("Cannot read existing %s: %v", *out, err)
+	}
+	if len(pokemons) > 0 {
+		fmt.Printf("Merging into %d Pokemon already in %s\n", len(pokemons), *out)
+	}
+
+	// Create context
+	opts := append(chromedp.DefaultExecAllocatorOptions[:], chromedp.Flag("headless", *headless))
+	if *chromePath != "" {
+		opts = append(opts, chromedp.ExecPath(*chromePath))
+	}
+	if *userAgent != "" {
+		opts = append(opts, chromedp.UserAgent(*userAgent))
+	}
+	allocCtx, cancelAlloc := chromedp.NewExecAllocator(context.Background(), opts...)
+	defer cancelAlloc()
+	ctx, cancel := chromedp.NewContext(allocCtx)
+	defer cancel()
+	// Start the browser so every worker opens a tab in it
+	if err := chromedp.Run(ctx); err != nil {
+		log.Fatal("Cannot start the browser: ", err)
+	}
+
+	var failed []int
+
+	done := make(map[int]bool)
+	if *resume {
+		done = scrapedIDs(pokemons)
+	}
+	var todo []int
+	for i := *start; i <= end; i++ {
+		if !done[i] {
+			todo = append(todo, i)
+		}
+	}
+
+	// Navigate and extract data from pokedex.org
+	sinceCheckpoint := 0
+	finished := 0
+	began := time.Now()
+	for result := range scrapeAll(ctx, todo, *workers) {
+		if result.err != nil {
+			// Keep going; one flaky page shouldn't abort the whole crawl
+			fmt.Printf("%sGiving up: %v\n", CLEAR_LINE, result.err)
+			failed = append(failed, result.id)
+		} else {
+			pokemons = mergePokemon(pokemons, result.pokemon)
+
+			// Checkpoint regularly so a crash only loses the last few IDs
+			sinceCheckpoint++
+			if sinceCheckpoint == CHECKPOINT_SIZE {
+				sortByID(pokemons)
+				if err := writeJSON(*out, pokemons); err != nil {
+					log.Fatal("Cannot write checkpoint: ", err)
+				}
+				sinceCheckpoint = 0
+			}
+		}
+		finished++
+		printProgress(finished, len(todo), result.id, time.Since(began))
+	}
+
+	if len(todo) > 0 {
+		fmt.Println()
+	}
+
+	// Save to JSON file
+	sortByID(pokemons)
+	if err := writeJSON(*out, pokemons); err != nil {
+		log.Fatal("Cannot write pokedex file: ", err)
+	}
+
+	// Record the IDs that failed so they can be scraped again later
+	if len(failed) > 0 {
+		slices.Sort(failed)
+		failedPath := filepath.Join(filepath.Dir(*out), FAILED_FILE)
+		if err := writeJSON(failedPath, failed); err != nil {
+			log.Printf("Cannot write %s: %v", failedPath, err)
+		}
+		log.Fatalf("%d of %d Pokemon failed to scrape: %v (see %s)", len(failed), len(todo), failed, failedPath)
 	}
 }
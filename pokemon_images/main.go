@@ -5,10 +5,26 @@ import (
 	"io"
 	"net/http"
 	"os"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
 
 	"github.com/PuerkitoBio/goquery"
 )
 
+const (
+	MAX_WORKERS = 8               // concurrent image downloads
+	MAX_RETRIES = 3               // retries per image after the first attempt
+	RETRY_DELAY = 1 * time.Second // pause between attempts
+)
+
+// imageJob is a single sprite to download.
+type imageJob struct {
+	url      string
+	filename string
+}
+
 func main() {
 	baseURL := "https://bulbapedia.bulbagarden.net/wiki/List_of_Pokémon_by_effort_value_yield_(Generation_IX)"
 
@@ -19,25 +35,29 @@ func main() {
 		return
 	}
 
-	seenIDs := make(map[string]bool) // Map to track seen IDs
-	pokemonCounter := 0              // Counter for the number of Pokemon processed
+	seenIDs := make(map[int]bool) // Map to track seen IDs
+	var jobs []imageJob
 
-	// Process the Pokemon entries
+	// Collect the image URLs first so they can be downloaded concurrently
 	doc.Find("table.sortable tbody tr").EachWithBreak(func(i int, s *goquery.Selection) bool {
 		if i == 0 {
 			return true
 		}
 
-		id := s.Find("td.r").Text() // Assuming the ID is in <td class="r">
+		rawID := s.Find("td.r").Text() // Assuming the ID is in <td class="r">
+		id, err := strconv.Atoi(strings.TrimPrefix(strings.TrimSpace(rawID), "#"))
+		if err != nil {
+			fmt.Printf("Skipping row %d: cannot parse ID %q\n", i, rawID)
+			return true
+		}
 		if _, exists := seenIDs[id]; !exists {
 			seenIDs[id] = true
 
 			imgTag := s.Find("td a img")
 			src, exists := imgTag.Attr("src")
 			if exists {
-				pokemonCounter++
-				fmt.Println("Downloading image:", src)
-				downloadImage(src, fmt.Sprintf("pokemon_%d.png", pokemonCounter))
+				// Name by National Dex ID so the client can find sprites directly
+				jobs = append(jobs, imageJob{url: src, filename: fmt.Sprintf("pokemon_%03d.png", id)})
 			} else {
 				fmt.Println("Image src not found for ID:", id)
 			}
@@ -45,11 +65,53 @@ func main() {
 		return true // continue processing until 100 unique Pokémon have been processed
 	})
 
-	if pokemonCounter >= 200 {
-		return
+	errs := downloadAll(jobs)
+
+	fmt.Printf("Downloaded %d of %d images\n", len(jobs)-len(errs), len(jobs))
+	if len(errs) > 0 {
+		fmt.Printf("%d downloads failed:\n", len(errs))
+		for _, err := range errs {
+			fmt.Println(" -", err)
+		}
 	}
 }
 
+// downloadAll downloads every job using at most MAX_WORKERS goroutines and
+// returns the errors of the downloads that failed.
+func downloadAll(jobs []imageJob) []error {
+	var (
+		wg   sync.WaitGroup
+		mu   sync.Mutex
+		errs []error
+	)
+	sem := make(chan struct{}, MAX_WORKERS)
+
+	for _, job := range jobs {
+		wg.Add(1)
+		sem <- struct{}{}
+		go func(job imageJob) {
+			defer wg.Done()
+			defer func() { <-sem }()
+
+			// Re-runs only fetch what is missing
+			if info, err := os.Stat(job.filename); err == nil && info.Size() > 0 {
+				fmt.Println("Already downloaded:", job.filename)
+				return
+			}
+
+			fmt.Println("Downloading image:", job.url)
+			if err := downloadWithRetry(job.url, job.filename); err != nil {
+				mu.Lock()
+				errs = append(errs, fmt.Errorf("%s: %w", job.filename, err))
+				mu.Unlock()
+			}
+		}(job)
+	}
+
+	wg.Wait()
+	return errs
+}
+
 // fetchDocument fetches the page and returns a goquery document
 func fetchDocument(url string) (*goquery.Document, error) {
 	resp, err := http.Get(url)
@@ -66,26 +128,50 @@ func fetchDocument(url string) (*goquery.Document, error) {
 	return doc, nil
 }
 
-// downloadImage downloads the image from the given URL and saves it to a file
-func downloadImage(url, filename string) {
+// downloadWithRetry calls downloadImage, retrying up to MAX_RETRIES times.
+func downloadWithRetry(url, filename string) error {
+	var err error
+	for attempt := 0; attempt <= MAX_RETRIES; attempt++ {
+		if attempt > 0 {
+			time.Sleep(RETRY_DELAY)
+		}
+		if err = downloadImage(url, filename); err == nil {
+			return nil
+		}
+	}
+	return fmt.Errorf("after %d attempts: %w", MAX_RETRIES+1, err)
+}
+
+// downloadImage downloads the image from the given URL and saves it to a file.
+// Partially written files are removed on failure.
+func downloadImage(url, filename string) error {
 	response, err := http.Get(url)
 	if err != nil {
-		fmt.Println("Error downloading the image:", err)
-		return
+		return fmt.Errorf("downloading the image: %w", err)
 	}
 	defer response.Body.Close()
 
+	if response.StatusCode != http.StatusOK {
+		return fmt.Errorf("unexpected status: %s", response.Status)
+	}
+	if contentType := response.Header.Get("Content-Type"); !strings.HasPrefix(contentType, "image/") {
+		return fmt.Errorf("unexpected content type %q", contentType)
+	}
+
 	// Create the file
 	file, err := os.Create(filename)
 	if err != nil {
-		fmt.Println("Error creating the file:", err)
-		return
+		return fmt.Errorf("creating the file: %w", err)
 	}
-	defer file.Close()
 
 	// Write the body to file
 	_, err = io.Copy(file, response.Body)
+	if closeErr := file.Close(); err == nil {
+		err = closeErr
+	}
 	if err != nil {
-		fmt.Println("Error writing the image to file:", err)
+		os.Remove(filename)
+		return fmt.Errorf("writing the image to file: %w", err)
 	}
+	return nil
 }
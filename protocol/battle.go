@@ -0,0 +1,80 @@
+package protocol
+
+import (
+	"encoding/json"
+	"fmt"
+	"strings"
+)
+
+// BATTLE_ACTION_PREFIX starts every battle action line a client sends. The
+// rest of the line is a JSON encoded BattleAction.
+const BATTLE_ACTION_PREFIX = "battle "
+
+// Battle actions a client can take
+const (
+	ACTION_SUBMIT    = "submit"    // add Pokemon to the battle team
+	ACTION_DONE      = "done"      // the battle team is complete
+	ACTION_ATTACK    = "attack"    // attack with the Pokemon at Index using its move at Move
+	ACTION_SWITCH    = "switch"    // make the Pokemon at Index the active one
+	ACTION_SURRENDER = "surrender" // give up the battle
+)
+
+// BattleAction is a single battle command from a client. Fields are explicit
+// so usernames and IDs never have to be split out of a delimited string.
+type BattleAction struct {
+	Player  string `json:"player"`
+	Action  string `json:"action"`
+	Index   int    `json:"index"`             // team index for attack and switch
+	Move    int    `json:"move,omitempty"`    // move index for attack
+	Pokemon string `json:"pokemon,omitempty"` // Pokemon ID for submit
+}
+
+// EncodeBattleAction returns the line, newline included, that sends a to the
+// server.
+func EncodeBattleAction(a BattleAction) ([]byte, error) {
+	if err := a.validate(); err != nil {
+		return nil, err
+	}
+	data, err := json.Marshal(a)
+	if err != nil {
+		return nil, err
+	}
+	return []byte(BATTLE_ACTION_PREFIX + string(data) + "\n"), nil
+}
+
+// DecodeBattleAction parses a line written by EncodeBattleAction.
+func DecodeBattleAction(line string) (BattleAction, error) {
+	var a BattleAction
+	payload, ok := strings.CutPrefix(strings.TrimSpace(line), BATTLE_ACTION_PREFIX)
+	if !ok {
+		return a, fmt.Errorf("battle action must start with %q", BATTLE_ACTION_PREFIX)
+	}
+	if err := json.Unmarshal([]byte(payload), &a); err != nil {
+		return a, fmt.Errorf("invalid battle action: %w", err)
+	}
+	return a, a.validate()
+}
+
+// validate checks that a carries the fields its action needs.
+func (a BattleAction) validate() error {
+	if a.Player == "" {
+		return fmt.Errorf("battle action has no player")
+	}
+	switch a.Action {
+	case ACTION_SUBMIT:
+		if a.Pokemon == "" {
+			return fmt.Errorf("submit action has no Pokemon")
+		}
+	case ACTION_ATTACK, ACTION_SWITCH:
+		if a.Index < 0 {
+			return fmt.Errorf("%s action has negative index %d", a.Action, a.Index)
+		}
+		if a.Move < 0 {
+			return fmt.Errorf("%s action has negative move %d", a.Action, a.Move)
+		}
+	case ACTION_DONE, ACTION_SURRENDER:
+	default:
+		return fmt.Errorf("unknown battle action %q", a.Action)
+	}
+	return nil
+}
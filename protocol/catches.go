@@ -0,0 +1,12 @@
+package protocol
+
+import "time"
+
+// CatchRecord is one entry of a player's catch history: which Pokemon they
+// caught, on which x-y tile and when. The server sends the most recent ones
+// as a JSON list wrapped as {"catches": "<json>"}.
+type CatchRecord struct {
+	Pokemon string    `json:"pokemon"`
+	At      string    `json:"at"`
+	Time    time.Time `json:"time"`
+}
@@ -0,0 +1,60 @@
+package protocol
+
+import "strings"
+
+// MAX_MOVES is the most moves a Pokemon can know.
+const MAX_MOVES = 4
+
+// Move is an attack a Pokemon can use in battle. Its type decides the type
+// effectiveness and STAB, its power scales the damage.
+type Move struct {
+	Name  string `json:"name"`
+	Type  string `json:"type"`
+	Power int    `json:"power"`
+}
+
+// TACKLE is the normal move every Pokemon knows when the pokedex lists none.
+var TACKLE = Move{Name: "Tackle", Type: "normal", Power: 40}
+
+// TYPE_MOVES is the move a Pokemon learns for each of its types when the
+// pokedex lists no moves for it.
+var TYPE_MOVES = map[string]Move{
+	"normal":   {Name: "Body Slam", Type: "normal", Power: 85},
+	"fire":     {Name: "Ember", Type: "fire", Power: 40},
+	"water":    {Name: "Water Gun", Type: "water", Power: 40},
+	"electric": {Name: "Thunder Shock", Type: "electric", Power: 40},
+	"grass":    {Name: "Vine Whip", Type: "grass", Power: 45},
+	"ice":      {Name: "Ice Shard", Type: "ice", Power: 40},
+	"fighting": {Name: "Karate Chop", Type: "fighting", Power: 50},
+	"poison":   {Name: "Poison Sting", Type: "poison", Power: 15},
+	"ground":   {Name: "Mud-Slap", Type: "ground", Power: 20},
+	"flying":   {Name: "Gust", Type: "flying", Power: 40},
+	"psychic":  {Name: "Confusion", Type: "psychic", Power: 50},
+	"bug":      {Name: "Bug Bite", Type: "bug", Power: 60},
+	"rock":     {Name: "Rock Throw", Type: "rock", Power: 50},
+	"ghost":    {Name: "Lick", Type: "ghost", Power: 30},
+	"dragon":   {Name: "Dragon Breath", Type: "dragon", Power: 60},
+	"dark":     {Name: "Bite", Type: "dark", Power: 60},
+	"steel":    {Name: "Metal Claw", Type: "steel", Power: 50},
+	"fairy":    {Name: "Fairy Wind", Type: "fairy", Power: 40},
+}
+
+// DefaultMoves returns the moves of a Pokemon the pokedex lists no moves for:
+// Tackle followed by one move for each of its types.
+func DefaultMoves(types []string) []Move {
+	moves := []Move{TACKLE}
+	for _, t := range types {
+		if move, ok := TYPE_MOVES[strings.ToLower(t)]; ok && len(moves) < MAX_MOVES {
+			moves = append(moves, move)
+		}
+	}
+	return moves
+}
+
+// MovesOf returns moves if there are any, or the default moves for types.
+func MovesOf(moves []Move, types []string) []Move {
+	if len(moves) > 0 {
+		return moves
+	}
+	return DefaultMoves(types)
+}
@@ -0,0 +1,74 @@
+// Package protocol holds the wire format and the game data shared by the
+// client and the server.
+package protocol
+
+import (
+	"encoding/binary"
+	"fmt"
+	"io"
+	"strconv"
+)
+
+// MAX_FRAME_SIZE is the largest payload a single frame may carry.
+const MAX_FRAME_SIZE = 1 << 20
+
+// DESPAWNING replaces a Pokemon's ID in a board update shortly before the
+// Pokemon despawns. It is not a number, so it can't be mistaken for the ID of
+// a Pokemon; the Pokemon can still be caught until it is gone.
+const DESPAWNING = "despawning"
+
+// STAT_KEYS are the stats every Pokemon in pokedex.json must carry, as
+// written by the scraper and read by the server and client.
+var STAT_KEYS = []string{"HP", "Attack", "Defense", "Sp Atk", "Sp Def", "Speed"}
+
+// ValidateStats checks that stats has every key in STAT_KEYS and that each
+// value is an integer.
+func ValidateStats(stats map[string]string) error {
+	for _, key := range STAT_KEYS {
+		value, ok := stats[key]
+		if !ok {
+			return fmt.Errorf("missing stat %q", key)
+		}
+		if _, err := strconv.Atoi(value); err != nil {
+			return fmt.Errorf("stat %q has non-integer value %q", key, value)
+		}
+	}
+	return nil
+}
+
+// WriteFrame writes payload to w prefixed with its length as a 4-byte
+// big-endian integer.
+func WriteFrame(w io.Writer, payload []byte) error {
+	if len(payload) > MAX_FRAME_SIZE {
+		return fmt.Errorf("frame of %d bytes exceeds limit of %d", len(payload), MAX_FRAME_SIZE)
+	}
+
+	// Header and payload go out in one write so concurrent frames can't interleave
+	frame := make([]byte, 4+len(payload))
+	binary.BigEndian.PutUint32(frame, uint32(len(payload)))
+	copy(frame[4:], payload)
+	_, err := w.Write(frame)
+	return err
+}
+
+// ReadFrame reads a single length-prefixed payload from r.
+func ReadFrame(r io.Reader) ([]byte, error) {
+	var header [4]byte
+	if _, err := io.ReadFull(r, header[:]); err != nil {
+		return nil, err
+	}
+
+	size := binary.BigEndian.Uint32(header[:])
+	if size > MAX_FRAME_SIZE {
+		return nil, fmt.Errorf("frame of %d bytes exceeds limit of %d", size, MAX_FRAME_SIZE)
+	}
+
+	payload := make([]byte, size)
+	if _, err := io.ReadFull(r, payload); err != nil {
+		if err == io.EOF {
+			err = io.ErrUnexpectedEOF
+		}
+		return nil, err
+	}
+	return payload, nil
+}
@@ -0,0 +1,196 @@
+package protocol
+
+import (
+	"bytes"
+	"encoding/binary"
+	"errors"
+	"io"
+	"os"
+	"path/filepath"
+	"testing"
+)
+
+func TestTypeMultiplier(t *testing.T) {
+	tests := []struct {
+		attack   string
+		defender []string
+		want     float64
+	}{
+		{"water", []string{"fire"}, 2},
+		{"water", []string{"grass"}, 0.5},
+		{"water", []string{"normal"}, 1},
+		{"electric", []string{"water", "flying"}, 4},
+		{"normal", []string{"ghost"}, 0},
+		{"Fire", []string{"Grass"}, 2},
+		{"unknown", []string{"fire"}, 1},
+		{"fire", nil, 1},
+	}
+	for _, tt := range tests {
+		if got := TypeMultiplier(tt.attack, tt.defender); got != tt.want {
+			t.Errorf("TypeMultiplier(%q, %v) = %v, want %v", tt.attack, tt.defender, got, tt.want)
+		}
+	}
+}
+
+func TestBattleActionRoundTrip(t *testing.T) {
+	actions := []BattleAction{
+		{Player: "ash", Action: ACTION_ATTACK, Index: 2},
+		{Player: "ash", Action: ACTION_ATTACK, Index: 1, Move: 3},
+		{Player: "ash", Action: ACTION_SWITCH},
+		{Player: "a-b*c d", Action: ACTION_SUBMIT, Pokemon: "25"},
+		{Player: "ash", Action: ACTION_DONE},
+		{Player: "ash", Action: ACTION_SURRENDER},
+	}
+	for _, want := range actions {
+		line, err := EncodeBattleAction(want)
+		if err != nil {
+			t.Fatalf("EncodeBattleAction(%+v): %v", want, err)
+		}
+		if bytes.Count(line, []byte("\n")) != 1 || line[len(line)-1] != '\n' {
+			t.Errorf("encoded line %q must end in its only newline", line)
+		}
+		got, err := DecodeBattleAction(string(line))
+		if err != nil {
+			t.Fatalf("DecodeBattleAction(%q): %v", line, err)
+		}
+		if got != want {
+			t.Errorf("round trip of %+v gave %+v", want, got)
+		}
+	}
+}
+
+func TestDecodeBattleActionRejectsMalformed(t *testing.T) {
+	lines := []string{
+		"battle-ash-0*attack",
+		`battle {"player":"ash","action":"dance"}`,
+		`battle {"player":"","action":"done"}`,
+		`battle {"player":"ash","action":"submit"}`,
+		`battle {"player":"ash","action":"attack","index":-1}`,
+		`battle {"player":"ash","action":"attack","move":-1}`,
+		`battle {"player":"ash"`,
+	}
+	for _, line := range lines {
+		if a, err := DecodeBattleAction(line); err == nil {
+			t.Errorf("DecodeBattleAction(%q) = %+v, want an error", line, a)
+		}
+	}
+}
+
+func TestDefaultMoves(t *testing.T) {
+	moves := DefaultMoves([]string{"Grass", "poison"})
+	want := []string{"Tackle", "Vine Whip", "Poison Sting"}
+	if len(moves) != len(want) {
+		t.Fatalf("DefaultMoves(grass, poison) = %v, want %v", moves, want)
+	}
+	for i, move := range moves {
+		if move.Name != want[i] {
+			t.Errorf("move %d is %s, want %s", i, move.Name, want[i])
+		}
+	}
+
+	// Every type has a move of that type
+	for _, typ := range TYPES {
+		if move, ok := TYPE_MOVES[typ]; !ok || move.Type != typ || move.Power <= 0 {
+			t.Errorf("TYPE_MOVES[%q] = %+v", typ, move)
+		}
+	}
+
+	scraped := []Move{{Name: "Surf", Type: "water", Power: 90}}
+	if got := MovesOf(scraped, []string{"fire"}); len(got) != 1 || got[0] != scraped[0] {
+		t.Errorf("MovesOf replaced the scraped moves with %v", got)
+	}
+}
+
+func TestLoadTypeChart(t *testing.T) {
+	dir := t.TempDir()
+
+	// Without a file the built-in chart is used
+	chart, err := LoadTypeChart(filepath.Join(dir, "missing.json"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(chart) != len(TYPES) || chart["water"]["fire"] != 2 {
+		t.Errorf("built-in chart has %d types and water vs fire %v", len(chart), chart["water"]["fire"])
+	}
+
+	custom := filepath.Join(dir, "types.json")
+	if err := os.WriteFile(custom, []byte(`{"Water": {"Fire": 3}}`), 0644); err != nil {
+		t.Fatal(err)
+	}
+	chart, err = LoadTypeChart(custom)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if chart["water"]["fire"] != 3 {
+		t.Errorf("custom chart gives water vs fire %v, want 3", chart["water"]["fire"])
+	}
+	if missing := MissingTypes(chart, []string{"Water", "Grass", "grass"}); len(missing) != 1 || missing[0] != "grass" {
+		t.Errorf("MissingTypes = %v, want [grass]", missing)
+	}
+
+	for _, bad := range []string{`{"water": {"plasma": 2}}`, `{"water": {"fire": -1}}`, `[]`} {
+		if err := os.WriteFile(custom, []byte(bad), 0644); err != nil {
+			t.Fatal(err)
+		}
+		if _, err := LoadTypeChart(custom); err == nil {
+			t.Errorf("LoadTypeChart accepted %s", bad)
+		}
+	}
+}
+
+func TestFrameRoundTrip(t *testing.T) {
+	messages := [][]byte{
+		[]byte(`{"2-3":"25"}`),
+		[]byte(`{"2-4":"ash"}`), // back to back with the one before, the old "}{" case
+		{},
+		bytes.Repeat([]byte("x"), 64*1024), // larger than any read buffer
+		[]byte(`{"battle":"wait"}`),
+		bytes.Repeat([]byte("y"), MAX_FRAME_SIZE),
+	}
+	var stream bytes.Buffer
+	for _, msg := range messages {
+		if err := WriteFrame(&stream, msg); err != nil {
+			t.Fatalf("WriteFrame(%d bytes): %v", len(msg), err)
+		}
+	}
+	for i, want := range messages {
+		got, err := ReadFrame(&stream)
+		if err != nil {
+			t.Fatalf("frame %d: %v", i, err)
+		}
+		if !bytes.Equal(got, want) {
+			t.Errorf("frame %d is %d bytes, want %d bytes as written", i, len(got), len(want))
+		}
+	}
+	if _, err := ReadFrame(&stream); err != io.EOF {
+		t.Errorf("reading past the last frame got %v, want io.EOF", err)
+	}
+
+	if err := WriteFrame(&stream, make([]byte, MAX_FRAME_SIZE+1)); err == nil {
+		t.Error("WriteFrame accepted a frame over MAX_FRAME_SIZE")
+	}
+}
+
+func TestReadFrameMalformed(t *testing.T) {
+	header := func(size uint32) []byte {
+		return binary.BigEndian.AppendUint32(nil, size)
+	}
+	tests := []struct {
+		name   string
+		stream []byte
+	}{
+		{"truncated header", []byte{0, 0}},
+		{"truncated payload", append(header(100), "only part of it"...)},
+		{"header only", header(10)},
+		{"oversized length", append(header(MAX_FRAME_SIZE+1), "x"...)},
+		{"garbage length", []byte(`{"2-3":"25"}`)},
+	}
+	for _, tt := range tests {
+		payload, err := ReadFrame(bytes.NewReader(tt.stream))
+		if err == nil {
+			t.Errorf("%s: got %d byte frame, want an error", tt.name, len(payload))
+		} else if errors.Is(err, io.EOF) {
+			t.Errorf("%s: got io.EOF, want an error telling it apart from a clean close", tt.name)
+		}
+	}
+}
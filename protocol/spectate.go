@@ -0,0 +1,19 @@
+package protocol
+
+// SpectatorUpdate is the battle state sent to spectators after every event,
+// wrapped as {"spectate": "<json>"}.
+type SpectatorUpdate struct {
+	Battle string             `json:"battle"` // empty if there is no such battle
+	Event  string             `json:"event"`  // what just happened
+	P1     string             `json:"p1"`
+	P2     string             `json:"p2"`
+	TeamP1 []SpectatorPokemon `json:"teamP1"`
+	TeamP2 []SpectatorPokemon `json:"teamP2"`
+	Over   bool               `json:"over"` // the battle has ended
+}
+
+// SpectatorPokemon is a Pokemon as seen by a spectator.
+type SpectatorPokemon struct {
+	Name string `json:"name"`
+	HP   string `json:"hp"`
+}
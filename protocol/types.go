@@ -0,0 +1,107 @@
+package protocol
+
+import (
+	_ "embed"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io/fs"
+	"os"
+	"slices"
+	"strings"
+)
+
+// TYPES lists the 18 Pokemon types in the order the games use.
+var TYPES = []string{
+	"normal", "fire", "water", "electric", "grass", "ice", "fighting", "poison", "ground",
+	"flying", "psychic", "bug", "rock", "ghost", "dragon", "dark", "steel", "fairy",
+}
+
+//go:embed types.json
+var defaultTypeChart []byte
+
+// TYPE_CHART maps an attacking type to the multiplier it deals against each
+// defending type. Pairs that are not listed are neutral (1x). It starts out as
+// the built-in chart; LoadTypeChart reads a replacement from a file.
+var TYPE_CHART = mustParseTypeChart(defaultTypeChart)
+
+// LoadTypeChart reads a type chart from a JSON file shaped like TYPE_CHART,
+// falling back to the built-in chart when the file doesn't exist. Every type
+// must be one of TYPES and every multiplier non-negative.
+func LoadTypeChart(filename string) (map[string]map[string]float64, error) {
+	data, err := os.ReadFile(filename)
+	if errors.Is(err, fs.ErrNotExist) {
+		data = defaultTypeChart
+	} else if err != nil {
+		return nil, err
+	}
+	return parseTypeChart(data)
+}
+
+// parseTypeChart decodes and validates a JSON type chart. Type names are
+// lowercased.
+func parseTypeChart(data []byte) (map[string]map[string]float64, error) {
+	var raw map[string]map[string]float64
+	if err := json.Unmarshal(data, &raw); err != nil {
+		return nil, fmt.Errorf("invalid type chart: %w", err)
+	}
+
+	chart := make(map[string]map[string]float64, len(raw))
+	for attackType, row := range raw {
+		attackType = strings.ToLower(attackType)
+		if !slices.Contains(TYPES, attackType) {
+			return nil, fmt.Errorf("unknown attacking type %q", attackType)
+		}
+		chart[attackType] = make(map[string]float64, len(row))
+		for defType, multiplier := range row {
+			defType = strings.ToLower(defType)
+			if !slices.Contains(TYPES, defType) {
+				return nil, fmt.Errorf("unknown defending type %q for %s", defType, attackType)
+			}
+			if multiplier < 0 {
+				return nil, fmt.Errorf("negative multiplier %v for %s against %s", multiplier, attackType, defType)
+			}
+			chart[attackType][defType] = multiplier
+		}
+	}
+	return chart, nil
+}
+
+// mustParseTypeChart parses the built-in chart, which can only be broken by
+// a bad edit to types.json.
+func mustParseTypeChart(data []byte) map[string]map[string]float64 {
+	chart, err := parseTypeChart(data)
+	if err != nil {
+		panic(err)
+	}
+	return chart
+}
+
+// MissingTypes returns the types, lowercased and in the order given, that
+// have no row in chart.
+func MissingTypes(chart map[string]map[string]float64, types []string) []string {
+	var missing []string
+	for _, t := range types {
+		t = strings.ToLower(t)
+		if _, ok := chart[t]; !ok && !slices.Contains(missing, t) {
+			missing = append(missing, t)
+		}
+	}
+	return missing
+}
+
+// TypeMultiplier returns the combined effectiveness of an attack of type
+// attackType against a defender with the given types.
+func TypeMultiplier(attackType string, defenderTypes []string) float64 {
+	multiplier := 1.0
+	row, ok := TYPE_CHART[strings.ToLower(attackType)]
+	if !ok {
+		return multiplier
+	}
+	for _, defType := range defenderTypes {
+		if m, ok := row[strings.ToLower(defType)]; ok {
+			multiplier *= m
+		}
+	}
+	return multiplier
+}
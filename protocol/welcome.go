@@ -0,0 +1,29 @@
+package protocol
+
+// PROTOCOL_VERSION is the version of the wire protocol. Bump it whenever a
+// message changes in a way the other side might not understand, so clients
+// and servers that are out of sync refuse each other instead of desyncing.
+const PROTOCOL_VERSION = 1
+
+// VERSION_PREFIX starts the first line a client sends, followed by the
+// PROTOCOL_VERSION it speaks, e.g. "version-1".
+const VERSION_PREFIX = "version-"
+
+// LOGIN_SUCCESSFUL is the Result of a Welcome for an accepted login. Rejected
+// logins have a Result of "failed: <reason>" and no other fields.
+const LOGIN_SUCCESSFUL = "successful"
+
+// Welcome is the single frame the server answers a login with. After a
+// successful login it holds everything the client needs to draw the board;
+// later changes arrive as map updates.
+type Welcome struct {
+	Result  string            `json:"result"`
+	Version int               `json:"version"`           // the server's PROTOCOL_VERSION
+	Pokemon []string          `json:"pokemon,omitempty"` // IDs of the Pokemon in the player's party
+	Box     []string          `json:"box,omitempty"`     // IDs of the Pokemon in the player's box
+	Party   int               `json:"party,omitempty"`   // most Pokemon a party may hold, 0 for no limit
+	Rows    int               `json:"rows,omitempty"`
+	Cols    int               `json:"cols,omitempty"`
+	Spawns  map[string]string `json:"spawns,omitempty"`  // x-y to Pokemon ID, or DESPAWNING
+	Players map[string]string `json:"players,omitempty"` // x-y to username, the new player included
+}
@@ -3,15 +3,30 @@ package main
 import (
 	"bufio"
 	"encoding/json"
+	"errors"
+	"flag"
 	"fmt"
 	"io"
-	"log"
+	"io/fs"
+	"log/slog"
+	"maps"
+	"math"
 	"math/rand"
 	"net"
 	"os"
+	"os/signal"
+	"path/filepath"
+	"slices"
+	"sort"
 	"strconv"
 	"strings"
+	"sync"
+	"syscall"
 	"time"
+
+	"golang.org/x/crypto/bcrypt"
+
+	"pokemon/protocol"
 )
 
 // -----------------------------------------------------------------------------
@@ -23,54 +38,296 @@ type Pokemon struct {
 	Name  string            `json:"name"`
 	Types []string          `json:"types"`
 	Stats map[string]string `json:"stats"`
-	Exp   string            `json:"exp"`
+	Exp   string            `json:"exp"` // base EXP yield when defeated
+	Moves []protocol.Move   `json:"moves,omitempty"`
+
+	// Level and XP only exist on caught Pokemon; XP counts towards the next level
+	Level int `json:"level,omitempty"`
+	XP    int `json:"xp,omitempty"`
 }
 
+// Player is an account in players.json. PokeBalls is the player's party, the
+// Pokemon they carry and battle with; the rest wait in their Box, see
+// PARTY_SIZE.
 type Player struct {
 	Username  string    `json:"username"`
 	Password  string    `json:"password"`
 	PokeBalls []Pokemon `json:"pokeBalls"`
+	Box       []Pokemon `json:"box,omitempty"`
+	Position  string    `json:"position,omitempty"` // last known x-y tile
+
+	Catches []protocol.CatchRecord `json:"catches,omitempty"` // every catch, oldest first
+}
+
+// BattleSession holds the state of a single battle between two players.
+type BattleSession struct {
+	ID string
+
+	P1, P2         string
+	ConnP1, ConnP2 net.Conn
+
+	PokeBallsP1, PokeBallsP2 []Pokemon // battle teams
+	DefIndexP1, DefIndexP2   int       // index of each player's active Pokemon
+	ExpP1, ExpP2             int       // EXP each player earned by defeating Pokemon
+	ReadyP1, ReadyP2         bool      // the player has finished choosing a team
+	Started                  bool
+	Player1Turn              bool
+
+	turn      int         // incremented every time a turn is announced
+	turnTimer *time.Timer // fires when the active player takes too long
+
+	Spectators []net.Conn // read-only watchers, see notifySpectators
+}
+
+// LeaderboardEntry is one row of the leaderboard, sent as a JSON list
+// wrapped as {"leaderboard": "<json>"}.
+type LeaderboardEntry struct {
+	Username string `json:"username"`
+	Pokemon  int    `json:"pokemon"` // number of Pokemon caught
+	Exp      int    `json:"exp"`     // total EXP earned by all of them
+}
+
+// lockedConn serializes writes to a connection. Frames for one player are
+// written from many goroutines (the spawner, battle timers, other players'
+// moves), and each frame must reach the client in one piece whatever the
+// underlying net.Conn guarantees.
+type lockedConn struct {
+	net.Conn
+	writeMu sync.Mutex
+
+	// outbox holds frames waiting to be written, see Send. It is guarded by
+	// queueMu, so frames can be queued under stateMu or battleMu alike.
+	queueMu    sync.Mutex
+	outbox     chan []byte
+	writerDone chan struct{} // closed once writeQueued returns
+	dropped    bool          // nothing more is queued: too slow, or closed
+}
+
+// spawnEntry records when the Pokemon at locKey appeared on the BOARD.
+type spawnEntry struct {
+	locKey    string
+	spawnedAt time.Time
+	warned    bool // players were told it is despawning soon
 }
 
+// recentCatch records who caught the Pokemon on a tile and when.
+type recentCatch struct {
+	pokemonID string
+	by        string
+	at        time.Time
+}
+
+// GameEvent is one line of the -eventlog file. Every line has a time and an
+// event name; the other fields are only set when they apply to the event:
+//
+//	spawn, despawn  pokemon, at
+//	catch           user, pokemon, at
+//	move            user, from, at
+//	battle_start    battle, user, opponent
+//	attack          battle, user, opponent, pokemon, move, damage, hp, flags, missed
+//	faint           battle, user, pokemon
+//	victory         battle, user, opponent
+//
+// For attacks, user is the attacker, pokemon the attacking Pokemon's ID and
+// hp what the defending Pokemon has left. Fields are only ever added to this
+// format, never renamed or removed.
+type GameEvent struct {
+	Time     time.Time `json:"time"`
+	Event    string    `json:"event"`
+	User     string    `json:"user,omitempty"`
+	Opponent string    `json:"opponent,omitempty"`
+	Battle   string    `json:"battle,omitempty"`
+	Pokemon  string    `json:"pokemon,omitempty"`
+	Move     string    `json:"move,omitempty"`
+	From     string    `json:"from,omitempty"`
+	At       string    `json:"at,omitempty"`
+	Damage   int       `json:"damage,omitempty"`
+	HP       int       `json:"hp,omitempty"`
+	Flags    []string  `json:"flags,omitempty"`
+	Missed   bool      `json:"missed,omitempty"`
+}
+
+// Event names written to the event log
+const (
+	EVENT_SPAWN        = "spawn"
+	EVENT_DESPAWN      = "despawn"
+	EVENT_CATCH        = "catch"
+	EVENT_MOVE         = "move"
+	EVENT_BATTLE_START = "battle_start"
+	EVENT_ATTACK       = "attack"
+	EVENT_FAINT        = "faint"
+	EVENT_VICTORY      = "victory"
+)
+
 // -----------------------------------------------------------------------------
 // GLOBAL VARIABLES
 // -----------------------------------------------------------------------------
 
+const (
+	// SPAWN_INTERVAL controls how often Pokemon appear on the BOARD. Each
+	// Pokemon stays for POKEMON_LIFETIME; DESPAWN_INTERVAL is how often the
+	// server looks for Pokemon that outstayed it.
+	SPAWN_INTERVAL   = 1 * time.Minute
+	POKEMON_LIFETIME = 5 * time.Minute
+	DESPAWN_INTERVAL = 10 * time.Second
+
+	// DESPAWN_WARNING is how long before despawning players are warned that
+	// a Pokemon is about to go
+	DESPAWN_WARNING = 30 * time.Second
+
+	// CATCH_RACE_WINDOW is how long after a catch a player who steps onto
+	// the same tile is told that someone else got there first
+	CATCH_RACE_WINDOW = 2 * time.Second
+
+	// MAX_POKEMON_ON_BOARD caps how many Pokemon can be on the BOARD at once
+	MAX_POKEMON_ON_BOARD = 30
+
+	// MAX_SPAWN_ATTEMPTS is how many random tiles are tried per spawn before
+	// the spawner falls back to scanning the BOARD for a free tile
+	MAX_SPAWN_ATTEMPTS = 100
+
+	// STARTER_COUNT is the number of random Pokemon a new player starts with
+	STARTER_COUNT = 3
+
+	// SHUTDOWN_TIMEOUT bounds how long a graceful shutdown may take
+	SHUTDOWN_TIMEOUT = 5 * time.Second
+
+	// PING_INTERVAL is how often the server pings each client; a client that
+	// sends nothing, not even a pong, for PING_INTERVAL + PONG_TIMEOUT is
+	// considered dead and evicted
+	PING_INTERVAL = 10 * time.Second
+	PONG_TIMEOUT  = 10 * time.Second
+
+	// TURN_TIMEOUT is how long a player may take to act in battle before the
+	// server attacks with their active Pokemon on their behalf
+	TURN_TIMEOUT = 30 * time.Second
+
+	// MAX_TEAM_SIZE is the largest battle team; smaller teams are confirmed
+	// with "done"
+	MAX_TEAM_SIZE = 3
+
+	// SAVE_DEBOUNCE is how long changes to PLAYERS are collected before the
+	// players file is written; SAVE_RETRY_INTERVAL is how long to wait before
+	// retrying a failed write
+	SAVE_DEBOUNCE       = 2 * time.Second
+	SAVE_RETRY_INTERVAL = 30 * time.Second
+
+	// OUTBOX_SIZE is how many broadcasts may wait for a slow player before
+	// they are disconnected
+	OUTBOX_SIZE = 256
+
+	// WRITE_TIMEOUT bounds a single write to a player, so a client that stops
+	// reading can't block the writer goroutine, or a synchronous write, forever
+	WRITE_TIMEOUT = 10 * time.Second
+
+	// MIN_USERNAME_LENGTH and MAX_USERNAME_LENGTH bound the length of a username
+	MIN_USERNAME_LENGTH = 3
+	MAX_USERNAME_LENGTH = 16
+
+	// LEADERBOARD_SIZE is how many players the leaderboard lists
+	LEADERBOARD_SIZE = 10
+
+	// CATCH_HISTORY_SIZE is how many of their latest catches a player is shown
+	CATCH_HISTORY_SIZE = 20
+
+	// SPAWN_WEIGHT_EXPONENT controls how strongly high base stats make a
+	// Pokemon rare: its spawn weight is 1 / totalStats^SPAWN_WEIGHT_EXPONENT
+	SPAWN_WEIGHT_EXPONENT = 2
+)
+
 var (
 	// POKEMONS stores all possible Pokemon loaded from pokedex.json
 	POKEMONS []Pokemon
 
 	// PLAYERS stores all possible Players loaded from players.json
-	PLAYERS []Player
+	PLAYERS      []Player
+	PLAYERS_FILE = "players.json"
 
-	// BOARD is a 2D grid representing the game map
+	playersDirty  bool // PLAYERS changed since the last save
+	saveScheduled bool // a flushPlayers call is pending
+
+	// saveMu serializes writes of the players file
+	saveMu sync.Mutex
+
+	// BOARD is a 2D grid representing the game map, sized by -rows and -cols
 	ROWS, COLS        = 10, 18
-	BOARD             = make([][]string, ROWS)
+	BOARD             [][]string
 	POKEMON_LOCATIONS = make(map[string]string) // key: x-y, value: pokemonID
 	PLAYER_LOCATIONS  = make(map[string]string) // key: x-y, value: username
-	despawnQueues     []string                  // holds queue of x-y coords for despawning pokemons
+	despawnQueues     []spawnEntry              // spawned Pokemon in spawn order, see despawnExpired
 	CONNECTIONS       = make(map[string]net.Conn)
+	pendingLogins     = make(map[string]bool) // verified users not yet in CONNECTIONS
+
+	// recentCatches maps x-y tiles to the catch made there, see CATCH_RACE_WINDOW
+	recentCatches = make(map[string]recentCatch)
+
+	// worldRand picks which Pokemon spawn and where, where players are placed
+	// and their starter Pokemon; main seeds it, tests swap in a seeded source
+	worldRand = rand.New(rand.NewSource(time.Now().UnixNano()))
+
+	// battleRand decides hits, crits and damage rolls in every battle
+	battleRand = rand.New(rand.NewSource(time.Now().UnixNano()))
 
 	// For battle mechanics
-	pokeBalls_P1       []Pokemon
-	pokeBalls_P2       []Pokemon
-	currentDefIndex_P1 int = 0
-	currentDefIndex_P2 int = 0
-	P1                 string
-	P2                 string
-	player1Turn        = true
+	BATTLES      = make(map[string]*BattleSession) // key: battle ID
+	nextBattleID = 0
+
+	// stateMu guards PLAYERS, BOARD, POKEMON_LOCATIONS, PLAYER_LOCATIONS,
+	// despawnQueues, CONNECTIONS, pendingLogins, recentCatches, worldRand,
+	// playersDirty and saveScheduled. When both locks are
+	// needed, stateMu must be acquired before battleMu.
+	stateMu sync.RWMutex
+
+	// battleMu guards BATTLES, nextBattleID, battleRand and every
+	// BattleSession's fields.
+	battleMu sync.Mutex
+
+	// RESERVED_USERNAMES are words the protocol or the client gives a meaning
+	// of their own, e.g. the client marks other players as "enemy" on its
+	// board and a "wait" battle message means it is not our turn
+	RESERVED_USERNAMES = []string{
+		"register", "battle", "wait", "done", "enemy", "victory", "timeout", "rejected",
+		"surrender", "spectate", "unspectate", "leaderboard", "pong", "ping", "board", "server", "quit",
+		"release", "catch", "catches", "admin", "box", "version",
+		protocol.DESPAWNING,
+	}
+
+	// NUMBERTOPROCESS is the number of Pokemon to spawn every SPAWN_INTERVAL
+	// and INITIAL_SPAWNS the number spawned at startup, set with -spawn-batch
+	// and -initial-spawns
+	NUMBERTOPROCESS = 5
+	INITIAL_SPAWNS  = 5
+
+	// ADMINS are the players allowed to send admin commands, set with -admins
+	ADMINS = make(map[string]bool)
+
+	// PARTY_SIZE is the most Pokemon a player's party may hold, set with
+	// -party-size. Catches beyond it go to the player's Box. 0 means no limit.
+	PARTY_SIZE = 0
+
+	// SPAWN_ZONES bias what spawns where, see pokemonForZone. They are loaded
+	// from zones.json at startup and never change afterwards
+	SPAWN_ZONES []SpawnZone
+
+	// damageModel computes attack damage; it is picked with -damage at
+	// startup and never changes afterwards
+	damageModel DamageModel = ClassicModel{}
+
+	// eventLog receives one GameEvent per line when -eventlog is set; it is
+	// guarded by eventMu so events can be logged while holding any other lock
+	eventLog *os.File
+	eventMu  sync.Mutex
 )
 
 // -----------------------------------------------------------------------------
 // UTILITY & HELPER FUNCTIONS
 // -----------------------------------------------------------------------------
 
-// checkError logs and exits the program on error.
-func checkError(err error) {
-	if err != nil {
-		fmt.Fprintf(os.Stderr, "Fatal error: %v\n", err)
-		os.Exit(1)
-	}
+// parseLogLevel converts a -loglevel value into a slog.Level.
+func parseLogLevel(name string) (slog.Level, error) {
+	var level slog.Level
+	err := level.UnmarshalText([]byte(name))
+	return level, err
 }
 
 // isNumber checks if a string can be converted to an integer.
@@ -79,35 +336,231 @@ func isNumber(str string) bool {
 	return err == nil
 }
 
+// rollChance returns true with the given probability (0.0 - 1.0).
+// The caller must hold battleMu.
+func rollChance(probability float64) bool {
+	return battleRand.Float64() < probability
+}
+
+// isHashed reports whether a stored password is already a bcrypt hash.
+func isHashed(password string) bool {
+	return strings.HasPrefix(password, "$2a$") ||
+		strings.HasPrefix(password, "$2b$") ||
+		strings.HasPrefix(password, "$2y$")
+}
+
+// hashPassword returns the bcrypt hash of a plaintext password.
+func hashPassword(password string) (string, error) {
+	hash, err := bcrypt.GenerateFromPassword([]byte(password), bcrypt.DefaultCost)
+	return string(hash), err
+}
+
 // verifyPlayer checks if a player with given username & password exists.
-func verifyPlayer(username, password string, players []Player) bool {
-	for _, user := range players {
-		if user.Username == username && user.Password == password {
-			return true
+// Players still stored with a plaintext password are upgraded to a bcrypt
+// hash on their first successful login. bcrypt is slow, so stateMu is only
+// held to read and update the stored password, never while hashing.
+// The caller must not hold stateMu.
+func verifyPlayer(username, password string) bool {
+	stateMu.RLock()
+	stored, found := "", false
+	if player := findPlayer(username); player != nil {
+		stored, found = player.Password, true
+	}
+	stateMu.RUnlock()
+	if !found {
+		return false
+	}
+
+	if isHashed(stored) {
+		return bcrypt.CompareHashAndPassword([]byte(stored), []byte(password)) == nil
+	}
+
+	// Legacy plaintext entry
+	if stored != password {
+		return false
+	}
+	hash, err := hashPassword(password)
+	if err != nil {
+		slog.Error("Cannot upgrade password", "user", username, "err", err)
+		return true
+	}
+	stateMu.Lock()
+	migratePassword(username, stored, hash)
+	stateMu.Unlock()
+	return true
+}
+
+// migratePassword replaces a player's plaintext password with its bcrypt hash
+// and schedules a save, unless the password changed while it was hashed.
+// The caller must hold stateMu.
+func migratePassword(username, plaintext, hash string) {
+	player := findPlayer(username)
+	if player == nil || player.Password != plaintext {
+		return
+	}
+	player.Password = hash
+	slog.Info("Upgraded plaintext password to bcrypt", "user", username)
+	persistPlayers()
+}
+
+// validateUsername checks that a username is safe to use in the protocol:
+// usernames end up in messages split on '-', '*' and '_', as map keys and on
+// the board, where anything numeric is taken for a Pokemon ID. Only letters
+// and digits are allowed, starting with a letter, and reserved words are
+// refused regardless of case.
+func validateUsername(username string) error {
+	if len(username) < MIN_USERNAME_LENGTH || len(username) > MAX_USERNAME_LENGTH {
+		return fmt.Errorf("username must be %d to %d characters long", MIN_USERNAME_LENGTH, MAX_USERNAME_LENGTH)
+	}
+	for i, r := range username {
+		isLetter := (r >= 'a' && r <= 'z') || (r >= 'A' && r <= 'Z')
+		isDigit := r >= '0' && r <= '9'
+		if i == 0 && !isLetter {
+			return fmt.Errorf("username must start with a letter")
+		}
+		if !isLetter && !isDigit {
+			return fmt.Errorf("username may only contain letters and digits")
 		}
 	}
-	return false
+	for _, word := range RESERVED_USERNAMES {
+		if strings.EqualFold(username, word) {
+			return fmt.Errorf("username %q is reserved", username)
+		}
+	}
+	return nil
+}
+
+// registerPlayer creates a new Player with three random starter Pokemon and
+// persists it to PLAYERS_FILE. The password is hashed before stateMu is
+// taken, since bcrypt is slow.
+// The caller must not hold stateMu.
+func registerPlayer(username, password string) error {
+	if username == "" || password == "" {
+		return fmt.Errorf("username and password must not be empty")
+	}
+	hash, err := hashPassword(password)
+	if err != nil {
+		return err
+	}
+
+	stateMu.Lock()
+	defer stateMu.Unlock()
+	for _, user := range PLAYERS {
+		if user.Username == username {
+			return fmt.Errorf("username %q already exists", username)
+		}
+	}
+
+	player := Player{Username: username, Password: hash, PokeBalls: []Pokemon{}}
+	for i := 0; i < STARTER_COUNT && len(POKEMONS) > 0; i++ {
+		player.PokeBalls = append(player.PokeBalls, copyPokemon(POKEMONS[worldRand.Intn(len(POKEMONS))]))
+	}
+	PLAYERS = append(PLAYERS, player)
+
+	persistPlayers()
+	return nil
+}
+
+// savePlayers writes the list of Players to a local JSON file.
+func savePlayers(filename string, players []Player) error {
+	data, err := json.MarshalIndent(players, "", "  ")
+	if err != nil {
+		return err
+	}
+	return writeFileAtomic(filename, data)
+}
+
+// writeFileAtomic writes data to a temporary file that is renamed over
+// filename, so a crash mid-write never leaves a truncated file behind.
+// Writes are serialized by saveMu.
+func writeFileAtomic(filename string, data []byte) error {
+	saveMu.Lock()
+	defer saveMu.Unlock()
+
+	file, err := os.CreateTemp(filepath.Dir(filename), ".players-*.json")
+	if err != nil {
+		return err
+	}
+	defer os.Remove(file.Name()) // no-op once renamed
+
+	if _, err := file.Write(data); err != nil {
+		file.Close()
+		return err
+	}
+	if err := file.Sync(); err != nil {
+		file.Close()
+		return err
+	}
+	if err := file.Close(); err != nil {
+		return err
+	}
+	return os.Rename(file.Name(), filename)
+}
+
+// persistPlayers marks PLAYERS as changed. Saves are debounced: the first
+// change schedules a flush after SAVE_DEBOUNCE and any further changes until
+// then are written by that same flush.
+// The caller must hold stateMu.
+func persistPlayers() {
+	playersDirty = true
+	if !saveScheduled {
+		saveScheduled = true
+		time.AfterFunc(SAVE_DEBOUNCE, flushPlayers)
+	}
+}
+
+// flushPlayers writes PLAYERS to PLAYERS_FILE if it changed. The players are
+// encoded under stateMu but written without it, so slow disks don't stall the
+// game. A failed save is logged and retried after SAVE_RETRY_INTERVAL; the
+// in-memory state stays authoritative.
+func flushPlayers() {
+	stateMu.Lock()
+	saveScheduled = false
+	if !playersDirty {
+		stateMu.Unlock()
+		return
+	}
+	playersDirty = false
+	filename := PLAYERS_FILE
+	data, err := json.MarshalIndent(PLAYERS, "", "  ")
+	stateMu.Unlock()
+
+	if err == nil {
+		err = writeFileAtomic(filename, data)
+	}
+	if err == nil {
+		return
+	}
+
+	slog.Error("Cannot save players file", "err", err, "retry_in", SAVE_RETRY_INTERVAL)
+	stateMu.Lock()
+	defer stateMu.Unlock()
+	playersDirty = true
+	if !saveScheduled {
+		saveScheduled = true
+		time.AfterFunc(SAVE_RETRY_INTERVAL, flushPlayers)
+	}
 }
 
 // loadPlayers loads the list of Players from a local JSON file.
 func loadPlayers(filename string) []Player {
 	file, err := os.Open(filename)
 	if err != nil {
-		fmt.Printf("Error opening players file: %v\n", err)
+		slog.Error("Cannot open players file", "err", err)
 		return nil
 	}
 	defer file.Close()
 
 	bytes, err := io.ReadAll(file)
 	if err != nil {
-		fmt.Printf("Error reading players file: %v\n", err)
+		slog.Error("Cannot read players file", "err", err)
 		return nil
 	}
 
 	var players []Player
 	err = json.Unmarshal(bytes, &players)
 	if err != nil {
-		fmt.Printf("Error unmarshalling players JSON: %v\n", err)
+		slog.Error("Cannot parse players file", "err", err)
 		return nil
 	}
 
@@ -118,417 +571,1698 @@ func loadPlayers(filename string) []Player {
 func loadPokemons(filename string) []Pokemon {
 	file, err := os.Open(filename)
 	if err != nil {
-		fmt.Printf("Error opening pokedex file: %v\n", err)
+		slog.Error("Cannot open pokedex file", "err", err)
 		return nil
 	}
 	defer file.Close()
 
 	bytes, err := io.ReadAll(file)
 	if err != nil {
-		fmt.Printf("Error reading pokedex file: %v\n", err)
+		slog.Error("Cannot read pokedex file", "err", err)
 		return nil
 	}
 
 	var pokemons []Pokemon
 	err = json.Unmarshal(bytes, &pokemons)
 	if err != nil {
-		fmt.Printf("Error unmarshalling pokedex JSON: %v\n", err)
+		slog.Error("Cannot parse pokedex file", "err", err)
 		return nil
 	}
-	return pokemons
+
+	// Drop entries with missing or broken stats; they would battle with 0s
+	valid := pokemons[:0]
+	for _, pokemon := range pokemons {
+		if err := protocol.ValidateStats(pokemon.Stats); err != nil {
+			slog.Warn("Skipping Pokemon with invalid stats", "id", pokemon.ID, "name", pokemon.Name, "err", err)
+			continue
+		}
+		// Pokemon without scraped moves learn the defaults for their types
+		pokemon.Moves = protocol.MovesOf(pokemon.Moves, pokemon.Types)
+		if len(pokemon.Moves) > protocol.MAX_MOVES {
+			slog.Warn("Pokemon knows too many moves, keeping the first ones", "id", pokemon.ID, "name", pokemon.Name, "moves", len(pokemon.Moves))
+			pokemon.Moves = pokemon.Moves[:protocol.MAX_MOVES]
+		}
+		valid = append(valid, pokemon)
+	}
+	return valid
 }
 
-// generateRandomPokemons spawns 'num' random Pokemon onto the BOARD.
+// generateRandomPokemons spawns up to 'num' random Pokemon onto the BOARD
+// and returns the tiles it actually filled. Fewer are spawned when the board
+// would exceed MAX_POKEMON_ON_BOARD or runs out of free tiles.
+// The caller must hold stateMu.
 func generateRandomPokemons(num int) map[string]string {
 	pokemonLocations := make(map[string]string)
+	if room := MAX_POKEMON_ON_BOARD - len(POKEMON_LOCATIONS); num > room {
+		slog.Info("Pokemon spawn cap reached", "requested", num, "onBoard", len(POKEMON_LOCATIONS), "max", MAX_POKEMON_ON_BOARD)
+		num = max(room, 0)
+	}
+
 	for i := 0; i < num; i++ {
-		for {
-			spawnX := rand.Intn(ROWS)
-			spawnY := rand.Intn(COLS)
-			if BOARD[spawnX][spawnY] == "" {
-				pokemonID := POKEMONS[rand.Intn(len(POKEMONS))].ID
-				BOARD[spawnX][spawnY] = pokemonID
-
-				locKey := strconv.Itoa(spawnX) + "-" + strconv.Itoa(spawnY)
-				despawnQueues = append(despawnQueues, locKey)
-				pokemonLocations[locKey] = pokemonID
-				POKEMON_LOCATIONS[locKey] = pokemonID
-				break
-			}
+		locKey, ok := findFreeTile()
+		if !ok {
+			slog.Info("No free tile left to spawn Pokemon on", "spawned", len(pokemonLocations), "requested", num)
+			break
 		}
+		x, y, _ := parseCoord(locKey)
+		pokemon, ok := pokemonForZone(x, y)
+		if !ok {
+			slog.Warn("No Pokemon to spawn", "spawned", len(pokemonLocations), "requested", num)
+			break
+		}
+		spawnPokemon(locKey, pokemon.ID)
+		pokemonLocations[locKey] = pokemon.ID
 	}
 	return pokemonLocations
 }
 
-// handlePokemons runs in its own goroutine to periodically spawn and despawn Pokemon.
-func handlePokemons() {
-	spawnTicker1min := time.NewTicker(1 * time.Minute)
-	despawnTicker5min := time.NewTicker(1 * time.Minute)
-
-	// number of Pokemon to spawn or despawn at a time
-	const NUMBERTOPROCESS = 5
+// spawnPokemon puts the Pokemon with pokemonID on the free tile locKey.
+// The caller must hold stateMu.
+func spawnPokemon(locKey, pokemonID string) {
+	x, y, _ := parseCoord(locKey)
+	BOARD[x][y] = pokemonID
+	despawnQueues = append(despawnQueues, spawnEntry{locKey: locKey, spawnedAt: time.Now()})
+	POKEMON_LOCATIONS[locKey] = pokemonID
+	logEvent(GameEvent{Event: EVENT_SPAWN, Pokemon: pokemonID, At: locKey})
+}
 
-	for {
-		select {
-		case <-spawnTicker1min.C:
-			newPokemonLocations, err := json.Marshal(generateRandomPokemons(NUMBERTOPROCESS))
-			checkError(err)
+// broadcastSpawns tells every connected player about newly spawned Pokemon.
+// The caller must hold stateMu.
+func broadcastSpawns(spawned map[string]string) {
+	newPokemonLocations, err := json.Marshal(spawned)
+	if err != nil {
+		slog.Error("Cannot encode spawned Pokemon", "err", err)
+		return
+	}
+	for _, tcpConn := range CONNECTIONS {
+		sendFrame(tcpConn, newPokemonLocations)
+	}
+}
 
-			// Notify all connected players about newly spawned Pokemon
-			for _, tcpConn := range CONNECTIONS {
-				tcpConn.Write(newPokemonLocations)
-			}
+// adminSpawn handles "admin-spawn-<pokemonID>-<x>-<y>": it puts that exact
+// Pokemon on the given free tile and tells everyone. Only ADMINS may use it.
+// The caller must hold stateMu.
+func adminSpawn(username, args string) error {
+	if !ADMINS[username] {
+		return fmt.Errorf("%s is not an admin", username)
+	}
+	pokemonID, locKey, _ := strings.Cut(args, "-")
+	if _, ok := pokemonByID(pokemonID); !ok {
+		return fmt.Errorf("no Pokemon with ID %q", pokemonID)
+	}
+	if !tileFree(locKey) {
+		return fmt.Errorf("tile %q is taken or off the board", locKey)
+	}
 
-		case <-despawnTicker5min.C:
-			if len(despawnQueues) < NUMBERTOPROCESS {
-				continue
-			}
-			despawnedPokemonLocations := make(map[string]string)
-			for i := 0; i < NUMBERTOPROCESS; i++ {
-				location := despawnQueues[i]
-				despawnedPokemonLocations[location] = ""
-				// Clear from BOARD
-				coords := strings.Split(location, "-")
-				if len(coords) == 2 {
-					x, _ := strconv.Atoi(coords[0])
-					y, _ := strconv.Atoi(coords[1])
-					BOARD[x][y] = ""
-				}
-				// Remove from POKEMON_LOCATIONS
-				delete(POKEMON_LOCATIONS, location)
-			}
-			despawnQueues = despawnQueues[NUMBERTOPROCESS:]
+	spawnPokemon(locKey, pokemonID)
+	broadcastSpawns(map[string]string{locKey: pokemonID})
+	slog.Info("Admin spawned Pokemon", "user", username, "pokemon", pokemonID, "at", locKey)
+	return nil
+}
 
-			// Send these despawns to all players
-			sent, _ := json.Marshal(despawnedPokemonLocations)
-			for _, tcpConn := range CONNECTIONS {
-				tcpConn.Write(sent)
+// findFreeTile picks a random tile with neither a Pokemon nor a player on it.
+// After MAX_SPAWN_ATTEMPTS misses it scans the whole BOARD instead, so it
+// always terminates and only fails when the board is full.
+// The caller must hold stateMu.
+func findFreeTile() (string, bool) {
+	for attempt := 0; attempt < MAX_SPAWN_ATTEMPTS; attempt++ {
+		locKey := strconv.Itoa(worldRand.Intn(ROWS)) + "-" + strconv.Itoa(worldRand.Intn(COLS))
+		if tileFree(locKey) {
+			return locKey, true
+		}
+	}
+	for x := 0; x < ROWS; x++ {
+		for y := 0; y < COLS; y++ {
+			locKey := strconv.Itoa(x) + "-" + strconv.Itoa(y)
+			if tileFree(locKey) {
+				return locKey, true
 			}
 		}
 	}
+	return "", false
 }
 
-// -----------------------------------------------------------------------------
-// BATTLE & GAME LOGIC
-// -----------------------------------------------------------------------------
+// pokedexTypes returns every type the given Pokemon have, with repeats.
+func pokedexTypes(pokemons []Pokemon) []string {
+	var types []string
+	for _, p := range pokemons {
+		types = append(types, p.Types...)
+	}
+	return types
+}
 
-// HandleInGameConnection processes movement, catching, and battle data once a user is verified.
-func HandleInGameConnection(conn net.Conn) {
-	defer conn.Close()
-	reader := bufio.NewReader(conn)
+// spawnWeight returns how likely p is to spawn relative to other Pokemon.
+// The higher its total base stats, the rarer it is.
+func spawnWeight(p Pokemon) float64 {
+	total := 0
+	for _, key := range protocol.STAT_KEYS {
+		value, _ := strconv.Atoi(p.Stats[key])
+		total += value
+	}
+	if total < 1 {
+		total = 1
+	}
+	return 1 / math.Pow(float64(total), SPAWN_WEIGHT_EXPONENT)
+}
 
-	for {
-		battleStatus := false
-		playerMsg, err := reader.ReadString('\n')
-		if err != nil {
-			// If error, the player has likely disconnected
-			removeConnectionAndNotify(conn)
-			return
+// pickWeightedPokemon picks a random Pokemon from candidates weighted by
+// spawnWeight, so legendaries show up far less often than Rattata. It fails
+// when there are no candidates.
+// The caller must hold stateMu.
+func pickWeightedPokemon(candidates []Pokemon) (Pokemon, bool) {
+	if len(candidates) == 0 {
+		return Pokemon{}, false
+	}
+	totalWeight := 0.0
+	for _, p := range candidates {
+		totalWeight += spawnWeight(p)
+	}
+
+	target := worldRand.Float64() * totalWeight
+	for _, p := range candidates {
+		target -= spawnWeight(p)
+		if target < 0 {
+			return p, true
 		}
+	}
+	// Only reached through floating point rounding
+	return candidates[len(candidates)-1], true
+}
 
-		playerMsg = strings.TrimSpace(playerMsg)
-		fmt.Println("Received message:", playerMsg)
+// SpawnZone is a rectangle of the board where only Pokemon of the given
+// types spawn. Its edges are fractions of the board, so zones fit any -rows
+// and -cols: it covers the rows from Top up to but not including Bottom, and
+// likewise the columns from Left to Right.
+type SpawnZone struct {
+	Name   string   `json:"name"`
+	Types  []string `json:"types"`
+	Top    float64  `json:"top"`
+	Bottom float64  `json:"bottom"`
+	Left   float64  `json:"left"`
+	Right  float64  `json:"right"`
+}
 
-		// BATTLE-RELATED PARSING
-		if strings.HasPrefix(playerMsg, "battle-") {
-			parts := strings.Split(playerMsg, "-")
-			if len(parts) < 3 {
-				continue
-			}
-			currentPlayer := parts[1]
-			mainMessage := strings.TrimSpace(parts[2])
+// contains reports whether the tile at x, y lies in the zone.
+func (z SpawnZone) contains(x, y int) bool {
+	row, col := float64(x)/float64(ROWS), float64(y)/float64(COLS)
+	return row >= z.Top && row < z.Bottom && col >= z.Left && col < z.Right
+}
 
-			// (1) SUBMIT POKEMON
-			if isNumber(mainMessage) {
-				// The user selected a Pokemon ID to add to his battle team
-				submitPokemon(currentPlayer, mainMessage)
-
-				// If both players have selected 3 Pokemon each, we start the battle
-				if len(pokeBalls_P1) == 3 && len(pokeBalls_P2) == 3 {
-					fmt.Println("Both players have submitted Pokemons. Battle begins!")
-					speed_P1, _ := strconv.Atoi(pokeBalls_P1[0].Stats["Speed"])
-					speed_P2, _ := strconv.Atoi(pokeBalls_P2[0].Stats["Speed"])
-					waitMsg := make(map[string]string)
-					waitMsg["battle"] = "wait"
-					sentWait, _ := json.Marshal(waitMsg)
-
-					turnMsg := make(map[string]string)
-					// Check whose Pokemon is faster
-					if speed_P1 >= speed_P2 {
-						fmt.Println("P1's turn first")
-						turnMsg["battle"] = P1
-						sentTurn, _ := json.Marshal(turnMsg)
-						CONNECTIONS[P1].Write([]byte(sentTurn))
-						CONNECTIONS[P2].Write([]byte(sentWait))
-						player1Turn = true
-					} else {
-						fmt.Println("P2's turn first")
-						turnMsg["battle"] = P2
-						sentTurn, _ := json.Marshal(turnMsg)
-						CONNECTIONS[P2].Write([]byte(sentTurn))
-						CONNECTIONS[P1].Write([]byte(sentWait))
-						player1Turn = false
-					}
-				}
-			} else {
-				// (2) BATTLE ACTIONS (attack, switch, etc.)
-				handleBattleAction(currentPlayer, mainMessage)
+// loadZones reads the spawn zones from filename. Without the file there are
+// no zones and any Pokemon spawns anywhere.
+func loadZones(filename string) ([]SpawnZone, error) {
+	data, err := os.ReadFile(filename)
+	if errors.Is(err, fs.ErrNotExist) {
+		return nil, nil
+	} else if err != nil {
+		return nil, err
+	}
+	return parseZones(data)
+}
+
+// parseZones decodes and checks a list of spawn zones.
+func parseZones(data []byte) ([]SpawnZone, error) {
+	var zones []SpawnZone
+	if err := json.Unmarshal(data, &zones); err != nil {
+		return nil, err
+	}
+	for _, z := range zones {
+		if len(z.Types) == 0 {
+			return nil, fmt.Errorf("zone %q has no types", z.Name)
+		}
+		for _, t := range z.Types {
+			if !slices.Contains(protocol.TYPES, strings.ToLower(t)) {
+				return nil, fmt.Errorf("zone %q has unknown type %q", z.Name, t)
 			}
+		}
+		if z.Top < 0 || z.Top >= z.Bottom || z.Bottom > 1 || z.Left < 0 || z.Left >= z.Right || z.Right > 1 {
+			return nil, fmt.Errorf("zone %q must lie within 0 and 1 with top above bottom and left of right", z.Name)
+		}
+	}
+	return zones, nil
+}
 
-		} else if strings.HasPrefix(playerMsg, "surrender-") {
-			parts := strings.Split(playerMsg, "-")
-			winMsg := make(map[string]string)
-
-			if parts[1] == P1 {
-				winMsg["battle"] = "victory_" + P2
-				sentWin, _ := json.Marshal(winMsg)
-				CONNECTIONS[P1].Write([]byte(sentWin))
-				CONNECTIONS[P2].Write([]byte(sentWin))
-				battleStatus = false
-				handleMovementOrEncounter(conn, "4-5", &battleStatus)
-			} else {
-				winMsg["battle"] = "victory_" + P1
-				sentWin, _ := json.Marshal(winMsg)
-				CONNECTIONS[P1].Write([]byte(sentWin))
-				CONNECTIONS[P2].Write([]byte(sentWin))
-				battleStatus = false
-				handleMovementOrEncounter(conn, "4-5", &battleStatus)
+// hasAnyType reports whether p has at least one of types, ignoring case.
+func hasAnyType(p Pokemon, types []string) bool {
+	for _, own := range p.Types {
+		for _, t := range types {
+			if strings.EqualFold(own, t) {
+				return true
 			}
+		}
+	}
+	return false
+}
 
-		} else {
-			// MOVEMENT OR ENCOUNTER LOGIC
-			handleMovementOrEncounter(conn, playerMsg, &battleStatus)
+// pokemonForZone picks a Pokemon to spawn on the tile at x, y. In the first
+// of SPAWN_ZONES containing the tile it is one of the zone's types, unless
+// no Pokemon has those; anywhere else it may be any Pokemon. It fails when
+// POKEMONS is empty.
+// The caller must hold stateMu.
+func pokemonForZone(x, y int) (Pokemon, bool) {
+	for _, zone := range SPAWN_ZONES {
+		if !zone.contains(x, y) {
+			continue
+		}
+		var candidates []Pokemon
+		for _, p := range POKEMONS {
+			if hasAnyType(p, zone.Types) {
+				candidates = append(candidates, p)
+			}
 		}
+		if len(candidates) > 0 {
+			return pickWeightedPokemon(candidates)
+		}
+		break
 	}
+	return pickWeightedPokemon(POKEMONS)
 }
 
-// removeConnectionAndNotify removes the disconnected player's data from global maps
-// and notifies all other players of the disconnection.
-func removeConnectionAndNotify(conn net.Conn) {
-	for username, connection := range CONNECTIONS {
-		if connection == conn {
-			// Remove player's location
-			for loc, player := range PLAYER_LOCATIONS {
-				if player == username {
-					delete(PLAYER_LOCATIONS, loc)
-				}
+// handlePokemons runs in its own goroutine to periodically spawn and despawn Pokemon.
+func handlePokemons() {
+	spawnTicker := time.NewTicker(SPAWN_INTERVAL)
+	despawnTicker := time.NewTicker(DESPAWN_INTERVAL)
+
+	for {
+		select {
+		case <-spawnTicker.C:
+			stateMu.Lock()
+			if spawned := generateRandomPokemons(NUMBERTOPROCESS); len(spawned) > 0 {
+				broadcastSpawns(spawned)
+			}
+			stateMu.Unlock()
+
+		case <-despawnTicker.C:
+			stateMu.Lock()
+			now := time.Now()
+			despawnedPokemonLocations := despawnExpired(now)
+			for locKey, warning := range warnExpiring(now) {
+				despawnedPokemonLocations[locKey] = warning
+			}
+			if len(despawnedPokemonLocations) == 0 {
+				stateMu.Unlock()
+				continue
 			}
-			// Remove from CONNECTIONS
-			delete(CONNECTIONS, username)
 
-			// Broadcast that this player quit
-			quitMsg := map[string]string{strings.TrimSpace(username): "quit"}
-			sentQuit, _ := json.Marshal(quitMsg)
-			for _, otherConn := range CONNECTIONS {
-				otherConn.Write(sentQuit)
+			// Send these despawns and warnings to all players
+			sent, _ := json.Marshal(despawnedPokemonLocations)
+			for _, tcpConn := range CONNECTIONS {
+				sendFrame(tcpConn, sent)
 			}
-			fmt.Println(username, "disconnected")
-			break
+			stateMu.Unlock()
 		}
 	}
 }
 
-// handleMovementOrEncounter deals with the message from a player who wants to move
-// or might encounter a Pokemon or another player.
-func handleMovementOrEncounter(conn net.Conn, playerCoord string, battleStatus *bool) {
-	playerCoord = strings.TrimSpace(playerCoord)
+// despawnExpired removes every Pokemon that has been on the BOARD for at
+// least POKEMON_LIFETIME and returns their tiles, cleared, ready to be
+// broadcast. despawnQueues is in spawn order, so the expired entries are
+// always at its front.
+// The caller must hold stateMu.
+func despawnExpired(now time.Time) map[string]string {
+	despawned := make(map[string]string)
+	count := 0
+	for _, entry := range despawnQueues {
+		if now.Sub(entry.spawnedAt) < POKEMON_LIFETIME {
+			break
+		}
+		count++
+		logEvent(GameEvent{Event: EVENT_DESPAWN, Pokemon: POKEMON_LOCATIONS[entry.locKey], At: entry.locKey})
+		despawned[entry.locKey] = ""
+		if x, y, ok := parseCoord(entry.locKey); ok {
+			BOARD[x][y] = ""
+		}
+		delete(POKEMON_LOCATIONS, entry.locKey)
+	}
+	despawnQueues = despawnQueues[count:]
+	return despawned
+}
 
-	// Find username from conn
-	var thisUsername string
-	for name, connection := range CONNECTIONS {
-		if connection == conn {
-			thisUsername = strings.TrimSpace(name)
+// warnExpiring marks every Pokemon that despawns within DESPAWN_WARNING and
+// returns their tiles set to protocol.DESPAWNING, ready to be broadcast. Each
+// Pokemon is only warned about once.
+// The caller must hold stateMu.
+func warnExpiring(now time.Time) map[string]string {
+	warnings := make(map[string]string)
+	for i := range despawnQueues {
+		entry := &despawnQueues[i]
+		if now.Sub(entry.spawnedAt) < POKEMON_LIFETIME-DESPAWN_WARNING {
 			break
 		}
+		if !entry.warned {
+			entry.warned = true
+			warnings[entry.locKey] = protocol.DESPAWNING
+		}
 	}
+	return warnings
+}
 
-	// Remove old location
-	for loc, pl := range PLAYER_LOCATIONS {
-		if strings.TrimSpace(pl) == thisUsername {
-			delete(PLAYER_LOCATIONS, loc)
+// forgetSpawn drops the Pokemon at locKey from despawnQueues once it has left
+// the board some other way, so its timer can't clear a later spawn there.
+// The caller must hold stateMu.
+func forgetSpawn(locKey string) {
+	for i, entry := range despawnQueues {
+		if entry.locKey == locKey {
+			despawnQueues = append(despawnQueues[:i], despawnQueues[i+1:]...)
+			return
+		}
+	}
+}
+
+// -----------------------------------------------------------------------------
+// EVENT LOG
+// -----------------------------------------------------------------------------
+
+// openEventLog opens filename for appending game events, creating it if needed.
+func openEventLog(filename string) error {
+	file, err := os.OpenFile(filename, os.O_WRONLY|os.O_APPEND|os.O_CREATE, 0644)
+	if err != nil {
+		return err
+	}
+	eventMu.Lock()
+	eventLog = file
+	eventMu.Unlock()
+	return nil
+}
+
+// closeEventLog stops event logging and closes the log file.
+func closeEventLog() {
+	eventMu.Lock()
+	defer eventMu.Unlock()
+	if eventLog != nil {
+		eventLog.Close()
+		eventLog = nil
+	}
+}
+
+// logEvent appends e to the event log as a single JSON line. It does nothing
+// when no event log is open, and a failed write is logged but never stops the
+// game.
+func logEvent(e GameEvent) {
+	eventMu.Lock()
+	defer eventMu.Unlock()
+	if eventLog == nil {
+		return
+	}
+	if e.Time.IsZero() {
+		e.Time = time.Now().UTC()
+	}
+	line, err := json.Marshal(e)
+	if err != nil {
+		slog.Error("Cannot encode game event", "event", e.Event, "err", err)
+		return
+	}
+	if _, err := eventLog.Write(append(line, '\n')); err != nil {
+		slog.Error("Cannot write event log", "err", err)
+	}
+}
+
+// -----------------------------------------------------------------------------
+// TYPE EFFECTIVENESS
+// -----------------------------------------------------------------------------
+
+// ACCURACY is the probability that an attack hits its target.
+const ACCURACY = 0.9
+
+// CRIT_CHANCE is the probability that an attack lands a critical hit, which
+// multiplies its damage by CRIT_MULTIPLIER.
+const (
+	CRIT_CHANCE     = 1.0 / 16
+	CRIT_MULTIPLIER = 1.5
+)
+
+// SPECIAL_CHANCE is the probability that an attack is a special move, which
+// uses Sp Atk and Sp Def instead of Attack and Defense.
+const (
+	SPECIAL_CHANCE = 0.3
+	BATTLE_LEVEL   = 50 // level used by RatioModel
+	BASE_POWER     = 50 // move power at which SubtractiveModel deals Atk - Def
+)
+
+// LEVEL_EXP_STEP scales the XP curve: going from level n to n+1 takes
+// n * LEVEL_EXP_STEP XP. Each level gained grows every stat by
+// LEVEL_STAT_GROWTH (at least 1 point), up to MAX_LEVEL.
+const (
+	LEVEL_EXP_STEP    = 100
+	LEVEL_STAT_GROWTH = 0.05
+	MAX_LEVEL         = 100
+)
+
+// STAB_BONUS is the same-type attack bonus applied when the move type matches
+// one of the attacker's own types.
+const STAB_BONUS = 1.5
+
+// hasSTAB reports whether the attacker shares the move's type and therefore
+// earns the same-type attack bonus.
+func hasSTAB(attacker Pokemon, moveType string) bool {
+	for _, t := range attacker.Types {
+		if strings.EqualFold(t, moveType) {
+			return true
+		}
+	}
+	return false
+}
+
+// -----------------------------------------------------------------------------
+// BATTLE & GAME LOGIC
+// -----------------------------------------------------------------------------
+
+// HandleInGameConnection processes movement, catching, and battle data once a user is verified.
+func HandleInGameConnection(conn net.Conn) {
+	defer conn.Close()
+	reader := bufio.NewReader(conn)
+
+	done := make(chan struct{})
+	defer close(done)
+	go pingClient(conn, done)
+
+	for {
+		battleStatus := false
+
+		// Half-open connections never error, so give up if the client goes quiet
+		conn.SetReadDeadline(time.Now().Add(PING_INTERVAL + PONG_TIMEOUT))
+		playerMsg, err := reader.ReadString('\n')
+		if err != nil {
+			// If error, the player has likely disconnected or timed out
+			removeConnectionAndNotify(conn)
+			return
+		}
+
+		playerMsg = strings.TrimSpace(playerMsg)
+		if playerMsg == "pong" {
+			// The read deadline has been pushed back, nothing else to do
+			continue
+		}
+		slog.Debug("Received message", "msg", playerMsg)
+
+		// BATTLE-RELATED PARSING
+		if strings.HasPrefix(playerMsg, protocol.BATTLE_ACTION_PREFIX) {
+			action, err := protocol.DecodeBattleAction(playerMsg)
+			if err != nil {
+				slog.Warn("Ignoring malformed battle action", "msg", playerMsg, "err", err)
+				continue
+			}
+
+			// Players may only act for themselves. Look up what they own
+			// first; stateMu comes before battleMu
+			var owned []Pokemon
+			stateMu.RLock()
+			player := usernameOf(conn)
+			if player != "" && action.Action == protocol.ACTION_SUBMIT {
+				owned = ownedPokemons(player, action.Pokemon)
+			}
+			stateMu.RUnlock()
+			if player == "" || action.Player != player {
+				slog.Warn("Ignoring battle action for another player", "user", player, "player", action.Player)
+				continue
+			}
+
+			if action.Action == protocol.ACTION_SURRENDER {
+				endBattle(action.Player)
+				continue
+			}
+
+			battleMu.Lock()
+			session := findBattle(action.Player)
+			if session == nil {
+				battleMu.Unlock()
+				continue
+			}
+
+			switch action.Action {
+			case protocol.ACTION_SUBMIT:
+				// The user selected a Pokemon ID to add to his battle team
+				if err := submitPokemon(session, action.Player, action.Pokemon, owned); err != nil {
+					slog.Warn("Rejected battle Pokemon", "battle", session.ID, "user", action.Player, "err", err)
+					rejectMsg := map[string]string{"battle": "rejected-" + action.Pokemon}
+					sentReject, _ := json.Marshal(rejectMsg)
+					sendFrame(session.conn(action.Player), sentReject)
+				}
+				session.startIfReady()
+			case protocol.ACTION_DONE:
+				// The user is happy with a team of fewer than MAX_TEAM_SIZE Pokemon
+				session.markReady(action.Player)
+				session.startIfReady()
+			default:
+				// Attack or switch
+				handleBattleAction(session, action)
+			}
+			battleMu.Unlock()
+
+		} else if strings.HasPrefix(playerMsg, "spectate-") {
+			battleMu.Lock()
+			spectateBattle(conn, strings.TrimPrefix(playerMsg, "spectate-"))
+			battleMu.Unlock()
+
+		} else if playerMsg == "unspectate" {
+			battleMu.Lock()
+			removeSpectator(conn)
+			battleMu.Unlock()
+
+		} else if pokemonID, ok := strings.CutPrefix(playerMsg, "release-"); ok {
+			// Format: "release-<pokemonID>", the reply is
+			// {"release": "ok-<pokemonID>"} or {"release": "rejected-<pokemonID>"}
+			stateMu.Lock()
+			result := "ok-" + pokemonID
+			if err := releasePokemon(usernameOf(conn), pokemonID); err != nil {
+				slog.Warn("Rejected release", "user", usernameOf(conn), "pokemon", pokemonID, "err", err)
+				result = "rejected-" + pokemonID
+			}
+			stateMu.Unlock()
+			releaseMsg, _ := json.Marshal(map[string]string{"release": result})
+			sendFrame(conn, releaseMsg)
+
+		} else if args, ok := strings.CutPrefix(playerMsg, "box-"); ok {
+			// Format: "box-deposit-<pokemonID>" or "box-withdraw-<pokemonID>",
+			// the reply is {"box": "ok-<deposit|withdraw>-<pokemonID>"} or
+			// {"box": "failed: <reason>"}
+			move, pokemonID, _ := strings.Cut(args, "-")
+			stateMu.Lock()
+			var err error
+			switch move {
+			case "deposit":
+				err = depositPokemon(usernameOf(conn), pokemonID)
+			case "withdraw":
+				err = withdrawPokemon(usernameOf(conn), pokemonID)
+			default:
+				err = fmt.Errorf("unknown box command %q", move)
+			}
+			stateMu.Unlock()
+			result := "ok-" + args
+			if err != nil {
+				slog.Warn("Rejected box command", "user", usernameOf(conn), "command", args, "err", err)
+				result = "failed: " + err.Error()
+			}
+			boxMsg, _ := json.Marshal(map[string]string{"box": result})
+			sendFrame(conn, boxMsg)
+
+		} else if args, ok := strings.CutPrefix(playerMsg, "admin-spawn-"); ok {
+			// Format: "admin-spawn-<pokemonID>-<x>-<y>", failures are
+			// answered with {"admin": "failed: <reason>"}
+			stateMu.Lock()
+			if err := adminSpawn(usernameOf(conn), args); err != nil {
+				slog.Warn("Rejected admin spawn", "user", usernameOf(conn), "args", args, "err", err)
+				failedMsg, _ := json.Marshal(map[string]string{"admin": "failed: " + err.Error()})
+				sendFrame(conn, failedMsg)
+			}
+			stateMu.Unlock()
+
+		} else if playerMsg == "leaderboard" {
+			stateMu.RLock()
+			sendLeaderboard(conn, leaderboard(LEADERBOARD_SIZE))
+			stateMu.RUnlock()
+
+		} else if playerMsg == "catches" {
+			stateMu.RLock()
+			sendCatches(conn, recentCatchHistory(usernameOf(conn), CATCH_HISTORY_SIZE))
+			stateMu.RUnlock()
+
+		} else {
+			// MOVEMENT OR ENCOUNTER LOGIC
+			handleMovementOrEncounter(conn, playerMsg, &battleStatus)
+		}
+	}
+}
+
+// pingClient sends {"ping":"1"} to the client every PING_INTERVAL until done
+// is closed, so live clients always have something to answer.
+func pingClient(conn net.Conn, done <-chan struct{}) {
+	ticker := time.NewTicker(PING_INTERVAL)
+	defer ticker.Stop()
+
+	pingMsg, _ := json.Marshal(map[string]string{"ping": "1"})
+	for {
+		select {
+		case <-done:
+			return
+		case <-ticker.C:
+			sendFrame(conn, pingMsg)
+		}
+	}
+}
+
+// removeConnectionAndNotify removes the disconnected player's data from global maps
+// and notifies all other players of the disconnection.
+func removeConnectionAndNotify(conn net.Conn) {
+	stateMu.Lock()
+	defer stateMu.Unlock()
+
+	// Whatever they were watching goes on without them
+	battleMu.Lock()
+	removeSpectator(conn)
+	battleMu.Unlock()
+
+	for username, connection := range CONNECTIONS {
+		if connection == conn {
+			// Remove player's location
+			for loc, player := range PLAYER_LOCATIONS {
+				if player == username {
+					delete(PLAYER_LOCATIONS, loc)
+				}
+			}
+			// Remove from CONNECTIONS; nothing is queued for it any more
+			delete(CONNECTIONS, username)
+			if c, ok := conn.(*lockedConn); ok {
+				c.closeOutbox()
+			}
+
+			// Leaving mid-battle forfeits it, so the opponent isn't stuck
+			finishBattle(username)
+
+			// Persist the player's last position for their next login
+			persistPlayers()
+
+			// Broadcast that this player quit
+			quitMsg := map[string]string{strings.TrimSpace(username): "quit"}
+			sentQuit, _ := json.Marshal(quitMsg)
+			for _, otherConn := range CONNECTIONS {
+				sendFrame(otherConn, sentQuit)
+			}
+			slog.Info("Player disconnected", "user", username)
+			break
+		}
+	}
+}
+
+// handleMovementOrEncounter deals with the message from a player who wants to move
+// or might encounter a Pokemon or another player.
+func handleMovementOrEncounter(conn net.Conn, playerCoord string, battleStatus *bool) {
+	stateMu.Lock()
+	defer stateMu.Unlock()
+
+	playerCoord = strings.TrimSpace(playerCoord)
+	if _, _, ok := parseCoord(playerCoord); !ok {
+		slog.Warn("Ignoring move to invalid coordinate", "coord", playerCoord)
+		return
+	}
+
+	// Find username from conn
+	var thisUsername string
+	for name, connection := range CONNECTIONS {
+		if connection == conn {
+			thisUsername = strings.TrimSpace(name)
+			break
+		}
+	}
+
+	// Find the old location
+	oldCoord := ""
+	for loc, pl := range PLAYER_LOCATIONS {
+		if strings.TrimSpace(pl) == thisUsername {
+			oldCoord = loc
+			break
+		}
+	}
+
+	// Players may only take single steps from where the server thinks they
+	// are. Players off the board (after catching or battling) are measured
+	// from their last known position.
+	player := findPlayer(thisUsername)
+	from := oldCoord
+	if from == "" && player != nil {
+		from = player.Position
+	}
+	if from != "" && !isAdjacent(from, playerCoord) {
+		slog.Warn("Rejecting illegal move", "user", thisUsername, "from", from, "to", playerCoord)
+		putBack(thisUsername, oldCoord, from)
+		return
+	}
+
+	// Battling players stay off the board until the battle ends, and a tile
+	// holds one player unless the newcomer starts a battle with them
+	battleMu.Lock()
+	moverBattling := findBattle(thisUsername) != nil
+	enemyName, occupied := PLAYER_LOCATIONS[playerCoord]
+	enemyBattling := occupied && findBattle(enemyName) != nil
+	battleMu.Unlock()
+	if moverBattling {
+		slog.Warn("Ignoring move during a battle", "user", thisUsername, "to", playerCoord)
+		return
+	}
+	if enemyBattling {
+		slog.Info("Rejecting move onto a battling player", "user", thisUsername, "to", playerCoord, "occupant", enemyName)
+		putBack(thisUsername, oldCoord, from)
+		return
+	}
+
+	// Remove old location
+	if oldCoord != "" {
+		delete(PLAYER_LOCATIONS, oldCoord)
+	}
+
+	// Check if there's a Pokemon at the new location
+	if pokemonID, exists := claimPokemon(thisUsername, playerCoord); exists {
+		// CATCHING
+		if err := catchPokemon(conn, thisUsername, playerCoord, pokemonID); err != nil {
+			// The player never learned of the catch, so they stay where they were
+			if oldCoord != "" {
+				PLAYER_LOCATIONS[oldCoord] = thisUsername
+			}
+			putBack(thisUsername, oldCoord, from)
+			return
+		}
+		*battleStatus = true
+		if player != nil {
+			player.Position = playerCoord
+		}
+	} else if enemyName, exists := PLAYER_LOCATIONS[playerCoord]; exists {
+		// BATTLE
+		initiateBattle(conn, thisUsername, enemyName)
+		*battleStatus = true
+	} else if caught, ok := recentCatches[playerCoord]; ok && caught.by != thisUsername && time.Since(caught.at) < CATCH_RACE_WINDOW {
+		// Most likely they were heading for the same Pokemon
+		// Format: {"catch": "<catcher>-<pokemonID>"}
+		notice, _ := json.Marshal(map[string]string{"catch": caught.by + "-" + caught.pokemonID})
+		sendFrame(conn, notice)
+	}
+
+	// If not battling, update new location
+	newCoord := ""
+	if !*battleStatus {
+		PLAYER_LOCATIONS[playerCoord] = thisUsername
+		newCoord = playerCoord
+		if player != nil {
+			player.Position = playerCoord
+		}
+		logEvent(GameEvent{Event: EVENT_MOVE, User: thisUsername, From: oldCoord, At: playerCoord})
+	}
+
+	// Tell everyone which tiles changed
+	broadcastPlayerMove(thisUsername, oldCoord, newCoord)
+}
+
+// putBack undoes a rejected move by telling the clients the player is still
+// on from, the tile the server last had them on.
+// The caller must hold stateMu.
+func putBack(username, oldCoord, from string) {
+	if oldCoord == "" && tileFree(from) {
+		PLAYER_LOCATIONS[from] = username
+	}
+	if PLAYER_LOCATIONS[from] == username {
+		broadcastPlayerMove(username, "", from)
+	}
+}
+
+// broadcastPlayerMove sends only the tiles that changed when a player moved:
+// the old tile is cleared and the new one set. Either coordinate may be empty,
+// e.g. a player who enters a battle leaves the board without a new tile.
+// The caller must hold stateMu.
+func broadcastPlayerMove(username, oldCoord, newCoord string) {
+	delta := make(map[string]string)
+	if oldCoord != "" && oldCoord != newCoord {
+		delta[oldCoord] = ""
+	}
+	if newCoord != "" {
+		delta[newCoord] = username
+	}
+	if len(delta) == 0 {
+		return
+	}
+
+	sentDelta, _ := json.Marshal(delta)
+	for _, tcpConn := range CONNECTIONS {
+		sendFrame(tcpConn, sentDelta)
+	}
+}
+
+// claimPokemon takes the Pokemon on locKey off the board for username and
+// reports whether there was one, so a Pokemon can only ever be claimed once.
+// The caller must hold stateMu.
+func claimPokemon(username, locKey string) (string, bool) {
+	pokemonID, exists := POKEMON_LOCATIONS[locKey]
+	if !exists {
+		return "", false
+	}
+	delete(POKEMON_LOCATIONS, locKey)
+
+	now := time.Now()
+	for loc, caught := range recentCatches {
+		if now.Sub(caught.at) >= CATCH_RACE_WINDOW {
+			delete(recentCatches, loc)
+		}
+	}
+	recentCatches[locKey] = recentCatch{pokemonID: pokemonID, by: username, at: now}
+	return pokemonID, true
+}
+
+// catchPokemon is called when a user steps on a tile with a Pokemon they
+// claimed with claimPokemon. The catch only happens once the player has been
+// told about it: if that fails, the Pokemon is put back and an error returned.
+// The caller must hold stateMu.
+func catchPokemon(conn net.Conn, username, locKey, pokemonID string) error {
+	pokemon, ok := pokemonByID(pokemonID)
+	if !ok {
+		// Nobody can ever catch it, so just clear the tile
+		slog.Error("Cannot resolve Pokemon on the board, removing it", "user", username, "pokemon", pokemonID, "at", locKey)
+	} else {
+		// Notify the player that they caught the Pokemon. This is the one
+		// frame written synchronously, since the catch depends on it;
+		// lockedConn.Write bounds it with WRITE_TIMEOUT.
+		caughtMsg := map[string]string{username: pokemonID}
+		sentCatched, _ := json.Marshal(caughtMsg)
+		if err := protocol.WriteFrame(conn, sentCatched); err != nil {
+			// Undo claimPokemon, it's as if nobody had stepped on the tile
+			POKEMON_LOCATIONS[locKey] = pokemonID
+			delete(recentCatches, locKey)
+			slog.Warn("Cannot tell player about their catch, putting the Pokemon back", "user", username, "pokemon", pokemonID, "at", locKey, "err", err)
+			return fmt.Errorf("notifying %s of the catch: %w", username, err)
+		}
+
+		slog.Info("Caught Pokemon", "user", username, "pokemon", pokemonID, "at", locKey)
+		logEvent(GameEvent{Event: EVENT_CATCH, User: username, Pokemon: pokemonID, At: locKey})
+		if player := findPlayer(username); player != nil {
+			if PARTY_SIZE > 0 && len(player.PokeBalls) >= PARTY_SIZE {
+				player.Box = append(player.Box, copyPokemon(pokemon))
+			} else {
+				player.PokeBalls = append(player.PokeBalls, copyPokemon(pokemon))
+			}
+			player.Catches = append(player.Catches, protocol.CatchRecord{Pokemon: pokemonID, At: locKey, Time: time.Now()})
+		}
+
+		// Save to JSON file
+		persistPlayers()
+	}
+
+	// Remove the Pokemon from the board
+	coords := strings.Split(locKey, "-")
+	if len(coords) == 2 {
+		x, _ := strconv.Atoi(coords[0])
+		y, _ := strconv.Atoi(coords[1])
+		BOARD[x][y] = ""
+	}
+	forgetSpawn(locKey)
+
+	// Notify other players that the Pokemon is gone
+	for _, tcpConn := range CONNECTIONS {
+		if tcpConn != conn {
+			pokemonGone := map[string]string{locKey: ""}
+			sentPokemonGone, _ := json.Marshal(pokemonGone)
+			sendFrame(tcpConn, sentPokemonGone)
+		}
+	}
+	return nil
+}
+
+// endBattle finishes the battle the loser takes part in: both players learn
+// who won, the winner's surviving Pokemon gain EXP, the session is torn down
+// and both players are put back on free tiles of the board.
+func endBattle(loser string) {
+	stateMu.Lock()
+	defer stateMu.Unlock()
+	finishBattle(loser)
+}
+
+// finishBattle does the work of endBattle. Players who are no longer
+// connected are not put back on the board.
+// The caller must hold stateMu.
+func finishBattle(loser string) {
+	battleMu.Lock()
+	session := findBattle(loser)
+	if session == nil {
+		battleMu.Unlock()
+		return
+	}
+
+	winner := session.opponent(loser)
+	winMsg := map[string]string{"battle": "victory_" + winner}
+	sentWin, _ := json.Marshal(winMsg)
+	sendFrame(session.ConnP1, []byte(sentWin))
+	sendFrame(session.ConnP2, []byte(sentWin))
+	session.notifySpectators(winner+" won the battle!", true)
+	session.stopTurnTimer()
+	delete(BATTLES, session.ID)
+
+	survivors, earned := session.PokeBallsP1, session.ExpP1
+	if winner == session.P2 {
+		survivors, earned = session.PokeBallsP2, session.ExpP2
+	}
+	battleMu.Unlock()
+	slog.Info("Battle ended", "battle", session.ID, "winner", winner)
+	logEvent(GameEvent{Event: EVENT_VICTORY, Battle: session.ID, User: winner, Opponent: loser})
+
+	awardExp(winner, survivors, earned)
+	returnToBoard(session.P1)
+	returnToBoard(session.P2)
+}
+
+// returnToBoard puts a player who left the board for a battle back on a free
+// tile and tells everyone where they are.
+// The caller must hold stateMu.
+func returnToBoard(username string) {
+	if CONNECTIONS[username] == nil {
+		return
+	}
+	for loc, name := range PLAYER_LOCATIONS {
+		if name == username {
+			// Still on the board, just resync the clients
+			broadcastPlayerMove(username, "", loc)
+			return
+		}
+	}
+
+	if err := placePlayerOnBoard(username); err != nil {
+		slog.Warn("Cannot return player to the board", "user", username, "err", err)
+		return
+	}
+	if player := findPlayer(username); player != nil {
+		broadcastPlayerMove(username, "", player.Position)
+	}
+}
+
+// initiateBattle sets up a "battle start" scenario between two players.
+// The caller must hold stateMu.
+func initiateBattle(conn net.Conn, thisUsername, enemyUsername string) *BattleSession {
+	battleMu.Lock()
+	defer battleMu.Unlock()
+
+	nextBattleID++
+	session := &BattleSession{
+		ID:          strconv.Itoa(nextBattleID),
+		P1:          thisUsername,
+		P2:          enemyUsername,
+		ConnP1:      conn,
+		ConnP2:      CONNECTIONS[enemyUsername],
+		PokeBallsP1: []Pokemon{},
+		PokeBallsP2: []Pokemon{},
+		Player1Turn: true,
+	}
+	BATTLES[session.ID] = session
+	slog.Info("Battle initiated", "battle", session.ID, "p1", thisUsername, "p2", enemyUsername)
+	logEvent(GameEvent{Event: EVENT_BATTLE_START, Battle: session.ID, User: thisUsername, Opponent: enemyUsername})
+
+	// Notify the mover
+	battleInfo := map[string]string{"battle": enemyUsername}
+	sentBattleInfo, _ := json.Marshal(battleInfo)
+	sendFrame(session.ConnP1, sentBattleInfo)
+
+	// Notify the enemy
+	battledInfo := map[string]string{"battle": thisUsername}
+	sentBattledInfo, _ := json.Marshal(battledInfo)
+	sendFrame(session.ConnP2, sentBattledInfo)
+
+	return session
+}
+
+// findBattle returns the active battle the given player takes part in, or nil.
+// The caller must hold battleMu.
+func findBattle(username string) *BattleSession {
+	for _, session := range BATTLES {
+		if session.P1 == username || session.P2 == username {
+			return session
+		}
+	}
+	return nil
+}
+
+// opponent returns the name of the other player in the battle.
+func (s *BattleSession) opponent(username string) string {
+	if username == s.P1 {
+		return s.P2
+	}
+	return s.P1
+}
+
+// conn returns the connection of the given player in the battle.
+func (s *BattleSession) conn(username string) net.Conn {
+	if username == s.P1 {
+		return s.ConnP1
+	}
+	return s.ConnP2
+}
+
+// currentPlayer returns the name of the player whose turn it is.
+func (s *BattleSession) currentPlayer() string {
+	if s.Player1Turn {
+		return s.P1
+	}
+	return s.P2
+}
+
+// activeIndex returns the index of the given player's active Pokemon.
+func (s *BattleSession) activeIndex(username string) int {
+	index, team := s.DefIndexP1, s.PokeBallsP1
+	if username == s.P2 {
+		index, team = s.DefIndexP2, s.PokeBallsP2
+	}
+	if index >= len(team) {
+		index = 0
+	}
+	return index
+}
+
+// announceTurn tells the active player it's their turn and the other to wait,
+// and starts the turn timer.
+func (s *BattleSession) announceTurn() {
+	active := s.currentPlayer()
+
+	waitMsg := map[string]string{"battle": "wait"}
+	waitJSON, _ := json.Marshal(waitMsg)
+	sendFrame(s.conn(s.opponent(active)), []byte(waitJSON))
+
+	turnMsg := map[string]string{"battle": active}
+	turnJSON, _ := json.Marshal(turnMsg)
+	sendFrame(s.conn(active), []byte(turnJSON))
+	s.notifySpectators(active+"'s turn", false)
+
+	s.turn++
+	s.startTurnTimer()
+}
+
+// startTurnTimer arms the timer for the turn that was just announced.
+// The caller must hold battleMu.
+func (s *BattleSession) startTurnTimer() {
+	s.stopTurnTimer()
+	turn := s.turn
+	s.turnTimer = time.AfterFunc(TURN_TIMEOUT, func() {
+		// Ending the battle needs stateMu, which comes before battleMu
+		stateMu.Lock()
+		defer stateMu.Unlock()
+		battleMu.Lock()
+
+		// The battle may have ended or moved on while we waited for the lock
+		if BATTLES[s.ID] != s || s.turn != turn {
+			battleMu.Unlock()
+			return
+		}
+		loser := s.handleTurnTimeout()
+		battleMu.Unlock()
+		if loser != "" {
+			finishBattle(loser)
+		}
+	})
+}
+
+// stopTurnTimer cancels the pending turn timer, if any.
+// The caller must hold battleMu.
+func (s *BattleSession) stopTurnTimer() {
+	if s.turnTimer != nil {
+		s.turnTimer.Stop()
+		s.turnTimer = nil
+	}
+}
+
+// handleTurnTimeout attacks with the active player's current Pokemon because
+// they didn't act in time, then passes the turn on. It returns the player who
+// lost if the attack fainted their last Pokemon; the caller ends the battle.
+// The caller must hold battleMu.
+func (s *BattleSession) handleTurnTimeout() string {
+	active := s.currentPlayer()
+	slog.Info("Turn timed out", "battle", s.ID, "user", active)
+
+	timeoutMsg := map[string]string{"battle": "timeout_" + active}
+	timeoutJSON, _ := json.Marshal(timeoutMsg)
+	sendFrame(s.ConnP1, timeoutJSON)
+	sendFrame(s.ConnP2, timeoutJSON)
+	s.notifySpectators(active+" ran out of time and attacks automatically", false)
+
+	attackEnemy(s, active, s.activeIndex(active), 0)
+	if loser := s.loser(); loser != "" {
+		s.stopTurnTimer()
+		return loser
+	}
+	s.Player1Turn = !s.Player1Turn
+	s.announceTurn()
+	return ""
+}
+
+// loser returns the player with no Pokemon left standing, or "" while both
+// can still fight. Only meaningful once the battle has started.
+func (s *BattleSession) loser() string {
+	if len(s.PokeBallsP1) == 0 {
+		return s.P1
+	}
+	if len(s.PokeBallsP2) == 0 {
+		return s.P2
+	}
+	return ""
+}
+
+// spectateBattle adds conn as a spectator of the battle with the given ID and
+// sends it the current state. Unknown IDs get a list of the active battles.
+// The caller must hold battleMu.
+func spectateBattle(conn net.Conn, battleID string) {
+	session, exists := BATTLES[strings.TrimSpace(battleID)]
+	if !exists {
+		active := []string{}
+		for _, s := range BATTLES {
+			active = append(active, fmt.Sprintf("%s (%s vs %s)", s.ID, s.P1, s.P2))
+		}
+		sort.Strings(active)
+		event := "No battle with ID " + battleID + ". Active battles: none"
+		if len(active) > 0 {
+			event = "No battle with ID " + battleID + ". Active battles: " + strings.Join(active, ", ")
+		}
+		sendSpectatorUpdate(conn, protocol.SpectatorUpdate{Event: event, Over: true})
+		return
+	}
+	if conn == session.ConnP1 || conn == session.ConnP2 {
+		return
+	}
+
+	removeSpectator(conn)
+	session.Spectators = append(session.Spectators, conn)
+	sendSpectatorUpdate(conn, session.spectatorUpdate("Now spectating", false))
+}
+
+// removeSpectator stops conn from watching any battle.
+// The caller must hold battleMu.
+func removeSpectator(conn net.Conn) {
+	for _, session := range BATTLES {
+		for i, spectator := range session.Spectators {
+			if spectator == conn {
+				session.Spectators = append(session.Spectators[:i], session.Spectators[i+1:]...)
+				break
+			}
+		}
+	}
+}
+
+// spectatorUpdate describes the current state of the battle.
+func (s *BattleSession) spectatorUpdate(event string, over bool) protocol.SpectatorUpdate {
+	team := func(pokemons []Pokemon) []protocol.SpectatorPokemon {
+		result := []protocol.SpectatorPokemon{}
+		for _, p := range pokemons {
+			result = append(result, protocol.SpectatorPokemon{Name: p.Name, HP: p.Stats["HP"]})
+		}
+		return result
+	}
+	return protocol.SpectatorUpdate{
+		Battle: s.ID,
+		Event:  event,
+		P1:     s.P1,
+		P2:     s.P2,
+		TeamP1: team(s.PokeBallsP1),
+		TeamP2: team(s.PokeBallsP2),
+		Over:   over,
+	}
+}
+
+// notifySpectators sends the battle state and the latest event to everyone
+// watching. Spectators can't affect the battle, so write errors are ignored.
+// The caller must hold battleMu.
+func (s *BattleSession) notifySpectators(event string, over bool) {
+	update := s.spectatorUpdate(event, over)
+	for _, spectator := range s.Spectators {
+		sendSpectatorUpdate(spectator, update)
+	}
+}
+
+// sendSpectatorUpdate writes a single update to a spectator.
+func sendSpectatorUpdate(conn net.Conn, update protocol.SpectatorUpdate) {
+	updateJSON, _ := json.Marshal(update)
+	spectateMsg := map[string]string{"spectate": string(updateJSON)}
+	sentSpectate, _ := json.Marshal(spectateMsg)
+	sendFrame(conn, sentSpectate)
+}
+
+// levelOf returns p's level. Pokemon caught before levels existed are level 1.
+func levelOf(p Pokemon) int {
+	if p.Level < 1 {
+		return 1
+	}
+	return p.Level
+}
+
+// expToNextLevel returns the XP a Pokemon at the given level needs to level up.
+func expToNextLevel(level int) int {
+	return level * LEVEL_EXP_STEP
+}
+
+// gainExp adds amount XP to p and levels it up every time it crosses the
+// threshold for its current level, growing its stats by LEVEL_STAT_GROWTH.
+// It returns the number of levels gained.
+func gainExp(p *Pokemon, amount int) int {
+	if amount <= 0 {
+		return 0
+	}
+	p.Level = levelOf(*p)
+	p.XP += amount
+
+	gained := 0
+	for p.Level < MAX_LEVEL && p.XP >= expToNextLevel(p.Level) {
+		p.XP -= expToNextLevel(p.Level)
+		p.Level++
+		gained++
+
+		for _, key := range protocol.STAT_KEYS {
+			value, _ := strconv.Atoi(p.Stats[key])
+			p.Stats[key] = strconv.Itoa(value + max(1, int(float64(value)*LEVEL_STAT_GROWTH)))
+		}
+	}
+	if p.Level == MAX_LEVEL {
+		p.XP = 0
+	}
+	return gained
+}
+
+// totalExp returns all the EXP p has earned since it was caught.
+func totalExp(p Pokemon) int {
+	total := p.XP
+	for level := 1; level < levelOf(p); level++ {
+		total += expToNextLevel(level)
+	}
+	return total
+}
+
+// leaderboard ranks the players by how many Pokemon they caught, then by the
+// total EXP of those Pokemon, and returns the top n.
+// The caller must hold stateMu.
+func leaderboard(n int) []LeaderboardEntry {
+	entries := make([]LeaderboardEntry, 0, len(PLAYERS))
+	for _, player := range PLAYERS {
+		entry := LeaderboardEntry{Username: player.Username, Pokemon: len(player.PokeBalls) + len(player.Box)}
+		for _, p := range slices.Concat(player.PokeBalls, player.Box) {
+			entry.Exp += totalExp(p)
+		}
+		entries = append(entries, entry)
+	}
+
+	sort.Slice(entries, func(i, j int) bool {
+		if entries[i].Pokemon != entries[j].Pokemon {
+			return entries[i].Pokemon > entries[j].Pokemon
+		}
+		if entries[i].Exp != entries[j].Exp {
+			return entries[i].Exp > entries[j].Exp
+		}
+		return entries[i].Username < entries[j].Username
+	})
+	if len(entries) > n {
+		entries = entries[:n]
+	}
+	return entries
+}
+
+// sendLeaderboard sends the leaderboard to one client.
+func sendLeaderboard(conn net.Conn, entries []LeaderboardEntry) {
+	data, _ := json.Marshal(entries)
+	msg, _ := json.Marshal(map[string]string{"leaderboard": string(data)})
+	sendFrame(conn, msg)
+}
+
+// recentCatchHistory returns the last n catches of username, oldest first.
+// The caller must hold stateMu.
+func recentCatchHistory(username string, n int) []protocol.CatchRecord {
+	player := findPlayer(username)
+	if player == nil {
+		return nil
+	}
+	return player.Catches[max(0, len(player.Catches)-n):]
+}
+
+// sendCatches sends a player their catch history.
+func sendCatches(conn net.Conn, catches []protocol.CatchRecord) {
+	data, _ := json.Marshal(catches)
+	msg, _ := json.Marshal(map[string]string{"catches": string(data)})
+	sendFrame(conn, msg)
+}
+
+// releasePokemon removes the first Pokemon with the given ID from the
+// player's PokeBalls and saves the result. A Pokemon can't be released while
+// it is in the team of the player's ongoing battle.
+// The caller must hold stateMu.
+func releasePokemon(username, pokemonID string) error {
+	player := findPlayer(username)
+	if player == nil {
+		return fmt.Errorf("unknown player %q", username)
+	}
+
+	index, owned := -1, 0
+	for i, pokemon := range player.PokeBalls {
+		if pokemon.ID == pokemonID {
+			if index < 0 {
+				index = i
+			}
+			owned++
+		}
+	}
+	if index < 0 {
+		return fmt.Errorf("%s does not own a Pokemon with ID %s", username, pokemonID)
+	}
+
+	// Only spare copies of a Pokemon in the battle team may go
+	if inBattleTeam(username, pokemonID) >= owned {
+		return fmt.Errorf("Pokemon %s is in %s's battle team", pokemonID, username)
+	}
+
+	player.PokeBalls = append(player.PokeBalls[:index], player.PokeBalls[index+1:]...)
+	persistPlayers()
+	return nil
+}
+
+// inBattleTeam counts the Pokemon with the given ID in the team of the
+// player's ongoing battle.
+// The caller must hold stateMu.
+func inBattleTeam(username, pokemonID string) int {
+	battleMu.Lock()
+	defer battleMu.Unlock()
+	session := findBattle(username)
+	if session == nil {
+		return 0
+	}
+	team := session.PokeBallsP1
+	if username == session.P2 {
+		team = session.PokeBallsP2
+	}
+	inTeam := 0
+	for _, pokemon := range team {
+		if pokemon.ID == pokemonID {
+			inTeam++
+		}
+	}
+	return inTeam
+}
+
+// depositPokemon moves the first Pokemon with the given ID from the player's
+// party to their Box. The last Pokemon of a party and Pokemon in the battle
+// team stay where they are.
+// The caller must hold stateMu.
+func depositPokemon(username, pokemonID string) error {
+	player := findPlayer(username)
+	if player == nil {
+		return fmt.Errorf("unknown player %q", username)
+	}
+	index := slices.IndexFunc(player.PokeBalls, func(p Pokemon) bool { return p.ID == pokemonID })
+	if index < 0 {
+		return fmt.Errorf("no Pokemon %s in your party", pokemonID)
+	}
+	if len(player.PokeBalls) == 1 {
+		return fmt.Errorf("you must keep at least one Pokemon in your party")
+	}
+	owned := 0
+	for _, pokemon := range player.PokeBalls {
+		if pokemon.ID == pokemonID {
+			owned++
+		}
+	}
+	if inBattleTeam(username, pokemonID) >= owned {
+		return fmt.Errorf("Pokemon %s is in your battle team", pokemonID)
+	}
+
+	player.Box = append(player.Box, player.PokeBalls[index])
+	player.PokeBalls = slices.Delete(player.PokeBalls, index, index+1)
+	persistPlayers()
+	return nil
+}
+
+// fitParty moves the Pokemon past PARTY_SIZE from the player's party to the
+// end of their Box, for players saved under a larger limit or none. It reports
+// whether anything was moved.
+// The caller must hold stateMu.
+func fitParty(player *Player) bool {
+	if PARTY_SIZE <= 0 || len(player.PokeBalls) <= PARTY_SIZE {
+		return false
+	}
+	player.Box = append(player.Box, player.PokeBalls[PARTY_SIZE:]...)
+	player.PokeBalls = slices.Clip(player.PokeBalls[:PARTY_SIZE])
+	return true
+}
+
+// withdrawPokemon moves the first Pokemon with the given ID from the player's
+// Box to their party, if the party has room for it.
+// The caller must hold stateMu.
+func withdrawPokemon(username, pokemonID string) error {
+	player := findPlayer(username)
+	if player == nil {
+		return fmt.Errorf("unknown player %q", username)
+	}
+	index := slices.IndexFunc(player.Box, func(p Pokemon) bool { return p.ID == pokemonID })
+	if index < 0 {
+		return fmt.Errorf("no Pokemon %s in your box", pokemonID)
+	}
+	if PARTY_SIZE > 0 && len(player.PokeBalls) >= PARTY_SIZE {
+		return fmt.Errorf("your party is full, %d Pokemon at most", PARTY_SIZE)
+	}
+
+	player.PokeBalls = append(player.PokeBalls, player.Box[index])
+	player.Box = slices.Delete(player.Box, index, index+1)
+	persistPlayers()
+	return nil
+}
+
+// awardExp splits the EXP a player earned in battle evenly between their
+// surviving Pokemon and saves the result.
+// The caller must hold stateMu.
+func awardExp(username string, survivors []Pokemon, earned int) {
+	if len(survivors) == 0 || earned <= 0 {
+		return
+	}
+
+	player := findPlayer(username)
+	if player == nil {
+		return
+	}
+
+	// Battle teams hold copies, so match them back to the player's Pokemon by ID
+	share := max(1, earned/len(survivors))
+	awarded := make(map[int]bool)
+	for _, survivor := range survivors {
+		for i := range player.PokeBalls {
+			if awarded[i] || player.PokeBalls[i].ID != survivor.ID {
+				continue
+			}
+			awarded[i] = true
+			if gainExp(&player.PokeBalls[i], share) > 0 {
+				slog.Info("Pokemon leveled up", "user", username, "pokemon", player.PokeBalls[i].Name, "level", player.PokeBalls[i].Level)
+			}
 			break
 		}
 	}
 
-	// Check if there's a Pokemon at the new location
-	if pokemonID, exists := POKEMON_LOCATIONS[playerCoord]; exists {
-		// CATCHING
-		catchPokemon(conn, thisUsername, playerCoord, pokemonID)
-		*battleStatus = true
-	} else if enemyName, exists := PLAYER_LOCATIONS[playerCoord]; exists {
-		// BATTLE
-		initiateBattle(conn, thisUsername, enemyName)
-		*battleStatus = true
-	}
+	persistPlayers()
+}
 
-	// If not battling, update new location
-	if !*battleStatus {
-		PLAYER_LOCATIONS[playerCoord] = thisUsername
+// pokemonByID looks up a Pokemon in POKEMONS by its ID field. Scraped data
+// can have gaps, so a Pokemon's position in the slice says nothing about its ID.
+func pokemonByID(id string) (Pokemon, bool) {
+	for _, pokemon := range POKEMONS {
+		if pokemon.ID == id {
+			return pokemon, true
+		}
 	}
-
-	// Broadcast updated PLAYER_LOCATIONS to all connected players
-	broadcastPlayerLocations()
+	return Pokemon{}, false
 }
 
-// broadcastPlayerLocations sends the entire PLAYER_LOCATIONS map to all players.
-func broadcastPlayerLocations() {
-	sentPLAYER_LOCATIONS, _ := json.Marshal(PLAYER_LOCATIONS)
-	for _, tcpConn := range CONNECTIONS {
-		tcpConn.Write([]byte(sentPLAYER_LOCATIONS))
+// copyPokemon returns a copy of p that doesn't share its Stats map, so battle
+// damage never leaks back into the pokedex.
+func copyPokemon(p Pokemon) Pokemon {
+	stats := make(map[string]string, len(p.Stats))
+	for k, v := range p.Stats {
+		stats[k] = v
 	}
+	p.Stats = stats
+	return p
 }
 
-// catchPokemon is called when a user steps on a tile with a Pokemon.
-func catchPokemon(conn net.Conn, username, locKey, pokemonID string) {
-	fmt.Printf("%s is catching Pokemon %s at %s\n", username, pokemonID, locKey)
-
-	// Notify the player that they caught the Pokemon
-	caughtMsg := map[string]string{username: pokemonID}
-	sentCatched, _ := json.Marshal(caughtMsg)
-	conn.Write(sentCatched)
-	for i := 0; i < len(PLAYERS); i++ {
-		if PLAYERS[i].Username == username {
-			pokeID, _ := strconv.Atoi(pokemonID)
-			PLAYERS[i].PokeBalls = append(PLAYERS[i].PokeBalls, POKEMONS[pokeID])
+// ownedPokemons returns copies of every Pokemon with the given ID in the
+// player's PokeBalls.
+// The caller must hold stateMu.
+func ownedPokemons(username, pokemonID string) []Pokemon {
+	var owned []Pokemon
+	if player := findPlayer(username); player != nil {
+		for _, pokemon := range player.PokeBalls {
+			if pokemon.ID == pokemonID {
+				owned = append(owned, copyPokemon(pokemon))
+			}
 		}
 	}
+	return owned
+}
 
-	// // Save to JSON file
-	file, err := os.Create("players.json")
-	if err != nil {
-		log.Fatal("Cannot create file", err)
+// submitPokemon adds the chosen Pokemon to either P1 or P2's team. owned holds
+// the player's own Pokemon with that ID, so nobody can battle with a Pokemon
+// they never caught or submit one Pokemon more often than they own it.
+func submitPokemon(session *BattleSession, currentPlayer, pokemonID string, owned []Pokemon) error {
+	team := &session.PokeBallsP1
+	if currentPlayer == session.P2 {
+		team = &session.PokeBallsP2
 	}
-	defer file.Close()
 
-	encoder := json.NewEncoder(file)
-	encoder.SetIndent("", "  ")
-	if err := encoder.Encode(PLAYERS); err != nil {
-		log.Fatal("Cannot encode to JSON", err)
+	if session.Started || len(*team) >= MAX_TEAM_SIZE {
+		return fmt.Errorf("%s's team is already complete", currentPlayer)
 	}
 
-	// Remove the Pokemon from the board
-	coords := strings.Split(locKey, "-")
-	if len(coords) == 2 {
-		x, _ := strconv.Atoi(coords[0])
-		y, _ := strconv.Atoi(coords[1])
-		BOARD[x][y] = ""
+	submitted := 0
+	for _, pokemon := range *team {
+		if pokemon.ID == pokemonID {
+			submitted++
+		}
+	}
+	if submitted >= len(owned) {
+		return fmt.Errorf("%s does not own another Pokemon with ID %s", currentPlayer, pokemonID)
 	}
-	delete(POKEMON_LOCATIONS, locKey)
 
-	// Notify other players that the Pokemon is gone
-	for _, tcpConn := range CONNECTIONS {
-		if tcpConn != conn {
-			pokemonGone := map[string]string{locKey: ""}
-			sentPokemonGone, _ := json.Marshal(pokemonGone)
-			tcpConn.Write([]byte(sentPokemonGone))
-		}
+	*team = append(*team, owned[submitted])
+	if len(*team) == MAX_TEAM_SIZE {
+		session.markReady(currentPlayer)
 	}
+	return nil
 }
 
-// initiateBattle sets up a "battle start" scenario between two players.
-func initiateBattle(conn net.Conn, thisUsername, enemyUsername string) {
-	fmt.Printf("Battle initiated: %s vs %s\n", thisUsername, enemyUsername)
-
-	// Notify the mover
-	battleInfo := map[string]string{"battle": enemyUsername}
-	sentBattleInfo, _ := json.Marshal(battleInfo)
-	conn.Write(sentBattleInfo)
-
-	// Notify the enemy
-	battledInfo := map[string]string{"battle": thisUsername}
-	sentBattledInfo, _ := json.Marshal(battledInfo)
-	CONNECTIONS[enemyUsername].Write(sentBattledInfo)
-
-	// Reset relevant battle data
-	pokeBalls_P1 = []Pokemon{}
-	pokeBalls_P2 = []Pokemon{}
-	P1 = thisUsername
-	P2 = enemyUsername
-	player1Turn = true
-}
-
-// submitPokemon adds the chosen Pokemon to either P1 or P2's team.
-func submitPokemon(currentPlayer, pokemonID string) {
-	for i := 0; i < len(POKEMONS); i++ {
-		if POKEMONS[i].ID == pokemonID {
-			if currentPlayer == P1 {
-				pokeBalls_P1 = append(pokeBalls_P1, POKEMONS[i])
-			} else if currentPlayer == P2 {
-				pokeBalls_P2 = append(pokeBalls_P2, POKEMONS[i])
-			}
-			break
-		}
+// markReady records that a player has finished choosing their team. Players
+// without any Pokemon in their team can't be ready.
+func (s *BattleSession) markReady(username string) {
+	if username == s.P1 && len(s.PokeBallsP1) > 0 {
+		s.ReadyP1 = true
+	} else if username == s.P2 && len(s.PokeBallsP2) > 0 {
+		s.ReadyP2 = true
 	}
 }
 
-// handleBattleAction interprets the action (attack or switch) from the player
-// and applies the effect in the battle context.
-func handleBattleAction(currentPlayer, mainMessage string) {
-	parts := strings.Split(mainMessage, "*")
-	if len(parts) != 2 {
+// startIfReady begins the battle once both players have submitted their
+// teams. The player with the faster lead Pokemon goes first.
+func (s *BattleSession) startIfReady() {
+	if s.Started || !s.ReadyP1 || !s.ReadyP2 {
 		return
 	}
-	action := strings.TrimSpace(parts[1])
+	s.Started = true
+	slog.Info("Battle begins", "battle", s.ID, "teamP1", len(s.PokeBallsP1), "teamP2", len(s.PokeBallsP2))
+
+	speed_P1, _ := strconv.Atoi(s.PokeBallsP1[0].Stats["Speed"])
+	speed_P2, _ := strconv.Atoi(s.PokeBallsP2[0].Stats["Speed"])
+
+	// Check whose Pokemon is faster
+	s.Player1Turn = speed_P1 >= speed_P2
+	s.announceTurn()
+}
 
-	if action == "switch" {
-		if player1Turn {
-			currentPokemonIndex, _ := strconv.Atoi(parts[0])
-			currentDefIndex_P1 = currentPokemonIndex
+// handleBattleAction applies an attack or a switch from the player in the
+// battle context.
+func handleBattleAction(session *BattleSession, action protocol.BattleAction) {
+	switch action.Action {
+	case protocol.ACTION_SWITCH:
+		// Only the player whose turn it is may switch, and only to a
+		// Pokemon they still have
+		if action.Player != session.currentPlayer() {
+			return
+		}
+		team := session.PokeBallsP1
+		if action.Player == session.P2 {
+			team = session.PokeBallsP2
+		}
+		if action.Index < 0 || action.Index >= len(team) {
+			slog.Warn("Rejected switch", "battle", session.ID, "user", action.Player, "index", action.Index)
+			return
+		}
+		if action.Player == session.P1 {
+			session.DefIndexP1 = action.Index
 		} else {
-			currentPokemonIndex, _ := strconv.Atoi(parts[0])
-			currentDefIndex_P2 = currentPokemonIndex
+			session.DefIndexP2 = action.Index
+		}
+
+	case protocol.ACTION_ATTACK:
+		// Only the player whose turn it is may attack
+		if action.Player != session.currentPlayer() {
+			return
+		}
+		// A Pokemon or move we don't know keeps the turn, so the player can
+		// choose again
+		if !validAttack(session, action) {
+			slog.Warn("Rejected attack", "battle", session.ID, "user", action.Player, "index", action.Index, "move", action.Move)
+			invalidMsg, _ := json.Marshal(map[string]string{"battle": "invalid-move"})
+			sendFrame(session.conn(action.Player), invalidMsg)
+			turnMsg, _ := json.Marshal(map[string]string{"battle": action.Player})
+			sendFrame(session.conn(action.Player), turnMsg)
+			return
 		}
+
+		// 1) Attack logic
+		attackEnemy(session, action.Player, action.Index, action.Move)
+
+		// 2) Switch turn to the other player
+		session.Player1Turn = !session.Player1Turn
+
+		// 3) Tell the attacker to wait and the defender it's their turn
+		session.announceTurn()
 	}
+}
 
-	// If it's P1's turn
-	if action == "attack" {
-		currentPokemonIndex, _ := strconv.Atoi(parts[0])
-		if player1Turn {
-			if currentPlayer == P1 && action == "attack" {
-				// 1) Attack logic
-				attackEnemy(pokeBalls_P1, pokeBalls_P2, currentPokemonIndex, currentDefIndex_P2, P2)
-				fmt.Print(currentDefIndex_P2)
+// validAttack reports whether the attacker has a Pokemon at action.Index that
+// knows the move at action.Move.
+func validAttack(session *BattleSession, action protocol.BattleAction) bool {
+	team := session.PokeBallsP1
+	if action.Player == session.P2 {
+		team = session.PokeBallsP2
+	}
+	if action.Index < 0 || action.Index >= len(team) {
+		return false
+	}
+	moves := protocol.MovesOf(team[action.Index].Moves, team[action.Index].Types)
+	return action.Move >= 0 && action.Move < len(moves)
+}
 
-				// 2) Switch turn to P2
+// DamageModel computes the base damage of an attack, before type
+// effectiveness, STAB and critical hits are applied. Special moves use Sp Atk
+// and Sp Def instead of Attack and Defense. power is the power of the move.
+// Damage is called with battleMu held, so it may use battleRand.
+type DamageModel interface {
+	Damage(attacker, defender Pokemon, power int, special bool) int
+}
 
-				// 3) Tell the attacker: “Please wait…”
-				waitMsg := map[string]string{"battle": "wait"}
-				waitJSON, _ := json.Marshal(waitMsg)
-				CONNECTIONS[P1].Write([]byte(waitJSON))
+// SubtractiveModel deals the attacking stat minus the defending stat, scaled
+// by the move's power relative to BASE_POWER.
+type SubtractiveModel struct{}
 
-				// 4) Tell the defender: “It’s your turn.”
-				turnMsg := map[string]string{"battle": P2}
-				turnJSON, _ := json.Marshal(turnMsg)
-				CONNECTIONS[P2].Write([]byte(turnJSON))
+// RatioModel uses the main-series damage formula
+// ((2 * Level / 5 + 2) * Power * Atk / Def) / 50 + 2, scaled by a random
+// factor of 85-100%.
+type RatioModel struct{}
 
-				player1Turn = false
+// ClassicModel uses SubtractiveModel for physical moves and RatioModel for
+// special ones.
+type ClassicModel struct{}
 
-			}
-		} else {
-			// If it's P2's turn
-			if currentPlayer == P2 && action == "attack" {
-				// 1) Attack logic
-				attackEnemy(pokeBalls_P2, pokeBalls_P1, currentPokemonIndex, currentDefIndex_P1, P1)
-
-				// 2) Switch turn back to P1
-
-				// 3) Tell P2: “Please wait…”
-				waitMsg := map[string]string{"battle": "wait"}
-				waitJSON, _ := json.Marshal(waitMsg)
-				CONNECTIONS[P2].Write([]byte(waitJSON))
-
-				// 4) Tell P1: “It’s your turn.”
-				turnMsg := map[string]string{"battle": P1}
-				turnJSON, _ := json.Marshal(turnMsg)
-				CONNECTIONS[P1].Write([]byte(turnJSON))
-				player1Turn = true
-			}
-		}
+// DAMAGE_MODELS are the damage models that can be picked with -damage.
+var DAMAGE_MODELS = map[string]DamageModel{
+	"classic":     ClassicModel{},
+	"subtractive": SubtractiveModel{},
+	"ratio":       RatioModel{},
+}
+
+// attackStats returns the attacker's offensive and the defender's defensive
+// stat for a physical or special move.
+func attackStats(attacker, defender Pokemon, special bool) (atk, def int) {
+	atkKey, defKey := "Attack", "Defense"
+	if special {
+		atkKey, defKey = "Sp Atk", "Sp Def"
+	}
+	atk, _ = strconv.Atoi(attacker.Stats[atkKey])
+	def, _ = strconv.Atoi(defender.Stats[defKey])
+	return atk, def
+}
+
+func (SubtractiveModel) Damage(attacker, defender Pokemon, power int, special bool) int {
+	atk, def := attackStats(attacker, defender, special)
+	return (atk - def) * power / BASE_POWER
+}
+
+func (RatioModel) Damage(attacker, defender Pokemon, power int, special bool) int {
+	atk, def := attackStats(attacker, defender, special)
+	if def < 1 {
+		def = 1
+	}
+	damage := ((2*BATTLE_LEVEL/5+2)*power*atk/def)/50 + 2
+	// Add random factor (85-100%)
+	return damage * (85 + battleRand.Intn(16)) / 100
+}
+
+func (ClassicModel) Damage(attacker, defender Pokemon, power int, special bool) int {
+	if special {
+		return RatioModel{}.Damage(attacker, defender, power, special)
 	}
+	return SubtractiveModel{}.Damage(attacker, defender, power, special)
 }
 
-// attackEnemy applies damage from attackingTeam to defendingTeam.
-func attackEnemy(attackingTeam, defendingTeam []Pokemon, attackerIndex, defenderIndex int, defenderPlayer string) {
+// attackEnemy makes the attacker's Pokemon at attackerIndex use its move at
+// moveIndex on the opponent's active Pokemon.
+func attackEnemy(session *BattleSession, attacker string, attackerIndex, moveIndex int) {
+	defenderPlayer := session.opponent(attacker)
+	attackingTeam, defendingTeam := session.PokeBallsP1, session.PokeBallsP2
+	defenderIndex := session.DefIndexP2
+	if attacker == session.P2 {
+		attackingTeam, defendingTeam = session.PokeBallsP2, session.PokeBallsP1
+		defenderIndex = session.DefIndexP1
+	}
+
 	if attackerIndex < 0 || attackerIndex >= len(attackingTeam) || len(defendingTeam) == 0 {
 		return
 	}
@@ -542,24 +2276,48 @@ func attackEnemy(attackingTeam, defendingTeam []Pokemon, attackerIndex, defender
 	// Defensive HP
 	defHP, _ := strconv.Atoi(defPoke.Stats["HP"])
 
-	var damage int
-
-	// if specAttackChance == 1 {
-	// 	atkValue, _ := strconv.Atoi(attackingTeam[attackerIndex].Stats["Sp Atk"])
-	// 	defValue, _ := strconv.Atoi(defPoke.Stats["Sp Def"])
-	// 	// Base damage formula: ((2 * Level * Power) / 5 + 2) * (Attack / Defense)
-	// 	baseDamage := 50 // Base power
-	// 	damage = ((2*50*baseDamage)/5 + 2) * atkValue / defValue
-	// 	// Add random factor (85-100%)
-	// 	damage = damage * (85 + rand.Intn(16)) / 100
-	// } else {
-	atkValue, _ := strconv.Atoi(attackingTeam[attackerIndex].Stats["Attack"])
-	defValue, _ := strconv.Atoi(defPoke.Stats["Defense"])
-	damage = atkValue - defValue
-	// }
-
-	// Ensure minimum damage
-	if damage < 1 {
+	atkPoke := attackingTeam[attackerIndex]
+
+	moves := protocol.MovesOf(atkPoke.Moves, atkPoke.Types)
+	if moveIndex < 0 || moveIndex >= len(moves) {
+		return
+	}
+	move := moves[moveIndex]
+
+	// Roll for accuracy; a missed attack deals no damage
+	if !rollChance(ACCURACY) {
+		missMsg := map[string]string{"battle": fmt.Sprintf("missed-%d", defenderIndex)}
+		sentMissMsg, _ := json.Marshal(missMsg)
+		sendFrame(session.conn(defenderPlayer), []byte(sentMissMsg))
+		session.notifySpectators(fmt.Sprintf("%s's %s used %s and missed", attacker, atkPoke.Name, move.Name), false)
+		logEvent(GameEvent{Event: EVENT_ATTACK, Battle: session.ID, User: attacker, Opponent: defenderPlayer, Pokemon: atkPoke.ID, Move: move.Name, HP: defHP, Missed: true})
+		return
+	}
+
+	// Decide whether this is a special or a physical move
+	var flags []string
+	special := rollChance(SPECIAL_CHANCE)
+	if special {
+		flags = append(flags, "special")
+	}
+	// The multipliers scale a positive base, so a weak attacker's
+	// super-effective hit still beats a resisted one
+	damage := max(damageModel.Damage(atkPoke, defPoke, move.Power, special), 1)
+
+	multiplier := protocol.TypeMultiplier(move.Type, defPoke.Types)
+	if hasSTAB(atkPoke, move.Type) {
+		multiplier *= STAB_BONUS
+	}
+	damage = int(float64(damage) * multiplier)
+
+	// Roll for a critical hit
+	if rollChance(CRIT_CHANCE) {
+		damage = int(float64(damage) * CRIT_MULTIPLIER)
+		flags = append(flags, "crit")
+	}
+
+	// Ensure minimum damage, unless the defender is immune
+	if multiplier > 0 && damage < 1 {
 		damage = 1
 	}
 
@@ -568,6 +2326,13 @@ func attackEnemy(attackingTeam, defendingTeam []Pokemon, attackerIndex, defender
 	// Check if Pokemon is defeated
 	if defHP <= 0 {
 		defHP = 0
+		// The attacker earns the defeated Pokemon's base EXP
+		baseExp, _ := strconv.Atoi(defPoke.Exp)
+		if attacker == session.P1 {
+			session.ExpP1 += baseExp
+		} else {
+			session.ExpP2 += baseExp
+		}
 		// Remove the fainted Pokemon
 		defendingTeam = append(defendingTeam[:defenderIndex], defendingTeam[defenderIndex+1:]...)
 	} else {
@@ -575,22 +2340,31 @@ func attackEnemy(attackingTeam, defendingTeam []Pokemon, attackerIndex, defender
 		defendingTeam[defenderIndex].Stats["HP"] = strconv.Itoa(defHP)
 	}
 
-	// Sync back to the global slice
-	if defenderPlayer == P1 {
-		pokeBalls_P1 = defendingTeam
-
+	// Sync back to the session
+	if defenderPlayer == session.P1 {
+		session.PokeBallsP1 = defendingTeam
 	} else {
-		pokeBalls_P2 = defendingTeam
-
+		session.PokeBallsP2 = defendingTeam
 	}
 
 	// Notify the defending player about the result
-	attackMsg := map[string]string{
-		"battle": fmt.Sprintf("attacked-%d-%d-%d", defHP, damage, defenderIndex),
+	// Format: "attacked-HP-DamageReceived-Index[-flag,flag...]"
+	result := fmt.Sprintf("attacked-%d-%d-%d", defHP, damage, defenderIndex)
+	if len(flags) > 0 {
+		result += "-" + strings.Join(flags, ",")
 	}
+	attackMsg := map[string]string{"battle": result}
 	sentAttackMsg, _ := json.Marshal(attackMsg)
-	CONNECTIONS[defenderPlayer].Write([]byte(sentAttackMsg))
-	defenderIndex = 0
+	sendFrame(session.conn(defenderPlayer), []byte(sentAttackMsg))
+
+	logEvent(GameEvent{Event: EVENT_ATTACK, Battle: session.ID, User: attacker, Opponent: defenderPlayer, Pokemon: atkPoke.ID, Move: move.Name, Damage: damage, HP: defHP, Flags: flags})
+
+	event := fmt.Sprintf("%s's %s used %s on %s's %s for %d damage", attacker, atkPoke.Name, move.Name, defenderPlayer, defPoke.Name, damage)
+	if defHP == 0 {
+		event += ", " + defPoke.Name + " fainted"
+		logEvent(GameEvent{Event: EVENT_FAINT, Battle: session.ID, User: defenderPlayer, Pokemon: defPoke.ID})
+	}
+	session.notifySpectators(event, false)
 }
 
 // -----------------------------------------------------------------------------
@@ -613,82 +2387,372 @@ func attackEnemy(attackingTeam, defendingTeam []Pokemon, attackerIndex, defender
 // 	}
 // }
 
+// Write writes b as a whole before any other write to the connection starts.
+// A write taking longer than WRITE_TIMEOUT fails.
+func (c *lockedConn) Write(b []byte) (int, error) {
+	c.writeMu.Lock()
+	defer c.writeMu.Unlock()
+	c.Conn.SetWriteDeadline(time.Now().Add(WRITE_TIMEOUT))
+	return c.Conn.Write(b)
+}
+
+// Send queues payload for the connection's writer goroutine and returns right
+// away, so sending under stateMu or battleMu never waits for a slow client.
+// Frames are written in the order they were queued. A player who falls
+// OUTBOX_SIZE frames behind is disconnected.
+func (c *lockedConn) Send(payload []byte) {
+	c.queueMu.Lock()
+	defer c.queueMu.Unlock()
+
+	if c.dropped {
+		return
+	}
+	if c.outbox == nil {
+		c.outbox = make(chan []byte, OUTBOX_SIZE)
+		c.writerDone = make(chan struct{})
+		go c.writeQueued(c.outbox, c.writerDone)
+	}
+	select {
+	case c.outbox <- payload:
+	default:
+		// The reader notices the closed connection and cleans up
+		slog.Warn("Player too slow to keep up, disconnecting", "remote", c.RemoteAddr().String())
+		c.dropped = true
+		c.Conn.Close()
+	}
+}
+
+// writeQueued writes the frames queued by Send until closeOutbox is called,
+// then closes the connection.
+func (c *lockedConn) writeQueued(outbox <-chan []byte, done chan<- struct{}) {
+	defer close(done)
+	for payload := range outbox {
+		if err := protocol.WriteFrame(c, payload); err != nil {
+			// Keep draining; the reader cleans up the broken connection
+			c.Conn.Close()
+		}
+	}
+	c.Conn.Close()
+}
+
+// closeOutbox stops queueing frames for the connection. Frames already queued
+// are still written before the connection is closed; the returned channel is
+// closed once that has happened.
+func (c *lockedConn) closeOutbox() <-chan struct{} {
+	c.queueMu.Lock()
+	defer c.queueMu.Unlock()
+
+	c.dropped = true
+	if c.outbox == nil {
+		// Nothing was ever queued
+		c.Conn.Close()
+		done := make(chan struct{})
+		close(done)
+		return done
+	}
+	close(c.outbox)
+	c.outbox = nil
+	return c.writerDone
+}
+
+// sendFrame queues payload for conn, see lockedConn.Send. Connections without
+// an outbox, like the fakes in tests, are written to directly.
+func sendFrame(conn net.Conn, payload []byte) {
+	if c, ok := conn.(*lockedConn); ok {
+		c.Send(payload)
+		return
+	}
+	protocol.WriteFrame(conn, payload)
+}
+
+// abortLogin logs why a login attempt was dropped and closes the connection.
+func abortLogin(conn net.Conn, err error) {
+	slog.Warn("Login aborted", "remote", conn.RemoteAddr().String(), "err", err)
+	conn.Close()
+}
+
 // handleAuthConnection handles the initial login/registration flow for a new connection.
 func handleAuthConnection(conn net.Conn) {
 	infoReader := bufio.NewReader(conn)
 
-	// Get username
+	// The client announces its protocol version before anything else
+	versionLine, err := infoReader.ReadString('\n')
+	if err != nil {
+		abortLogin(conn, err)
+		return
+	}
+	if version, ok := strings.CutPrefix(strings.TrimSpace(versionLine), protocol.VERSION_PREFIX); !ok || version != strconv.Itoa(protocol.PROTOCOL_VERSION) {
+		slog.Warn("Rejected incompatible client", "remote", conn.RemoteAddr().String(), "version", strings.TrimSpace(versionLine))
+		rejectLogin(conn, fmt.Sprintf("incompatible client, the server speaks protocol version %d", protocol.PROTOCOL_VERSION))
+		return
+	}
+
+	// Get username, or "register" followed by the username of a new player
 	username, err := infoReader.ReadString('\n')
-	checkError(err)
+	if err != nil {
+		abortLogin(conn, err)
+		return
+	}
 	username = strings.TrimSpace(username)
 
+	register := username == "register"
+	if register {
+		username, err = infoReader.ReadString('\n')
+		if err != nil {
+			abortLogin(conn, err)
+			return
+		}
+		username = strings.TrimSpace(username)
+	}
+
 	// Get password
 	password, err := infoReader.ReadString('\n')
-	checkError(err)
+	if err != nil {
+		abortLogin(conn, err)
+		return
+	}
 	password = strings.TrimSpace(password)
 
-	// Verify credentials
-	if verifyPlayer(username, password, PLAYERS) {
-		// If successful, send "successful" to the client
-		conn.Write([]byte("successful"))
-
-		// Send some initial Pokemon indexes (3 random indexes for demonstration)
-		for i := 0; i < len(PLAYERS); i++ {
-			if PLAYERS[i].Username == username {
-				loadPokemons := ""
-				for j := 0; j < len(PLAYERS[i].PokeBalls); j++ {
-					idx := PLAYERS[i].PokeBalls[j].ID
-					loadPokemons += idx
-					if j < len(PLAYERS[i].PokeBalls)-1 {
-						loadPokemons += "-"
-					}
-				}
-				conn.Write([]byte(loadPokemons))
-			}
+	// Refuse names that would corrupt the messages they end up in
+	if err := validateUsername(username); err != nil {
+		slog.Warn("Rejected invalid username", "user", username, "err", err)
+		rejectLogin(conn, err.Error())
+		return
+	}
+
+	// Create the account first if the player asked to register
+	if register {
+		if err := registerPlayer(username, password); err != nil {
+			slog.Warn("Registration rejected", "user", username, "err", err)
+			rejectLogin(conn, err.Error())
+			return
 		}
+		slog.Info("New player registered", "user", username)
+	}
 
-		// Artificial delay (not sure why you put 22 seconds, but preserving)
-		time.Sleep(2 * time.Second)
+	// Verify credentials
+	verified := verifyPlayer(username, password)
+	stateMu.Lock()
+	alreadyOnline := verified && (CONNECTIONS[username] != nil || pendingLogins[username])
+	if verified && !alreadyOnline {
+		// Reserve the username until the connection is registered below
+		pendingLogins[username] = true
+	}
+	stateMu.Unlock()
 
-		// Register this connection globally
-		CONNECTIONS[username] = conn
-		fmt.Println("New player logged in:", username)
+	// A second login for the same user is rejected; the first session is kept
+	if alreadyOnline {
+		slog.Warn("Rejected duplicate login", "user", username)
+		rejectLogin(conn, "already logged in")
+		return
+	}
 
-		// Send current Pokemon locations
-		sendCurrentPokemonLocations(conn)
+	if verified {
+		// The welcome is written before the connection is registered and
+		// under the same lock, so no update can reach the client before it
+		stateMu.Lock()
+		// The party limit may have shrunk since the player was saved
+		if player := findPlayer(username); player != nil && fitParty(player) {
+			slog.Info("Moved Pokemon over the party size to the box", "user", username, "party", PARTY_SIZE)
+			persistPlayers()
+		}
 
 		// Place player on the BOARD
-		placePlayerOnBoard(username)
+		if err := placePlayerOnBoard(username); err != nil {
+			delete(pendingLogins, username)
+			stateMu.Unlock()
+			slog.Warn("Cannot place player", "user", username, "err", err)
+			rejectLogin(conn, err.Error())
+			return
+		}
+
+		// The welcome has everything the client needs to draw the board
+		welcomeMsg, _ := json.Marshal(welcome(username))
+		sendFrame(conn, welcomeMsg)
+
+		// Everyone else learns where the new player is
+		if player := findPlayer(username); player != nil {
+			broadcastPlayerMove(username, "", player.Position)
+		}
 
-		// Broadcast updated player locations
-		broadcastPlayerLocations()
+		// Register this connection globally
+		CONNECTIONS[username] = conn
+		delete(pendingLogins, username)
+		slog.Info("New player logged in", "user", username)
+		stateMu.Unlock()
 
 		// Now handle the rest of the in-game communication
 		HandleInGameConnection(conn)
 
 	} else {
-		// If failed, send "failed"
-		conn.Write([]byte("failed"))
+		rejectLogin(conn, "wrong username or password")
 	}
 }
 
-// sendCurrentPokemonLocations marshals and sends current Pokemon positions to the client.
-func sendCurrentPokemonLocations(conn net.Conn) {
-	sentPOKEMON_LOCATIONS, _ := json.Marshal(POKEMON_LOCATIONS)
-	conn.Write([]byte(sentPOKEMON_LOCATIONS))
+// rejectLogin answers a login with a Welcome saying why it failed.
+func rejectLogin(conn net.Conn, reason string) {
+	rejectMsg, _ := json.Marshal(protocol.Welcome{Result: "failed: " + reason, Version: protocol.PROTOCOL_VERSION})
+	protocol.WriteFrame(conn, rejectMsg)
 }
 
-// placePlayerOnBoard finds a random empty spot on the BOARD for this player.
-func placePlayerOnBoard(username string) {
-	for {
-		playerX := rand.Intn(ROWS)
-		playerY := rand.Intn(COLS)
-		if BOARD[playerX][playerY] == "" {
-			BOARD[playerX][playerY] = username
-			PLAYER_LOCATIONS[fmt.Sprintf("%d-%d", playerX, playerY)] = username
-			break
+// welcome builds the Welcome for username, who must already be on the board.
+// The caller must hold stateMu.
+func welcome(username string) protocol.Welcome {
+	w := protocol.Welcome{
+		Result:  protocol.LOGIN_SUCCESSFUL,
+		Version: protocol.PROTOCOL_VERSION,
+		Rows:    ROWS,
+		Cols:    COLS,
+		Spawns:  currentPokemonLocations(),
+		Players: maps.Clone(PLAYER_LOCATIONS),
+		Party:   PARTY_SIZE,
+	}
+	if player := findPlayer(username); player != nil {
+		for _, pokemon := range player.PokeBalls {
+			w.Pokemon = append(w.Pokemon, pokemon.ID)
+		}
+		for _, pokemon := range player.Box {
+			w.Box = append(w.Box, pokemon.ID)
+		}
+	}
+	return w
+}
+
+// currentPokemonLocations returns the Pokemon on the board by x-y tile, with
+// DESPAWNING for those players have been warned about.
+// The caller must hold stateMu.
+func currentPokemonLocations() map[string]string {
+	locations := make(map[string]string, len(POKEMON_LOCATIONS))
+	for locKey, pokemonID := range POKEMON_LOCATIONS {
+		locations[locKey] = pokemonID
+	}
+	// Players joining late see the same warnings as everyone else
+	for _, entry := range despawnQueues {
+		if entry.warned {
+			locations[entry.locKey] = protocol.DESPAWNING
+		}
+	}
+	return locations
+}
+
+// parseCoord parses an "x-y" coordinate and reports whether it lies on the BOARD.
+func parseCoord(coord string) (x, y int, ok bool) {
+	coords := strings.Split(coord, "-")
+	if len(coords) != 2 {
+		return 0, 0, false
+	}
+	x, errX := strconv.Atoi(coords[0])
+	y, errY := strconv.Atoi(coords[1])
+	if errX != nil || errY != nil || x < 0 || x >= ROWS || y < 0 || y >= COLS {
+		return 0, 0, false
+	}
+	return x, y, true
+}
+
+// isAdjacent reports whether the "x-y" coordinates a and b are exactly one
+// step apart horizontally or vertically.
+func isAdjacent(a, b string) bool {
+	ax, ay, okA := parseCoord(a)
+	bx, by, okB := parseCoord(b)
+	if !okA || !okB {
+		return false
+	}
+	dx, dy := ax-bx, ay-by
+	return dx*dx+dy*dy == 1
+}
+
+// usernameOf returns the name of the player on conn, or "" if there is none.
+// The caller must hold stateMu.
+func usernameOf(conn net.Conn) string {
+	for name, connection := range CONNECTIONS {
+		if connection == conn {
+			return name
+		}
+	}
+	return ""
+}
+
+// findPlayer returns a pointer to the named player in PLAYERS, or nil.
+// The caller must hold stateMu.
+func findPlayer(username string) *Player {
+	for i := range PLAYERS {
+		if PLAYERS[i].Username == username {
+			return &PLAYERS[i]
+		}
+	}
+	return nil
+}
+
+// tileFree reports whether coord is an "x-y" tile on the BOARD that holds
+// neither a player nor a Pokemon.
+// The caller must hold stateMu.
+func tileFree(coord string) bool {
+	if _, _, ok := parseCoord(coord); !ok {
+		return false
+	}
+	_, hasPlayer := PLAYER_LOCATIONS[coord]
+	_, hasPokemon := POKEMON_LOCATIONS[coord]
+	return !hasPlayer && !hasPokemon
+}
+
+// placePlayerOnBoard puts the player back on their last known tile if it is
+// still free, otherwise on a random free tile. Players are only kept in
+// PLAYER_LOCATIONS; the BOARD holds Pokemon. It fails if the board is full.
+// The caller must hold stateMu.
+func placePlayerOnBoard(username string) error {
+	player := findPlayer(username)
+
+	// Put returning players back where they left off if nobody took the tile
+	var locKey string
+	if player != nil && tileFree(player.Position) {
+		locKey = player.Position
+	} else {
+		var ok bool
+		if locKey, ok = findFreeTile(); !ok {
+			return errors.New("the board is full")
+		}
+	}
+
+	PLAYER_LOCATIONS[locKey] = username
+	if player != nil {
+		player.Position = locKey
+	}
+	return nil
+}
+
+// shutdownServer tells every connected player the server is going away,
+// persists players.json and closes all connections once everything queued
+// for them has been written.
+func shutdownServer() {
+	stateMu.Lock()
+
+	shutdownMsg, _ := json.Marshal(map[string]string{"server": "shutdown"})
+	for _, tcpConn := range CONNECTIONS {
+		sendFrame(tcpConn, shutdownMsg)
+	}
+
+	// Save right away instead of waiting for a debounced flush
+	if err := savePlayers(PLAYERS_FILE, PLAYERS); err != nil {
+		slog.Error("Cannot save players file", "err", err)
+	} else {
+		playersDirty = false
+	}
+
+	var flushed []<-chan struct{}
+	for _, tcpConn := range CONNECTIONS {
+		if c, ok := tcpConn.(*lockedConn); ok {
+			flushed = append(flushed, c.closeOutbox())
+		} else {
+			tcpConn.Close()
 		}
 	}
+	closeEventLog()
+	stateMu.Unlock()
+
+	// Writes are bounded by WRITE_TIMEOUT, main by SHUTDOWN_TIMEOUT
+	for _, done := range flushed {
+		<-done
+	}
 }
 
 // -----------------------------------------------------------------------------
@@ -696,42 +2760,163 @@ func placePlayerOnBoard(username string) {
 // -----------------------------------------------------------------------------
 
 func main() {
+	addr := flag.String("addr", ":8080", "address to listen on, e.g. :8080 or 127.0.0.1:9000")
+	rows := flag.Int("rows", ROWS, "number of rows on the board")
+	cols := flag.Int("cols", COLS, "number of columns on the board")
+	logLevel := flag.String("loglevel", "info", "minimum log level: debug, info, warn or error")
+	eventLogFile := flag.String("eventlog", "", "append game events as JSON lines to this file")
+	damage := flag.String("damage", "classic", "damage formula: classic, subtractive or ratio")
+	admins := flag.String("admins", "", "comma-separated usernames allowed to use admin commands")
+	initialSpawns := flag.Int("initial-spawns", INITIAL_SPAWNS, "number of Pokemon spawned at startup")
+	spawnBatch := flag.Int("spawn-batch", NUMBERTOPROCESS, "number of Pokemon spawned every spawn interval")
+	partySize := flag.Int("party-size", PARTY_SIZE, "most Pokemon a player carries, the rest go to their box (0 for no limit, 6 in the games)")
+	seed := flag.Int64("seed", 0, "seed for spawns, placements and battles, to reproduce a game (0 picks one)")
+	flag.Parse()
+
+	level, err := parseLogLevel(*logLevel)
+	if err != nil {
+		fmt.Fprintf(os.Stderr, "Invalid -loglevel %q: %v\n", *logLevel, err)
+		os.Exit(2)
+	}
+	slog.SetDefault(slog.New(slog.NewTextHandler(os.Stderr, &slog.HandlerOptions{Level: level})))
+
+	if *rows < 1 || *cols < 1 {
+		slog.Error("Invalid board size: -rows and -cols must be at least 1", "rows", *rows, "cols", *cols)
+		os.Exit(1)
+	}
+	ROWS, COLS = *rows, *cols
+
+	// More Pokemon than fit on the board, or than it may hold, could never spawn
+	capacity := min(ROWS*COLS, MAX_POKEMON_ON_BOARD)
+	if *initialSpawns < 0 || *initialSpawns > capacity || *spawnBatch < 0 || *spawnBatch > capacity {
+		slog.Error("Invalid spawn counts: -initial-spawns and -spawn-batch must be between 0 and the board capacity",
+			"initialSpawns", *initialSpawns, "spawnBatch", *spawnBatch, "capacity", capacity)
+		os.Exit(1)
+	}
+	INITIAL_SPAWNS, NUMBERTOPROCESS = *initialSpawns, *spawnBatch
+
+	if *partySize < 0 {
+		slog.Error("Invalid -party-size: must not be negative", "partySize", *partySize)
+		os.Exit(1)
+	}
+	PARTY_SIZE = *partySize
+
+	model, ok := DAMAGE_MODELS[*damage]
+	if !ok {
+		slog.Error("Unknown damage model", "damage", *damage)
+		os.Exit(1)
+	}
+	damageModel = model
+
+	for _, name := range strings.Split(*admins, ",") {
+		if name = strings.TrimSpace(name); name != "" {
+			ADMINS[name] = true
+		}
+	}
+
+	if *eventLogFile != "" {
+		if err := openEventLog(*eventLogFile); err != nil {
+			slog.Error("Cannot open event log", "file", *eventLogFile, "err", err)
+			os.Exit(1)
+		}
+	}
+
 	// Initialize the BOARD
+	BOARD = make([][]string, ROWS)
 	for i := range BOARD {
 		BOARD[i] = make([]string, COLS)
 	}
 
-	rand.Seed(time.Now().UnixNano())
+	// The seed is always logged so any game can be replayed with -seed
+	if *seed == 0 {
+		*seed = time.Now().UnixNano()
+	}
+	slog.Info("Seeding random number generator", "seed", *seed)
+	worldRand = rand.New(rand.NewSource(*seed))
+	battleRand = rand.New(rand.NewSource(worldRand.Int63()))
 
 	// Load data from JSON
 	POKEMONS = loadPokemons("pokedex.json")
-	PLAYERS = loadPlayers("players.json")
+	if len(POKEMONS) == 0 {
+		slog.Error("pokedex.json has no usable Pokemon, run the pokedex scraper first")
+		os.Exit(1)
+	}
+	PLAYERS = loadPlayers(PLAYERS_FILE)
+
+	// types.json is optional, the built-in type chart is used without it
+	chart, err := protocol.LoadTypeChart("types.json")
+	if err != nil {
+		slog.Error("Cannot load type chart", "err", err)
+		os.Exit(1)
+	}
+	if missing := protocol.MissingTypes(chart, pokedexTypes(POKEMONS)); len(missing) > 0 {
+		slog.Error("pokedex.json uses types missing from the type chart", "types", missing)
+		os.Exit(1)
+	}
+	protocol.TYPE_CHART = chart
+
+	// zones.json is optional, Pokemon spawn anywhere without it
+	zones, err := loadZones("zones.json")
+	if err != nil {
+		slog.Error("Cannot load spawn zones", "err", err)
+		os.Exit(1)
+	}
+	SPAWN_ZONES = zones
 
 	// Initial random Pokemon spawn
-	generateRandomPokemons(5)
-	fmt.Println("Initial Pokemon Locations:", POKEMON_LOCATIONS)
+	generateRandomPokemons(INITIAL_SPAWNS)
+	slog.Debug("Initial Pokemon locations", "locations", POKEMON_LOCATIONS)
 
 	// Start background goroutine for spawning & despawning Pokemon
 	go handlePokemons()
 
-	// Start listening on port 8080
-	listener, err := net.Listen("tcp", ":8080")
+	// Start listening on the configured address
+	listener, err := net.Listen("tcp", *addr)
 	if err != nil {
-		fmt.Printf("Error starting server: %v\n", err)
+		slog.Error("Cannot start server", "err", err)
 		os.Exit(1)
 	}
 	defer listener.Close()
 
-	fmt.Println("Server is listening on port 8080")
+	slog.Info("Server is listening", "addr", listener.Addr().String())
+
+	// Shut down gracefully on SIGINT/SIGTERM
+	signals := make(chan os.Signal, 1)
+	signal.Notify(signals, os.Interrupt, syscall.SIGTERM)
+	stopped := make(chan struct{})
+	go func() {
+		sig := <-signals
+		slog.Info("Shutting down", "signal", sig.String())
+		listener.Close()
+
+		done := make(chan struct{})
+		go func() {
+			shutdownServer()
+			close(done)
+		}()
+		select {
+		case <-done:
+			slog.Info("Server stopped")
+		case <-time.After(SHUTDOWN_TIMEOUT):
+			slog.Warn("Shutdown timed out, exiting anyway")
+		}
+		close(stopped)
+	}()
 
 	// Accept new connections
 	for {
 		conn, err := listener.Accept()
 		if err != nil {
-			fmt.Printf("Error accepting connection: %v\n", err)
+			if errors.Is(err, net.ErrClosed) {
+				// The listener was closed by the shutdown handler
+				<-stopped
+				return
+			}
+			slog.Error("Cannot accept connection", "err", err)
 			continue
 		}
-		// Handle authentication in a new goroutine
-		go handleAuthConnection(conn)
+		// Handle authentication in a new goroutine; every write to the
+		// connection from now on goes through the lock
+		go handleAuthConnection(&lockedConn{Conn: conn})
 	}
 }
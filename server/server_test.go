@@ -0,0 +1,1775 @@
+package main
+
+import (
+	"bytes"
+	"encoding/json"
+	"fmt"
+	"math/rand"
+	"net"
+	"os"
+	"path/filepath"
+	"runtime"
+	"slices"
+	"strconv"
+	"strings"
+	"sync"
+	"testing"
+	"time"
+
+	"golang.org/x/crypto/bcrypt"
+
+	"pokemon/protocol"
+)
+
+// resetState gives a test a fresh board, player list and connection table.
+// It takes stateMu since a debounced save from an earlier test may still run.
+// Tests may replace POKEMONS; it is restored when the test ends.
+func resetState(t *testing.T, players []Player) {
+	t.Helper()
+	pokemons := POKEMONS
+	t.Cleanup(func() { POKEMONS = pokemons })
+	stateMu.Lock()
+	defer stateMu.Unlock()
+	PLAYERS_FILE = filepath.Join(t.TempDir(), "players.json")
+	PLAYERS = players
+	BOARD = make([][]string, ROWS)
+	for i := range BOARD {
+		BOARD[i] = make([]string, COLS)
+	}
+	POKEMON_LOCATIONS = make(map[string]string)
+	PLAYER_LOCATIONS = make(map[string]string)
+	despawnQueues = nil
+	recentCatches = make(map[string]recentCatch)
+	CONNECTIONS = make(map[string]net.Conn)
+	pendingLogins = make(map[string]bool)
+	BATTLES = make(map[string]*BattleSession)
+	playersDirty, saveScheduled = false, false
+}
+
+// login runs handleAuthConnection against one end of an in-memory pipe and
+// sends the protocol version and the credentials from the other end. Every
+// frame the server sends is delivered on the returned channel.
+func login(t *testing.T, username, password string) (net.Conn, <-chan string) {
+	t.Helper()
+	return handshake(t, protocol.VERSION_PREFIX+strconv.Itoa(protocol.PROTOCOL_VERSION)+"\n"+username+"\n"+password+"\n")
+}
+
+// handshake is login with the lines the client sends spelled out. When the
+// test ends both ends of the pipe are closed and the handler is waited for, so
+// it can't touch the state the next test resets.
+func handshake(t *testing.T, lines string) (net.Conn, <-chan string) {
+	t.Helper()
+	client, server := net.Pipe()
+	done := make(chan struct{})
+	go func() {
+		defer close(done)
+		handleAuthConnection(server)
+	}()
+	t.Cleanup(func() {
+		client.Close()
+		server.Close()
+		select {
+		case <-done:
+		case <-time.After(5 * time.Second):
+			t.Error("connection handler did not return")
+		}
+	})
+
+	frames := make(chan string, 100)
+	go func() {
+		defer close(frames)
+		for {
+			frame, err := protocol.ReadFrame(client)
+			if err != nil {
+				return
+			}
+			frames <- string(frame)
+		}
+	}()
+
+	if _, err := client.Write([]byte(lines)); err != nil {
+		t.Fatal(err)
+	}
+	return client, frames
+}
+
+// nextFrame waits for the next frame on the channel.
+func nextFrame(t *testing.T, frames <-chan string) string {
+	t.Helper()
+	select {
+	case frame, ok := <-frames:
+		if !ok {
+			t.Fatal("connection closed while waiting for a frame")
+		}
+		return frame
+	case <-time.After(5 * time.Second):
+		t.Fatal("timed out waiting for a frame")
+	}
+	return ""
+}
+
+// nextWelcome reads the next frame and decodes it as the server's answer to a
+// login.
+func nextWelcome(t *testing.T, frames <-chan string) protocol.Welcome {
+	t.Helper()
+	frame := nextFrame(t, frames)
+	var w protocol.Welcome
+	if err := json.Unmarshal([]byte(frame), &w); err != nil {
+		t.Fatalf("login reply %q is not a welcome: %v", frame, err)
+	}
+	return w
+}
+
+// waitForLogin waits until the server has registered username's connection
+// and placed them on the board.
+func waitForLogin(t *testing.T, username string) {
+	t.Helper()
+	deadline := time.Now().Add(5 * time.Second)
+	for {
+		stateMu.RLock()
+		registered := CONNECTIONS[username]
+		stateMu.RUnlock()
+		if registered != nil {
+			return
+		}
+		if time.Now().After(deadline) {
+			t.Fatalf("%s was never registered", username)
+		}
+		time.Sleep(10 * time.Millisecond)
+	}
+}
+
+func TestLockedConnKeepsFramesWhole(t *testing.T) {
+	raw := &tricklingConn{}
+	conn := &lockedConn{Conn: raw}
+
+	const writers, frames = 8, 20
+	var wg sync.WaitGroup
+	for w := 0; w < writers; w++ {
+		wg.Add(1)
+		go func(w int) {
+			defer wg.Done()
+			payload := []byte(fmt.Sprintf(`{"writer":"%d"}`, w))
+			for i := 0; i < frames; i++ {
+				protocol.WriteFrame(conn, payload)
+			}
+		}(w)
+	}
+	wg.Wait()
+
+	reader := bytes.NewReader(raw.data)
+	for i := 0; i < writers*frames; i++ {
+		frame, err := protocol.ReadFrame(reader)
+		if err != nil {
+			t.Fatalf("frame %d: %v", i, err)
+		}
+		var msg map[string]string
+		if err := json.Unmarshal(frame, &msg); err != nil {
+			t.Fatalf("frame %d is garbled: %q", i, frame)
+		}
+	}
+}
+
+func TestLockedConnSendKeepsOrder(t *testing.T) {
+	client, server := net.Pipe()
+	defer client.Close()
+	conn := &lockedConn{Conn: server}
+
+	for i := 0; i < 10; i++ {
+		conn.Send([]byte(strconv.Itoa(i)))
+	}
+
+	for i := 0; i < 10; i++ {
+		frame, err := protocol.ReadFrame(client)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if string(frame) != strconv.Itoa(i) {
+			t.Fatalf("frame %d is %q", i, frame)
+		}
+	}
+	conn.closeOutbox()
+}
+
+func TestLockedConnCloseOutboxFlushes(t *testing.T) {
+	client, server := net.Pipe()
+	defer client.Close()
+	conn := &lockedConn{Conn: server}
+
+	conn.Send([]byte("last"))
+	done := conn.closeOutbox()
+	// Ignored, the connection is on its way out
+	conn.Send([]byte("too late"))
+
+	frame, err := protocol.ReadFrame(client)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if string(frame) != "last" {
+		t.Fatalf("got %q, want the frame queued before closing", frame)
+	}
+	<-done
+	if _, err := protocol.ReadFrame(client); err == nil {
+		t.Fatal("the connection is still open after its outbox was flushed")
+	}
+}
+
+func TestLockedConnSendDropsSlowPlayer(t *testing.T) {
+	// Nobody reads the client end, so the writer goroutine blocks on the
+	// first frame and the rest pile up
+	client, server := net.Pipe()
+	defer client.Close()
+	conn := &lockedConn{Conn: server}
+
+	for i := 0; i < OUTBOX_SIZE+2; i++ {
+		conn.Send([]byte("{}"))
+	}
+	if !conn.dropped {
+		t.Fatal("a player who never reads was not disconnected")
+	}
+	conn.closeOutbox()
+}
+
+func TestHasSTAB(t *testing.T) {
+	// An entry from a malformed pokedex.json with no types at all
+	var malformed Pokemon
+	if err := json.Unmarshal([]byte(`{"id":"999","name":"Missingno","types":[],"stats":{}}`), &malformed); err != nil {
+		t.Fatal(err)
+	}
+
+	tests := []struct {
+		name     string
+		attacker Pokemon
+		moveType string
+		want     bool
+	}{
+		{"single type match", Pokemon{Types: []string{"fire"}}, "fire", true},
+		{"single type mismatch", Pokemon{Types: []string{"fire"}}, "water", false},
+		{"dual type first", Pokemon{Types: []string{"grass", "poison"}}, "grass", true},
+		{"dual type second", Pokemon{Types: []string{"grass", "poison"}}, "poison", true},
+		{"dual type mismatch", Pokemon{Types: []string{"grass", "poison"}}, "fire", false},
+		{"same type twice", Pokemon{Types: []string{"water", "water"}}, "water", true},
+		{"case insensitive", Pokemon{Types: []string{"Water"}}, "water", true},
+		{"empty types", malformed, "normal", false},
+		{"nil types", Pokemon{}, "", false},
+	}
+	for _, tt := range tests {
+		if got := hasSTAB(tt.attacker, tt.moveType); got != tt.want {
+			t.Errorf("%s: hasSTAB = %v, want %v", tt.name, got, tt.want)
+		}
+	}
+}
+
+func TestDamageModels(t *testing.T) {
+	pokemons := loadPokemons("pokedex.json")
+	if len(pokemons) == 0 {
+		t.Fatal("no Pokemon loaded from pokedex.json")
+	}
+
+	// Pair every Pokemon with a handful of opponents, including itself
+	for i, attacker := range pokemons {
+		for _, j := range []int{i, 0, len(pokemons) - 1, (i * 7) % len(pokemons)} {
+			defender := pokemons[j]
+
+			for _, special := range []bool{false, true} {
+				if got := (RatioModel{}).Damage(attacker, defender, BASE_POWER, special); got < 1 {
+					t.Errorf("RatioModel(%s, %s, special=%v) = %d, want >= 1", attacker.Name, defender.Name, special, got)
+				}
+				atk, def := attackStats(attacker, defender, special)
+				if got := (SubtractiveModel{}).Damage(attacker, defender, BASE_POWER, special); got != atk-def {
+					t.Errorf("SubtractiveModel(%s, %s, special=%v) = %d, want %d", attacker.Name, defender.Name, special, got, atk-def)
+				}
+			}
+
+			// The classic model subtracts for physical moves only
+			atk, _ := strconv.Atoi(attacker.Stats["Attack"])
+			def, _ := strconv.Atoi(defender.Stats["Defense"])
+			if got := (ClassicModel{}).Damage(attacker, defender, BASE_POWER, false); got != atk-def {
+				t.Errorf("ClassicModel(%s, %s) = %d, want %d", attacker.Name, defender.Name, got, atk-def)
+			}
+			if got := (ClassicModel{}).Damage(attacker, defender, BASE_POWER, true); got < 1 {
+				t.Errorf("ClassicModel(%s, %s, special) = %d, want >= 1", attacker.Name, defender.Name, got)
+			}
+		}
+	}
+}
+
+func TestLoadPokemonsDropsInvalidStats(t *testing.T) {
+	path := filepath.Join(t.TempDir(), "pokedex.json")
+	data := `[
+		{"id":"1","name":"Complete","stats":{"HP":"45","Attack":"49","Defense":"49","Sp Atk":"65","Sp Def":"65","Speed":"45"}},
+		{"id":"2","name":"NoSpeed","stats":{"HP":"45","Attack":"49","Defense":"49","Sp Atk":"65","Sp Def":"65"}},
+		{"id":"3","name":"BadHP","stats":{"HP":"??","Attack":"49","Defense":"49","Sp Atk":"65","Sp Def":"65","Speed":"45"}}
+	]`
+	if err := os.WriteFile(path, []byte(data), 0644); err != nil {
+		t.Fatal(err)
+	}
+
+	pokemons := loadPokemons(path)
+	if len(pokemons) != 1 || pokemons[0].ID != "1" {
+		t.Fatalf("loadPokemons kept %+v, want only ID 1", pokemons)
+	}
+}
+
+func TestSavePlayersReplacesFile(t *testing.T) {
+	dir := t.TempDir()
+	path := filepath.Join(dir, "players.json")
+	if err := os.WriteFile(path, []byte("old contents"), 0644); err != nil {
+		t.Fatal(err)
+	}
+
+	players := []Player{{Username: "ash", Password: "x", PokeBalls: []Pokemon{{ID: "25", Name: "Pikachu"}}}}
+	if err := savePlayers(path, players); err != nil {
+		t.Fatal(err)
+	}
+
+	loaded := loadPlayers(path)
+	if len(loaded) != 1 || loaded[0].Username != "ash" || len(loaded[0].PokeBalls) != 1 {
+		t.Errorf("loadPlayers after save = %+v", loaded)
+	}
+
+	// The temporary file must be gone after the rename
+	entries, err := os.ReadDir(dir)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(entries) != 1 {
+		t.Errorf("directory holds %d files after save, want 1", len(entries))
+	}
+}
+
+func TestEventLogAppendsJSONLines(t *testing.T) {
+	path := filepath.Join(t.TempDir(), "events.jsonl")
+	if err := os.WriteFile(path, []byte(`{"time":"2024-01-01T00:00:00Z","event":"spawn"}`+"\n"), 0644); err != nil {
+		t.Fatal(err)
+	}
+	if err := openEventLog(path); err != nil {
+		t.Fatal(err)
+	}
+	logEvent(GameEvent{Event: EVENT_CATCH, User: "ash", Pokemon: "25", At: "1-2"})
+	logEvent(GameEvent{Event: EVENT_ATTACK, Battle: "1", User: "ash", Opponent: "gary", Damage: 12, HP: 30, Flags: []string{"crit"}})
+	closeEventLog()
+	logEvent(GameEvent{Event: EVENT_MOVE}) // dropped once the log is closed
+
+	data, err := os.ReadFile(path)
+	if err != nil {
+		t.Fatal(err)
+	}
+	lines := strings.Split(strings.TrimSpace(string(data)), "\n")
+	if len(lines) != 3 {
+		t.Fatalf("event log has %d lines, want 3:\n%s", len(lines), data)
+	}
+
+	var catch, attack GameEvent
+	if err := json.Unmarshal([]byte(lines[1]), &catch); err != nil {
+		t.Fatal(err)
+	}
+	if err := json.Unmarshal([]byte(lines[2]), &attack); err != nil {
+		t.Fatal(err)
+	}
+	if catch.Event != EVENT_CATCH || catch.User != "ash" || catch.At != "1-2" || catch.Time.IsZero() {
+		t.Errorf("catch event = %+v", catch)
+	}
+	if attack.Damage != 12 || attack.HP != 30 || len(attack.Flags) != 1 || attack.Missed {
+		t.Errorf("attack event = %+v", attack)
+	}
+	if strings.Contains(lines[1], "damage") {
+		t.Errorf("catch line %s carries fields that don't apply to it", lines[1])
+	}
+}
+
+func TestPersistPlayersIsDebounced(t *testing.T) {
+	resetState(t, []Player{{Username: "ash"}})
+
+	stateMu.Lock()
+	for i := 0; i < 3; i++ {
+		persistPlayers()
+	}
+	scheduled := saveScheduled
+	stateMu.Unlock()
+
+	if !scheduled {
+		t.Fatal("persistPlayers did not schedule a flush")
+	}
+	if _, err := os.Stat(PLAYERS_FILE); !os.IsNotExist(err) {
+		t.Fatalf("players file written before the debounce elapsed: %v", err)
+	}
+
+	flushPlayers()
+	if loaded := loadPlayers(PLAYERS_FILE); len(loaded) != 1 || loaded[0].Username != "ash" {
+		t.Errorf("players file after flush = %+v", loaded)
+	}
+	stateMu.RLock()
+	defer stateMu.RUnlock()
+	if playersDirty {
+		t.Error("players still marked dirty after a successful flush")
+	}
+}
+
+func TestRatioModelZeroDefense(t *testing.T) {
+	attacker := Pokemon{Stats: map[string]string{"Sp Atk": "100"}}
+	defender := Pokemon{Stats: map[string]string{"Sp Def": "0"}}
+	if got := (RatioModel{}).Damage(attacker, defender, BASE_POWER, true); got < 1 {
+		t.Errorf("RatioModel with zero Sp Def = %d, want >= 1", got)
+	}
+}
+
+func TestAccuracyBoundaries(t *testing.T) {
+	for i := 0; i < 1000; i++ {
+		if !rollChance(1.0) {
+			t.Fatal("an attack with 100% accuracy missed")
+		}
+		if rollChance(0.0) {
+			t.Fatal("an attack with 0% accuracy hit")
+		}
+	}
+}
+
+func TestDuplicateLoginRejected(t *testing.T) {
+	hash, err := hashPassword("pikachu")
+	if err != nil {
+		t.Fatal(err)
+	}
+	resetState(t, []Player{{Username: "ash", Password: hash}})
+
+	first, firstFrames := login(t, "ash", "pikachu")
+	defer first.Close()
+	if got := nextWelcome(t, firstFrames).Result; got != protocol.LOGIN_SUCCESSFUL {
+		t.Fatalf("first login got %q, want %q", got, protocol.LOGIN_SUCCESSFUL)
+	}
+
+	// A second login while the first one is still being set up
+	second, secondFrames := login(t, "ash", "pikachu")
+	defer second.Close()
+	if got := nextWelcome(t, secondFrames).Result; got != "failed: already logged in" {
+		t.Fatalf("second login got %q, want rejection", got)
+	}
+
+	// Wait for the first login to be fully registered
+	waitForLogin(t, "ash")
+
+	// A third login once the first is in game
+	third, thirdFrames := login(t, "ash", "pikachu")
+	defer third.Close()
+	if got := nextWelcome(t, thirdFrames).Result; got != "failed: already logged in" {
+		t.Fatalf("third login got %q, want rejection", got)
+	}
+
+	stateMu.RLock()
+	defer stateMu.RUnlock()
+	if len(CONNECTIONS) != 1 {
+		t.Errorf("got %d connections, want 1", len(CONNECTIONS))
+	}
+	tiles := 0
+	for _, name := range PLAYER_LOCATIONS {
+		if name == "ash" {
+			tiles++
+		}
+	}
+	if tiles != 1 {
+		t.Errorf("ash occupies %d tiles, want 1", tiles)
+	}
+}
+
+func TestValidateUsername(t *testing.T) {
+	tests := []struct {
+		username string
+		valid    bool
+	}{
+		{"ash", true},
+		{"Ash2024", true},
+		{"ab", false},
+		{"abcdefghijklmnopq", false},
+		{"ash-ketchum", false},
+		{"ash*1", false},
+		{"ash ketchum", false},
+		{"ash_k", false},
+		{"151", false},
+		{"7eleven", false},
+		{"wait", false},
+		{"Battle", false},
+		{"enemy", false},
+	}
+	for _, tt := range tests {
+		err := validateUsername(tt.username)
+		if (err == nil) != tt.valid {
+			t.Errorf("validateUsername(%q) = %v, want valid %v", tt.username, err, tt.valid)
+		}
+	}
+}
+
+func TestInvalidUsernameRejectedAtLogin(t *testing.T) {
+	resetState(t, nil)
+	client, frames := login(t, "wait", "secret")
+	defer client.Close()
+
+	if reply := nextWelcome(t, frames).Result; !strings.HasPrefix(reply, "failed: ") || !strings.Contains(reply, "reserved") {
+		t.Errorf("login as \"wait\" got %q, want a failure naming the reserved word", reply)
+	}
+}
+
+func TestIncompatibleClientRejected(t *testing.T) {
+	hash, err := hashPassword("pikachu")
+	if err != nil {
+		t.Fatal(err)
+	}
+	for _, lines := range []string{
+		"ash\npikachu\n", // a client from before the handshake
+		protocol.VERSION_PREFIX + strconv.Itoa(protocol.PROTOCOL_VERSION+1) + "\nash\npikachu\n",
+		protocol.VERSION_PREFIX + "one\nash\npikachu\n",
+	} {
+		resetState(t, []Player{{Username: "ash", Password: hash}})
+		client, frames := handshake(t, lines)
+		w := nextWelcome(t, frames)
+		client.Close()
+		if !strings.HasPrefix(w.Result, "failed: incompatible client") || w.Version != protocol.PROTOCOL_VERSION {
+			t.Errorf("handshake %q got %+v, want a rejection naming the server's version", lines, w)
+		}
+		stateMu.RLock()
+		online := len(CONNECTIONS) + len(pendingLogins)
+		stateMu.RUnlock()
+		if online != 0 {
+			t.Errorf("handshake %q logged ash in", lines)
+		}
+	}
+}
+
+func TestCatchFlow(t *testing.T) {
+	hash, err := hashPassword("pikachu")
+	if err != nil {
+		t.Fatal(err)
+	}
+	resetState(t, []Player{{Username: "ash", Password: hash, Position: "2-2"}})
+	POKEMONS = []Pokemon{
+		{ID: "1", Name: "Bulbasaur", Stats: battleStats(nil)},
+		{ID: "2", Name: "Ivysaur", Stats: battleStats(nil)},
+	}
+	BOARD[2][3] = "1"
+	POKEMON_LOCATIONS["2-3"] = "1"
+
+	client, frames := login(t, "ash", "pikachu")
+	defer client.Close()
+	w := nextWelcome(t, frames)
+	if w.Result != protocol.LOGIN_SUCCESSFUL {
+		t.Fatalf("login got %q, want %q", w.Result, protocol.LOGIN_SUCCESSFUL)
+	}
+	// The welcome alone is enough to draw the board
+	if w.Rows != ROWS || w.Cols != COLS || w.Spawns["2-3"] != "1" || w.Players["2-2"] != "ash" {
+		t.Errorf("welcome = %+v, want the board size, Bulbasaur at 2-3 and ash at 2-2", w)
+	}
+	waitForLogin(t, "ash")
+
+	// Step onto the Pokemon next to us
+	if _, err := client.Write([]byte("2-3\n")); err != nil {
+		t.Fatal(err)
+	}
+	for {
+		var msg map[string]string
+		if json.Unmarshal([]byte(nextFrame(t, frames)), &msg) != nil {
+			continue // non-JSON frames
+		}
+		if id, ok := msg["ash"]; ok {
+			if id != "1" {
+				t.Errorf("caught Pokemon %q, want %q", id, "1")
+			}
+			break
+		}
+	}
+
+	// The Pokemon is added to the player right after the catch message
+	deadline := time.Now().Add(5 * time.Second)
+	for {
+		stateMu.RLock()
+		caught := len(PLAYERS[0].PokeBalls)
+		_, onBoard := POKEMON_LOCATIONS["2-3"]
+		stateMu.RUnlock()
+		if caught == 1 && !onBoard {
+			break
+		}
+		if time.Now().After(deadline) {
+			t.Fatalf("after the catch ash has %d Pokemon and the tile still holds one: %v", caught, onBoard)
+		}
+		time.Sleep(10 * time.Millisecond)
+	}
+	stateMu.RLock()
+	defer stateMu.RUnlock()
+	if got := PLAYERS[0].PokeBalls[0].Name; got != "Bulbasaur" {
+		t.Errorf("ash caught %s, want Bulbasaur", got)
+	}
+	if catches := PLAYERS[0].Catches; len(catches) != 1 || catches[0].Pokemon != "1" || catches[0].At != "2-3" || catches[0].Time.IsZero() {
+		t.Errorf("ash's catch history = %v, want Bulbasaur caught at 2-3", catches)
+	}
+}
+
+func TestRecentCatchHistory(t *testing.T) {
+	var catches []protocol.CatchRecord
+	for i := 0; i < 5; i++ {
+		catches = append(catches, protocol.CatchRecord{Pokemon: strconv.Itoa(i + 1), At: "0-0"})
+	}
+	resetState(t, []Player{{Username: "ash", Catches: catches}, {Username: "misty"}})
+
+	got := recentCatchHistory("ash", 3)
+	if len(got) != 3 || got[0].Pokemon != "3" || got[2].Pokemon != "5" {
+		t.Errorf("recentCatchHistory(ash, 3) = %v, want the last 3 catches", got)
+	}
+	if got := recentCatchHistory("misty", 3); len(got) != 0 {
+		t.Errorf("misty has caught nothing but got %v", got)
+	}
+	if got := recentCatchHistory("nobody", 3); got != nil {
+		t.Errorf("unknown player got %v", got)
+	}
+}
+
+func TestCatchUnknownPokemon(t *testing.T) {
+	resetState(t, []Player{{Username: "ash"}})
+	POKEMONS = []Pokemon{{ID: "1", Name: "Bulbasaur", Stats: battleStats(nil)}}
+	BOARD[2][3] = "151"
+	POKEMON_LOCATIONS["2-3"] = "151"
+
+	id, ok := claimPokemon("ash", "2-3")
+	if !ok || id != "151" {
+		t.Fatalf("claimPokemon = %q, %v, want 151, true", id, ok)
+	}
+	catchPokemon(nil, "ash", "2-3", id)
+	if len(PLAYERS[0].PokeBalls) != 0 {
+		t.Errorf("ash caught %v, want nothing", PLAYERS[0].PokeBalls)
+	}
+	if _, onBoard := POKEMON_LOCATIONS["2-3"]; onBoard || BOARD[2][3] != "" {
+		t.Error("the unknown Pokemon was left on the board")
+	}
+}
+
+func TestCatchRolledBackWhenCatcherUnreachable(t *testing.T) {
+	resetState(t, []Player{{Username: "ash", Position: "2-2"}, {Username: "misty"}})
+	POKEMONS = []Pokemon{{ID: "25", Name: "Pikachu", Stats: battleStats(nil)}}
+	spawnPokemon("2-3", "25")
+	ash, misty := brokenConn{}, &recordingConn{}
+	CONNECTIONS["ash"], CONNECTIONS["misty"] = ash, misty
+	PLAYER_LOCATIONS["2-2"] = "ash"
+
+	battleStatus := false
+	handleMovementOrEncounter(ash, "2-3", &battleStatus)
+
+	if battleStatus || PLAYER_LOCATIONS["2-2"] != "ash" || PLAYER_LOCATIONS["2-3"] != "" {
+		t.Errorf("ash left 2-2 although the catch failed: %v", PLAYER_LOCATIONS)
+	}
+	if POKEMON_LOCATIONS["2-3"] != "25" || BOARD[2][3] != "25" || len(despawnQueues) != 1 {
+		t.Errorf("Pikachu is no longer on 2-3: %v", POKEMON_LOCATIONS)
+	}
+	if len(PLAYERS[0].PokeBalls) != 0 || playersDirty {
+		t.Errorf("ash caught %v although they were never told", PLAYERS[0].PokeBalls)
+	}
+	if _, ok := recentCatches["2-3"]; ok {
+		t.Error("the undone catch is still recorded as a recent catch")
+	}
+	if slices.Contains(misty.frames, `{"2-3":""}`) {
+		t.Errorf("misty was told Pikachu is gone: %v", misty.frames)
+	}
+
+	// The Pokemon is still up for grabs
+	if id, ok := claimPokemon("misty", "2-3"); !ok || id != "25" {
+		t.Errorf("claimPokemon after the rollback = %q, %v", id, ok)
+	}
+}
+
+func TestAdminSpawn(t *testing.T) {
+	resetState(t, []Player{{Username: "ash"}, {Username: "misty"}})
+	POKEMONS = []Pokemon{{ID: "25", Name: "Pikachu", Stats: battleStats(nil)}}
+	ADMINS = map[string]bool{"ash": true}
+	defer func() { ADMINS = make(map[string]bool) }()
+	misty := &recordingConn{}
+	CONNECTIONS["misty"] = misty
+	PLAYER_LOCATIONS["1-1"] = "misty"
+
+	for _, tt := range []struct{ user, args string }{
+		{"misty", "25-2-2"}, // not an admin
+		{"ash", "999-2-2"},  // unknown Pokemon
+		{"ash", "25-1-1"},   // taken by misty
+		{"ash", "25-99-2"},  // off the board
+		{"ash", "25"},
+	} {
+		if err := adminSpawn(tt.user, tt.args); err == nil {
+			t.Errorf("adminSpawn(%q, %q) succeeded, want an error", tt.user, tt.args)
+		}
+	}
+	if len(POKEMON_LOCATIONS) != 0 {
+		t.Fatalf("rejected spawns left Pokemon on the board: %v", POKEMON_LOCATIONS)
+	}
+
+	if err := adminSpawn("ash", "25-2-2"); err != nil {
+		t.Fatal(err)
+	}
+	if POKEMON_LOCATIONS["2-2"] != "25" || BOARD[2][2] != "25" || len(despawnQueues) != 1 {
+		t.Errorf("Pikachu not spawned at 2-2: %v", POKEMON_LOCATIONS)
+	}
+	if want := `{"2-2":"25"}`; !slices.Contains(misty.frames, want) {
+		t.Errorf("misty got %v, want %s", misty.frames, want)
+	}
+}
+
+func TestReleasePokemon(t *testing.T) {
+	resetState(t, []Player{{Username: "ash", PokeBalls: []Pokemon{{ID: "1"}, {ID: "2"}, {ID: "1"}}}})
+	session, _, _ := newTestBattle(t, []Pokemon{{ID: "1"}}, nil)
+	BATTLES[session.ID] = session
+
+	if err := releasePokemon("ash", "2"); err != nil {
+		t.Fatalf("releasing a Pokemon outside the team: %v", err)
+	}
+	// One of the two copies of "1" is battling, the other one is spare
+	if err := releasePokemon("ash", "1"); err != nil {
+		t.Fatalf("releasing a spare copy: %v", err)
+	}
+	if err := releasePokemon("ash", "1"); err == nil {
+		t.Error("released the Pokemon that is in the battle team")
+	}
+	if err := releasePokemon("ash", "9"); err == nil {
+		t.Error("released a Pokemon ash doesn't own")
+	}
+	if got := PLAYERS[0].PokeBalls; len(got) != 1 || got[0].ID != "1" {
+		t.Errorf("PokeBalls after releasing = %v, want [1]", got)
+	}
+	if !playersDirty {
+		t.Error("the release was not saved")
+	}
+}
+
+func TestPartyAndBox(t *testing.T) {
+	resetState(t, []Player{{Username: "ash", PokeBalls: []Pokemon{{ID: "1"}, {ID: "2"}}}})
+	POKEMONS = []Pokemon{{ID: "25", Name: "Pikachu", Stats: battleStats(nil)}}
+	PARTY_SIZE = 2
+	defer func() { PARTY_SIZE = 0 }()
+	session, _, _ := newTestBattle(t, []Pokemon{{ID: "1"}}, nil)
+	BATTLES[session.ID] = session
+
+	// The party is full, so the catch goes to the box
+	catchPokemon(&recordingConn{}, "ash", "2-3", "25")
+	player := &PLAYERS[0]
+	if len(player.PokeBalls) != 2 || len(player.Box) != 1 || player.Box[0].ID != "25" {
+		t.Fatalf("party %v, box %v, want Pikachu in the box", player.PokeBalls, player.Box)
+	}
+	if err := withdrawPokemon("ash", "25"); err == nil {
+		t.Error("withdrew into a full party")
+	}
+	if err := depositPokemon("ash", "1"); err == nil {
+		t.Error("deposited the Pokemon that is in the battle team")
+	}
+	if err := depositPokemon("ash", "2"); err != nil {
+		t.Fatal(err)
+	}
+	if err := depositPokemon("ash", "1"); err == nil {
+		t.Error("deposited the last Pokemon of the party")
+	}
+	if err := withdrawPokemon("ash", "25"); err != nil {
+		t.Fatal(err)
+	}
+	if err := withdrawPokemon("ash", "25"); err == nil {
+		t.Error("withdrew a Pokemon that isn't in the box")
+	}
+	if len(player.PokeBalls) != 2 || player.PokeBalls[1].ID != "25" || len(player.Box) != 1 || player.Box[0].ID != "2" {
+		t.Errorf("party %v, box %v, want 1 and 25 in the party and 2 in the box", player.PokeBalls, player.Box)
+	}
+
+	// Boxed Pokemon still count on the leaderboard
+	if got := leaderboard(1); got[0].Pokemon != 3 {
+		t.Errorf("leaderboard counts %d Pokemon for ash, want 3", got[0].Pokemon)
+	}
+}
+
+func TestOversizedPartyBoxedAtLogin(t *testing.T) {
+	hash, err := hashPassword("pikachu")
+	if err != nil {
+		t.Fatal(err)
+	}
+	resetState(t, []Player{{Username: "ash", Password: hash, PokeBalls: []Pokemon{{ID: "1"}, {ID: "4"}, {ID: "7"}}, Box: []Pokemon{{ID: "25"}}}})
+	PARTY_SIZE = 2
+	t.Cleanup(func() { PARTY_SIZE = 0 })
+
+	_, frames := login(t, "ash", "pikachu")
+	w := nextWelcome(t, frames)
+	if !slices.Equal(w.Pokemon, []string{"1", "4"}) || !slices.Equal(w.Box, []string{"25", "7"}) {
+		t.Errorf("welcome has party %v and box %v, want [1 4] and [25 7]", w.Pokemon, w.Box)
+	}
+}
+
+func TestPlaintextPasswordUpgraded(t *testing.T) {
+	resetState(t, []Player{{Username: "ash", Password: "pikachu"}})
+
+	if verifyPlayer("ash", "raichu") {
+		t.Fatal("wrong password accepted")
+	}
+	if !verifyPlayer("ash", "pikachu") {
+		t.Fatal("plaintext password rejected")
+	}
+	stateMu.RLock()
+	defer stateMu.RUnlock()
+	if !isHashed(PLAYERS[0].Password) || !playersDirty {
+		t.Errorf("password %q not upgraded and scheduled for saving", PLAYERS[0].Password)
+	}
+	if err := bcrypt.CompareHashAndPassword([]byte(PLAYERS[0].Password), []byte("pikachu")); err != nil {
+		t.Errorf("upgraded hash doesn't match: %v", err)
+	}
+}
+
+func TestPlacePlayerRestoresPosition(t *testing.T) {
+	resetState(t, []Player{{Username: "ash", Position: "3-4"}, {Username: "misty", Position: "3-4"}})
+
+	placePlayerOnBoard("ash")
+	if PLAYER_LOCATIONS["3-4"] != "ash" || BOARD[3][4] != "" {
+		t.Fatalf("ash was not restored to 3-4 alone: locations %v, board %q", PLAYER_LOCATIONS, BOARD[3][4])
+	}
+
+	// misty's saved tile is now taken, so she lands somewhere else
+	placePlayerOnBoard("misty")
+	if PLAYER_LOCATIONS["3-4"] != "ash" {
+		t.Fatalf("misty took ash's tile: %v", PLAYER_LOCATIONS)
+	}
+	if pos := PLAYERS[1].Position; pos == "3-4" || PLAYER_LOCATIONS[pos] != "misty" {
+		t.Errorf("misty placed at %q, locations %v", pos, PLAYER_LOCATIONS)
+	}
+}
+
+func TestPlacePlayerOnFullBoard(t *testing.T) {
+	resetState(t, []Player{{Username: "ash"}, {Username: "misty"}})
+	for x := 0; x < ROWS; x++ {
+		for y := 0; y < COLS; y++ {
+			if x != 0 || y != 0 {
+				POKEMON_LOCATIONS[fmt.Sprintf("%d-%d", x, y)] = "1"
+			}
+		}
+	}
+
+	// The last free tile goes to ash and only PLAYER_LOCATIONS knows it
+	if err := placePlayerOnBoard("ash"); err != nil {
+		t.Fatal(err)
+	}
+	if PLAYER_LOCATIONS["0-0"] != "ash" || BOARD[0][0] != "" {
+		t.Fatalf("ash not placed on 0-0 alone: locations %v, board %q", PLAYER_LOCATIONS, BOARD[0][0])
+	}
+	if err := placePlayerOnBoard("misty"); err == nil {
+		t.Error("misty was placed on a full board")
+	}
+}
+
+func TestGainExpLevelBoundaries(t *testing.T) {
+	newPokemon := func() Pokemon {
+		return Pokemon{Stats: map[string]string{"HP": "100", "Attack": "10", "Defense": "10", "Sp Atk": "10", "Sp Def": "10", "Speed": "1"}}
+	}
+
+	tests := []struct {
+		name      string
+		amount    int
+		wantLevel int
+		wantXP    int
+	}{
+		{"nothing", 0, 1, 0},
+		{"just below level 2", LEVEL_EXP_STEP - 1, 1, LEVEL_EXP_STEP - 1},
+		{"exactly level 2", LEVEL_EXP_STEP, 2, 0},
+		{"two levels at once", 3 * LEVEL_EXP_STEP, 3, 0},
+		{"leftover XP", 3*LEVEL_EXP_STEP + 5, 3, 5},
+		{"capped at max level", 1 << 30, MAX_LEVEL, 0},
+	}
+	for _, tt := range tests {
+		p := newPokemon()
+		gained := gainExp(&p, tt.amount)
+		if levelOf(p) != tt.wantLevel || p.XP != tt.wantXP {
+			t.Errorf("%s: level %d xp %d, want level %d xp %d", tt.name, levelOf(p), p.XP, tt.wantLevel, tt.wantXP)
+		}
+		if gained != tt.wantLevel-1 {
+			t.Errorf("%s: gained %d levels, want %d", tt.name, gained, tt.wantLevel-1)
+		}
+	}
+
+	// One level up: 5% growth, but never less than a single point
+	p := newPokemon()
+	gainExp(&p, LEVEL_EXP_STEP)
+	if p.Stats["HP"] != "105" || p.Stats["Speed"] != "2" {
+		t.Errorf("stats after level up: HP %s Speed %s, want 105 and 2", p.Stats["HP"], p.Stats["Speed"])
+	}
+}
+
+func TestLeaderboardRanking(t *testing.T) {
+	caught := func(levels ...int) []Pokemon {
+		var balls []Pokemon
+		for _, level := range levels {
+			balls = append(balls, Pokemon{ID: "1", Level: level})
+		}
+		return balls
+	}
+	resetState(t, []Player{
+		{Username: "misty", PokeBalls: caught(1)},
+		{Username: "ash", PokeBalls: caught(1, 1)},
+		{Username: "gary", PokeBalls: caught(3, 1)}, // 100 + 200 EXP to reach level 3
+		{Username: "brock", PokeBalls: caught(1)},
+		{Username: "tracey"},
+	})
+
+	got := leaderboard(4)
+	want := []LeaderboardEntry{
+		{Username: "gary", Pokemon: 2, Exp: 300},
+		{Username: "ash", Pokemon: 2},
+		{Username: "brock", Pokemon: 1},
+		{Username: "misty", Pokemon: 1},
+	}
+	if fmt.Sprint(got) != fmt.Sprint(want) {
+		t.Errorf("leaderboard(4) = %v, want %v", got, want)
+	}
+}
+
+func TestPickWeightedPokemonFavorsLowStats(t *testing.T) {
+	stats := func(each string) map[string]string {
+		return map[string]string{"HP": each, "Attack": each, "Defense": each, "Sp Atk": each, "Sp Def": each, "Speed": each}
+	}
+	resetState(t, nil)
+	POKEMONS = []Pokemon{
+		{ID: "1", Name: "Common", Stats: stats("50")},     // total 300
+		{ID: "2", Name: "Legendary", Stats: stats("100")}, // total 600
+	}
+	worldRand = rand.New(rand.NewSource(1))
+	defer func() { worldRand = rand.New(rand.NewSource(time.Now().UnixNano())) }()
+
+	counts := make(map[string]int)
+	for i := 0; i < 100000; i++ {
+		pokemon, _ := pickWeightedPokemon(POKEMONS)
+		counts[pokemon.ID]++
+	}
+
+	// Twice the stats with an exponent of 2 should be 4 times as rare
+	ratio := float64(counts["1"]) / float64(counts["2"])
+	if ratio < 3.6 || ratio > 4.4 {
+		t.Errorf("common:legendary spawn ratio = %.2f (%v), want about 4", ratio, counts)
+	}
+}
+
+func TestGenerateRandomPokemonsRespectsLimits(t *testing.T) {
+	resetState(t, nil)
+	POKEMONS = []Pokemon{{ID: "1", Name: "Bulbasaur", Stats: battleStats(nil)}}
+
+	// The cap limits a batch to the room that is left
+	for i := 0; i < MAX_POKEMON_ON_BOARD-2; i++ {
+		POKEMON_LOCATIONS[fmt.Sprintf("f-%d", i)] = "1"
+	}
+	if spawned := generateRandomPokemons(NUMBERTOPROCESS); len(spawned) != 2 {
+		t.Errorf("spawned %d Pokemon with room for 2", len(spawned))
+	}
+	if spawned := generateRandomPokemons(NUMBERTOPROCESS); len(spawned) != 0 {
+		t.Errorf("spawned %d Pokemon on a capped board", len(spawned))
+	}
+
+	// A board covered in players must not make the spawner spin
+	resetState(t, nil)
+	for x := 0; x < ROWS; x++ {
+		for y := 0; y < COLS; y++ {
+			PLAYER_LOCATIONS[fmt.Sprintf("%d-%d", x, y)] = "p"
+		}
+	}
+	delete(PLAYER_LOCATIONS, "3-4")
+	spawned := generateRandomPokemons(NUMBERTOPROCESS)
+	if len(spawned) != 1 || spawned["3-4"] != "1" {
+		t.Errorf("spawned %v on a board with one free tile, want only 3-4", spawned)
+	}
+}
+
+func TestGenerateRandomPokemonsAvoidsOccupiedTiles(t *testing.T) {
+	defer func(rows, cols int) { ROWS, COLS = rows, cols }(ROWS, COLS)
+	ROWS, COLS = 4, 4
+	resetState(t, nil)
+	POKEMONS = []Pokemon{{ID: "1", Name: "Bulbasaur", Stats: battleStats(nil)}}
+	worldRand = rand.New(rand.NewSource(1))
+	defer func() { worldRand = rand.New(rand.NewSource(time.Now().UnixNano())) }()
+
+	// Fill 12 of the 16 tiles, leaving the diagonal free
+	occupied := make(map[string]string)
+	for x := 0; x < ROWS; x++ {
+		for y := 0; y < COLS; y++ {
+			locKey := fmt.Sprintf("%d-%d", x, y)
+			switch {
+			case x == y:
+			case (x+y)%2 == 0:
+				PLAYER_LOCATIONS[locKey] = "p"
+				occupied[locKey] = "p"
+			default:
+				BOARD[x][y] = "25"
+				POKEMON_LOCATIONS[locKey] = "25"
+				occupied[locKey] = "25"
+			}
+		}
+	}
+
+	// Ask for more than fits; the spawner has to give up instead of spinning
+	done := make(chan map[string]string)
+	go func() { done <- generateRandomPokemons(10) }()
+	var spawned map[string]string
+	select {
+	case spawned = <-done:
+	case <-time.After(5 * time.Second):
+		t.Fatal("generateRandomPokemons did not return on a nearly full board")
+	}
+
+	if len(spawned) != 4 {
+		t.Errorf("spawned %d Pokemon with 4 free tiles: %v", len(spawned), spawned)
+	}
+	for locKey := range spawned {
+		if _, taken := occupied[locKey]; taken {
+			t.Errorf("spawned on occupied tile %s", locKey)
+		}
+	}
+	for locKey, want := range occupied {
+		got := PLAYER_LOCATIONS[locKey]
+		if want != "p" {
+			got = POKEMON_LOCATIONS[locKey]
+		}
+		if got != want {
+			t.Errorf("tile %s holds %q after spawning, want %q", locKey, got, want)
+		}
+	}
+}
+
+func TestShippedZonesParse(t *testing.T) {
+	zones, err := loadZones("zones.json")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(zones) == 0 {
+		t.Error("zones.json has no zones")
+	}
+	if zones, err := loadZones(filepath.Join(t.TempDir(), "zones.json")); err != nil || zones != nil {
+		t.Errorf("loadZones without a file = %v, %v, want no zones", zones, err)
+	}
+}
+
+func TestParseZonesRejectsMalformed(t *testing.T) {
+	for _, data := range []string{
+		`[{"name": "void", "types": [], "bottom": 1, "right": 1}]`,
+		`[{"name": "shadow", "types": ["shadow"], "bottom": 1, "right": 1}]`,
+		`[{"name": "upside down", "types": ["water"], "top": 0.5, "bottom": 0.2, "right": 1}]`,
+		`[{"name": "too big", "types": ["water"], "bottom": 1.5, "right": 1}]`,
+		`{"name": "not a list"}`,
+	} {
+		if _, err := parseZones([]byte(data)); err == nil {
+			t.Errorf("parseZones(%s) succeeded, want an error", data)
+		}
+	}
+}
+
+func TestPokemonForZone(t *testing.T) {
+	defer func(rows, cols int) { ROWS, COLS = rows, cols }(ROWS, COLS)
+	ROWS, COLS = 8, 8
+	resetState(t, nil)
+	POKEMONS = []Pokemon{
+		{ID: "1", Name: "Bulbasaur", Types: []string{"Grass", "Poison"}, Stats: battleStats(nil)},
+		{ID: "7", Name: "Squirtle", Types: []string{"water"}, Stats: battleStats(nil)},
+		{ID: "19", Name: "Rattata", Types: []string{"normal"}, Stats: battleStats(nil)},
+	}
+	SPAWN_ZONES = []SpawnZone{
+		{Name: "lake", Types: []string{"water"}, Top: 0, Bottom: 0.25, Left: 0, Right: 1},
+		{Name: "forest", Types: []string{"grass"}, Top: 0.25, Bottom: 1, Left: 0, Right: 0.5},
+		{Name: "volcano", Types: []string{"fire"}, Top: 0.25, Bottom: 1, Left: 0.5, Right: 1},
+	}
+	defer func() { SPAWN_ZONES = nil }()
+
+	seen := make(map[string]bool)
+	for i := 0; i < 200; i++ {
+		if got, _ := pokemonForZone(1, 7); got.ID != "7" {
+			t.Fatalf("spawned %s in the lake, want Squirtle", got.Name)
+		}
+		if got, _ := pokemonForZone(7, 0); got.ID != "1" {
+			t.Fatalf("spawned %s in the forest, want Bulbasaur", got.Name)
+		}
+		// No fire Pokemon, so anything spawns in the volcano
+		pokemon, _ := pokemonForZone(7, 7)
+		seen[pokemon.ID] = true
+	}
+	if len(seen) != len(POKEMONS) {
+		t.Errorf("only %v spawned in a zone no Pokemon matches, want any", seen)
+	}
+}
+
+func TestGenerateRandomPokemonsEmptyPokedex(t *testing.T) {
+	resetState(t, nil)
+	POKEMONS = nil
+	if spawned := generateRandomPokemons(5); len(spawned) != 0 || len(POKEMON_LOCATIONS) != 0 {
+		t.Errorf("spawned %v without a pokedex", spawned)
+	}
+}
+
+func TestDespawnExpiredByAge(t *testing.T) {
+	resetState(t, nil)
+	now := time.Now()
+	spawn := func(locKey string, age time.Duration) {
+		x, y, _ := parseCoord(locKey)
+		BOARD[x][y] = "1"
+		POKEMON_LOCATIONS[locKey] = "1"
+		despawnQueues = append(despawnQueues, spawnEntry{locKey: locKey, spawnedAt: now.Add(-age)})
+	}
+	spawn("0-0", POKEMON_LIFETIME+time.Minute)
+	spawn("0-1", POKEMON_LIFETIME)
+	spawn("0-2", POKEMON_LIFETIME-time.Second)
+	spawn("0-3", 0)
+
+	despawned := despawnExpired(now)
+	if len(despawned) != 2 || despawned["0-0"] != "" || despawned["0-1"] != "" {
+		t.Errorf("despawned %v, want exactly 0-0 and 0-1", despawned)
+	}
+	if _, ok := POKEMON_LOCATIONS["0-1"]; ok || BOARD[0][1] != "" {
+		t.Error("expired Pokemon is still on the board")
+	}
+	if len(despawnQueues) != 2 || despawnQueues[0].locKey != "0-2" {
+		t.Errorf("despawnQueues = %v, want the two young Pokemon", despawnQueues)
+	}
+
+	// A caught Pokemon's timer must not clear a later spawn on its tile
+	forgetSpawn("0-2")
+	spawn("0-2", 0)
+	if despawned := despawnExpired(now.Add(POKEMON_LIFETIME - time.Millisecond)); len(despawned) != 0 {
+		t.Errorf("despawned %v before any Pokemon expired", despawned)
+	}
+}
+
+func TestWarnExpiring(t *testing.T) {
+	resetState(t, nil)
+	now := time.Now()
+	for _, spawn := range []struct {
+		locKey string
+		age    time.Duration
+	}{
+		{"0-0", POKEMON_LIFETIME - time.Second},
+		{"0-1", POKEMON_LIFETIME - DESPAWN_WARNING},
+		{"0-2", POKEMON_LIFETIME - DESPAWN_WARNING - time.Second},
+	} {
+		POKEMON_LOCATIONS[spawn.locKey] = "25"
+		despawnQueues = append(despawnQueues, spawnEntry{locKey: spawn.locKey, spawnedAt: now.Add(-spawn.age)})
+	}
+
+	warnings := warnExpiring(now)
+	if len(warnings) != 2 || warnings["0-0"] != protocol.DESPAWNING || warnings["0-1"] != protocol.DESPAWNING {
+		t.Errorf("warnings = %v, want 0-0 and 0-1 despawning", warnings)
+	}
+	if again := warnExpiring(now); len(again) != 0 {
+		t.Errorf("warned twice about %v", again)
+	}
+
+	// Late joiners see the warnings too, but the Pokemon is still catchable
+	locations := currentPokemonLocations()
+	if locations["0-0"] != protocol.DESPAWNING || locations["0-2"] != "25" {
+		t.Errorf("login locations = %v", locations)
+	}
+	if POKEMON_LOCATIONS["0-0"] != "25" {
+		t.Errorf("warning replaced the Pokemon ID on the server: %v", POKEMON_LOCATIONS)
+	}
+}
+
+func TestMovementMustBeAdjacent(t *testing.T) {
+	resetState(t, []Player{{Username: "ash", Position: "2-2"}})
+	conn := &countingConn{}
+	CONNECTIONS["ash"] = conn
+	PLAYER_LOCATIONS["2-2"] = "ash"
+
+	tests := []struct {
+		move string
+		want string
+	}{
+		{"5-5", "2-2"},  // teleport
+		{"3-3", "2-2"},  // diagonal
+		{"-1-2", "2-2"}, // off the board
+		{"2-2", "2-2"},  // standing still
+		{"2-3", "2-3"},
+		{"1-3", "1-3"},
+	}
+	for _, tt := range tests {
+		battleStatus := false
+		handleMovementOrEncounter(conn, tt.move, &battleStatus)
+		if PLAYER_LOCATIONS[tt.want] != "ash" || len(PLAYER_LOCATIONS) != 1 {
+			t.Errorf("after move to %s: locations %v, want ash at %s", tt.move, PLAYER_LOCATIONS, tt.want)
+		}
+	}
+}
+
+func TestMoveOntoBattlingPlayerRejected(t *testing.T) {
+	resetState(t, []Player{{Username: "ash", Position: "2-2"}, {Username: "misty", Position: "2-3"}})
+	conn := &countingConn{}
+	CONNECTIONS["ash"] = conn
+	PLAYER_LOCATIONS["2-2"] = "ash"
+	PLAYER_LOCATIONS["2-3"] = "misty"
+	BATTLES["1"] = &BattleSession{ID: "1", P1: "brock", P2: "misty"}
+
+	battleStatus := false
+	handleMovementOrEncounter(conn, "2-3", &battleStatus)
+	if battleStatus || len(BATTLES) != 1 {
+		t.Error("ash started a battle with misty, who is already battling")
+	}
+	if PLAYER_LOCATIONS["2-2"] != "ash" || PLAYER_LOCATIONS["2-3"] != "misty" {
+		t.Errorf("locations %v, want ash and misty where they were", PLAYER_LOCATIONS)
+	}
+
+	// Battling players can't walk around either
+	BATTLES["1"].P1 = "ash"
+	handleMovementOrEncounter(conn, "1-2", &battleStatus)
+	if PLAYER_LOCATIONS["1-2"] == "ash" {
+		t.Error("ash moved during a battle")
+	}
+}
+
+func TestRaceForPokemonTile(t *testing.T) {
+	for round := 0; round < 20; round++ {
+		resetState(t, []Player{{Username: "ash", Position: "2-2"}, {Username: "misty", Position: "2-4"}})
+		POKEMONS = []Pokemon{{ID: "1", Name: "Bulbasaur", Stats: battleStats(nil)}}
+		BOARD[2][3] = "1"
+		POKEMON_LOCATIONS["2-3"] = "1"
+		conns := []*recordingConn{{}, {}}
+		CONNECTIONS["ash"], CONNECTIONS["misty"] = conns[0], conns[1]
+		PLAYER_LOCATIONS["2-2"], PLAYER_LOCATIONS["2-4"] = "ash", "misty"
+
+		// Both step onto the Pokemon at the same time
+		var wg sync.WaitGroup
+		for _, conn := range conns {
+			wg.Add(1)
+			go func() {
+				defer wg.Done()
+				battleStatus := false
+				handleMovementOrEncounter(conn, "2-3", &battleStatus)
+			}()
+		}
+		wg.Wait()
+
+		if caught := len(PLAYERS[0].PokeBalls) + len(PLAYERS[1].PokeBalls); caught != 1 {
+			t.Fatalf("round %d: %d Pokemon caught, want 1", round, caught)
+		}
+		// The catcher leaves the board, so the slower player ends up on the tile
+		loser := PLAYER_LOCATIONS["2-3"]
+		if loser == "" || len(findPlayer(loser).PokeBalls) != 0 {
+			t.Fatalf("round %d: tile 2-3 holds %q, want the player who missed out", round, loser)
+		}
+		winner, loserConn := "misty", conns[0]
+		if loser == "misty" {
+			winner, loserConn = "ash", conns[1]
+		}
+		notice := `{"catch":"` + winner + `-1"}`
+		if !slices.Contains(loserConn.frames, notice) {
+			t.Errorf("round %d: %s got %v, want %s", round, loser, loserConn.frames, notice)
+		}
+	}
+}
+
+// countingConn is a net.Conn that only counts the bytes written to it.
+type countingConn struct {
+	net.Conn
+	written int
+}
+
+func (c *countingConn) Write(b []byte) (int, error) {
+	c.written += len(b)
+	return len(b), nil
+}
+
+// recordingConn is a net.Conn that keeps the payload of every frame written
+// to it.
+type recordingConn struct {
+	net.Conn
+	frames []string
+}
+
+func (c *recordingConn) Write(b []byte) (int, error) {
+	c.frames = append(c.frames, string(b[4:]))
+	return len(b), nil
+}
+
+// brokenConn is a net.Conn whose writes all fail, like one the client has
+// already hung up.
+type brokenConn struct {
+	net.Conn
+}
+
+func (brokenConn) Write(b []byte) (int, error) {
+	return 0, net.ErrClosed
+}
+
+// tricklingConn is a net.Conn that takes each write one byte at a time,
+// giving other goroutines every chance to interleave their writes.
+type tricklingConn struct {
+	net.Conn
+	mu   sync.Mutex
+	data []byte
+}
+
+func (c *tricklingConn) Write(b []byte) (int, error) {
+	for _, octet := range b {
+		c.mu.Lock()
+		c.data = append(c.data, octet)
+		c.mu.Unlock()
+		runtime.Gosched()
+	}
+	return len(b), nil
+}
+
+func (c *tricklingConn) SetWriteDeadline(time.Time) error {
+	return nil
+}
+
+// setupLobby fills the board with n connected players that count their traffic.
+func setupLobby(b *testing.B, n int) []*countingConn {
+	b.Helper()
+	PLAYER_LOCATIONS = make(map[string]string)
+	CONNECTIONS = make(map[string]net.Conn)
+	conns := make([]*countingConn, n)
+	for i := range conns {
+		username := "player" + strconv.Itoa(i)
+		conns[i] = &countingConn{}
+		CONNECTIONS[username] = conns[i]
+		PLAYER_LOCATIONS[strconv.Itoa(i%ROWS)+"-"+strconv.Itoa(i/ROWS)] = username
+	}
+	return conns
+}
+
+// reportTraffic reports the bytes sent to all clients per broadcast.
+func reportTraffic(b *testing.B, conns []*countingConn) {
+	total := 0
+	for _, c := range conns {
+		total += c.written
+	}
+	b.ReportMetric(float64(total)/float64(b.N), "bytes/op")
+}
+
+// BenchmarkBroadcastFullState sends every player the whole PLAYER_LOCATIONS
+// map, as the server did before moves were sent as deltas.
+func BenchmarkBroadcastFullState(b *testing.B) {
+	conns := setupLobby(b, 100)
+	b.ResetTimer()
+	for i := 0; i < b.N; i++ {
+		sentPLAYER_LOCATIONS, _ := json.Marshal(PLAYER_LOCATIONS)
+		for _, tcpConn := range CONNECTIONS {
+			protocol.WriteFrame(tcpConn, sentPLAYER_LOCATIONS)
+		}
+	}
+	reportTraffic(b, conns)
+}
+
+func BenchmarkBroadcastMoveDelta(b *testing.B) {
+	conns := setupLobby(b, 100)
+	b.ResetTimer()
+	for i := 0; i < b.N; i++ {
+		broadcastPlayerMove("player0", "0-0", "0-1")
+	}
+	reportTraffic(b, conns)
+}
+
+// battleStats builds a stat map where every stat not given is 50.
+func battleStats(overrides map[string]string) map[string]string {
+	stats := map[string]string{"HP": "50", "Attack": "50", "Defense": "50", "Sp Atk": "50", "Sp Def": "50", "Speed": "50"}
+	for k, v := range overrides {
+		stats[k] = v
+	}
+	return stats
+}
+
+// newTestBattle wires a BattleSession to two in-memory pipes and returns the
+// client ends of P1 and P2.
+func newTestBattle(t *testing.T, teamP1, teamP2 []Pokemon) (*BattleSession, net.Conn, net.Conn) {
+	t.Helper()
+	clientP1, serverP1 := net.Pipe()
+	clientP2, serverP2 := net.Pipe()
+	t.Cleanup(func() {
+		clientP1.Close()
+		serverP1.Close()
+		clientP2.Close()
+		serverP2.Close()
+	})
+	session := &BattleSession{
+		ID:          "test",
+		P1:          "ash",
+		P2:          "misty",
+		ConnP1:      serverP1,
+		ConnP2:      serverP2,
+		PokeBallsP1: teamP1,
+		PokeBallsP2: teamP2,
+		Player1Turn: true,
+	}
+	return session, clientP1, clientP2
+}
+
+// attackAndCapture runs attackEnemy and returns the battle message the
+// defender received, or "" if nothing was sent.
+func attackAndCapture(t *testing.T, session *BattleSession, defender net.Conn, attacker string, attackerIndex int) string {
+	t.Helper()
+	frames := make(chan string, 1)
+	go func() {
+		frame, err := protocol.ReadFrame(defender)
+		if err != nil {
+			close(frames)
+			return
+		}
+		frames <- string(frame)
+	}()
+
+	attackEnemy(session, attacker, attackerIndex, 0)
+
+	select {
+	case frame, ok := <-frames:
+		if !ok {
+			return ""
+		}
+		var msg map[string]string
+		if err := json.Unmarshal([]byte(frame), &msg); err != nil {
+			t.Fatalf("defender got invalid JSON %q: %v", frame, err)
+		}
+		return msg["battle"]
+	case <-time.After(100 * time.Millisecond):
+		// net.Pipe writes block until read, so nothing was written
+		defender.Close()
+		return ""
+	}
+}
+
+// parseAttacked splits an "attacked-HP-Damage-Index[-flags]" message.
+func parseAttacked(t *testing.T, msg string) (hp, damage, index int, flags string) {
+	t.Helper()
+	parts := strings.Split(msg, "-")
+	if len(parts) < 4 || len(parts) > 5 || parts[0] != "attacked" {
+		t.Fatalf("malformed attack message %q", msg)
+	}
+	hp, _ = strconv.Atoi(parts[1])
+	damage, _ = strconv.Atoi(parts[2])
+	index, _ = strconv.Atoi(parts[3])
+	if len(parts) == 5 {
+		flags = parts[4]
+	}
+	return hp, damage, index, flags
+}
+
+func TestAttackEnemy(t *testing.T) {
+	tests := []struct {
+		name          string
+		attacker      string
+		attackerIndex int
+		defIndex      int // the defender's active Pokemon, may be out of range
+		defenderHP    string
+		wantIndex     int
+		wantFaint     bool
+	}{
+		{"damage without fainting", "ash", 0, 0, "500", 0, false},
+		{"second defender Pokemon", "ash", 0, 1, "500", 1, false},
+		{"out of range defender index is clamped", "ash", 0, 7, "500", 0, false},
+		{"fainted defender is removed", "ash", 0, 0, "1", 0, true},
+		{"player 2 attacks player 1", "misty", 0, 1, "1", 1, true},
+	}
+
+	for _, tt := range tests {
+		// Attacks may miss, so retry until one lands
+		var msg string
+		var session *BattleSession
+		for attempt := 0; attempt < 50; attempt++ {
+			defenders := []Pokemon{
+				{ID: "1", Name: "First", Exp: "64", Stats: battleStats(map[string]string{"HP": tt.defenderHP})},
+				{ID: "2", Name: "Second", Exp: "64", Stats: battleStats(map[string]string{"HP": tt.defenderHP})},
+			}
+			attackers := []Pokemon{{ID: "3", Name: "Attacker", Stats: battleStats(map[string]string{"Attack": "80"})}}
+
+			var defenderConn net.Conn
+			if tt.attacker == "ash" {
+				session, _, defenderConn = newTestBattle(t, attackers, defenders)
+				session.DefIndexP2 = tt.defIndex
+			} else {
+				session, defenderConn, _ = newTestBattle(t, defenders, attackers)
+				session.DefIndexP1 = tt.defIndex
+			}
+
+			msg = attackAndCapture(t, session, defenderConn, tt.attacker, tt.attackerIndex)
+			if !strings.HasPrefix(msg, "missed") {
+				break
+			}
+			if msg != fmt.Sprintf("missed-%d", tt.wantIndex) {
+				t.Fatalf("%s: miss message %q, want index %d", tt.name, msg, tt.wantIndex)
+			}
+		}
+
+		hp, damage, index, flags := parseAttacked(t, msg)
+		if index != tt.wantIndex {
+			t.Errorf("%s: attacked index %d, want %d", tt.name, index, tt.wantIndex)
+		}
+		if damage < 1 {
+			t.Errorf("%s: damage %d, want at least 1", tt.name, damage)
+		}
+		for _, flag := range strings.Split(flags, ",") {
+			if flag != "" && flag != "crit" && flag != "special" {
+				t.Errorf("%s: unknown flag %q in %q", tt.name, flag, msg)
+			}
+		}
+
+		defendingTeam, earned := session.PokeBallsP2, session.ExpP1
+		if tt.attacker == "misty" {
+			defendingTeam, earned = session.PokeBallsP1, session.ExpP2
+		}
+
+		startHP, _ := strconv.Atoi(tt.defenderHP)
+		if tt.wantFaint {
+			if hp != 0 {
+				t.Errorf("%s: fainted Pokemon reported HP %d, want 0", tt.name, hp)
+			}
+			if len(defendingTeam) != 1 || defendingTeam[0].ID == strconv.Itoa(tt.wantIndex+1) {
+				t.Errorf("%s: fainted Pokemon not removed, team %+v", tt.name, defendingTeam)
+			}
+			if earned != 64 {
+				t.Errorf("%s: attacker earned %d EXP, want 64", tt.name, earned)
+			}
+		} else {
+			if hp != startHP-damage {
+				t.Errorf("%s: HP %d after %d damage, want %d", tt.name, hp, damage, startHP-damage)
+			}
+			if len(defendingTeam) != 2 {
+				t.Errorf("%s: defending team has %d Pokemon, want 2", tt.name, len(defendingTeam))
+			}
+			if got := defendingTeam[tt.wantIndex].Stats["HP"]; got != strconv.Itoa(hp) {
+				t.Errorf("%s: session HP %s, want %d", tt.name, got, hp)
+			}
+		}
+	}
+}
+
+func TestAttackEnemyInvalidAttackerIndex(t *testing.T) {
+	for _, index := range []int{-1, 1, 5} {
+		defenders := []Pokemon{{ID: "1", Name: "Defender", Stats: battleStats(nil)}}
+		attackers := []Pokemon{{ID: "2", Name: "Attacker", Stats: battleStats(nil)}}
+		session, _, defenderConn := newTestBattle(t, attackers, defenders)
+
+		if msg := attackAndCapture(t, session, defenderConn, "ash", index); msg != "" {
+			t.Errorf("attack with index %d sent %q, want nothing", index, msg)
+		}
+		if hp := session.PokeBallsP2[0].Stats["HP"]; hp != "50" {
+			t.Errorf("attack with index %d changed defender HP to %s", index, hp)
+		}
+	}
+}
+
+func TestAttackEnemyInvalidMove(t *testing.T) {
+	// A Pokemon without types only knows Tackle
+	for _, move := range []int{-1, 1} {
+		defenders := []Pokemon{{ID: "1", Name: "Defender", Stats: battleStats(nil)}}
+		attackers := []Pokemon{{ID: "2", Name: "Attacker", Stats: battleStats(nil)}}
+		session, _, _ := newTestBattle(t, attackers, defenders)
+
+		// Nothing is written for an invalid move, so this can't block on the pipe
+		attackEnemy(session, "ash", 0, move)
+		if hp := session.PokeBallsP2[0].Stats["HP"]; hp != "50" {
+			t.Errorf("attack with move %d changed defender HP to %s", move, hp)
+		}
+	}
+}
+
+func TestEndBattleResetsState(t *testing.T) {
+	resetState(t, []Player{{Username: "ash", Position: "4-4"}, {Username: "misty", Position: "4-5"}})
+	ashConn, mistyConn := &countingConn{}, &countingConn{}
+	CONNECTIONS["ash"], CONNECTIONS["misty"] = ashConn, mistyConn
+
+	// ash walked into misty, so only misty is still on the board
+	PLAYER_LOCATIONS["4-5"] = "misty"
+	session := initiateBattle(ashConn, "ash", "misty")
+	session.PokeBallsP2 = []Pokemon{{ID: "1", Name: "Staryu", Stats: battleStats(nil)}}
+
+	endBattle("ash")
+
+	if len(BATTLES) != 0 {
+		t.Errorf("%d battles left after endBattle, want 0", len(BATTLES))
+	}
+	if findBattle("ash") != nil || findBattle("misty") != nil {
+		t.Error("players still have a battle after endBattle")
+	}
+	if PLAYER_LOCATIONS["4-5"] != "misty" || PLAYER_LOCATIONS["4-4"] != "ash" || len(PLAYER_LOCATIONS) != 2 {
+		t.Errorf("players not back on their own tiles: %v", PLAYER_LOCATIONS)
+	}
+
+	// A fresh battle between the same players starts from scratch
+	next := initiateBattle(mistyConn, "misty", "ash")
+	if len(next.PokeBallsP1) != 0 || len(next.PokeBallsP2) != 0 || next.DefIndexP1 != 0 || next.DefIndexP2 != 0 || !next.Player1Turn {
+		t.Errorf("new battle carries stale state: %+v", next)
+	}
+}
+
+func TestDisconnectForfeitsBattle(t *testing.T) {
+	resetState(t, []Player{{Username: "ash", Position: "4-4"}, {Username: "misty", Position: "4-5"}})
+	ashConn, mistyConn := &recordingConn{}, &recordingConn{}
+	CONNECTIONS["ash"], CONNECTIONS["misty"] = ashConn, mistyConn
+	session := initiateBattle(ashConn, "ash", "misty")
+	session.PokeBallsP2 = []Pokemon{{ID: "1", Name: "Staryu", Stats: battleStats(nil)}}
+
+	removeConnectionAndNotify(ashConn)
+
+	if len(BATTLES) != 0 {
+		t.Errorf("%d battles left after a player disconnected, want 0", len(BATTLES))
+	}
+	won := false
+	for _, frame := range mistyConn.frames {
+		if frame == `{"battle":"victory_misty"}` {
+			won = true
+		}
+	}
+	if !won {
+		t.Errorf("misty got %v, want a victory", mistyConn.frames)
+	}
+	if PLAYER_LOCATIONS["4-5"] != "misty" || len(PLAYER_LOCATIONS) != 1 {
+		t.Errorf("want only misty back on the board, got %v", PLAYER_LOCATIONS)
+	}
+}
+
+func TestBattleStartsWithSmallTeams(t *testing.T) {
+	session, _, _ := newTestBattle(t, nil, nil)
+	pikachu := []Pokemon{{ID: "25", Name: "Pikachu", Stats: battleStats(nil)}}
+	staryu := []Pokemon{{ID: "120", Name: "Staryu", Stats: battleStats(nil)}}
+
+	// "done" with an empty team doesn't count
+	session.markReady("ash")
+	if session.ReadyP1 {
+		t.Fatal("player with an empty team marked ready")
+	}
+
+	if err := submitPokemon(session, "ash", "25", pikachu); err != nil {
+		t.Fatal(err)
+	}
+	session.markReady("ash")
+	if err := submitPokemon(session, "misty", "120", staryu); err != nil {
+		t.Fatal(err)
+	}
+	if session.ReadyP2 || session.Started {
+		t.Fatal("misty is ready before sending done")
+	}
+
+	// Starting announces the first turn, so drain both connections
+	session.ConnP1, session.ConnP2 = &countingConn{}, &countingConn{}
+	session.markReady("misty")
+	session.startIfReady()
+	session.stopTurnTimer()
+	if !session.Started {
+		t.Fatal("battle with one Pokemon per side did not start")
+	}
+
+	// No more Pokemon once the battle runs
+	if err := submitPokemon(session, "misty", "120", append(staryu, staryu...)); err == nil {
+		t.Error("submitting after the start was accepted")
+	}
+}
+
+func TestBattleActionsOnlyForSelf(t *testing.T) {
+	hash, err := hashPassword("pikachu")
+	if err != nil {
+		t.Fatal(err)
+	}
+	resetState(t, []Player{{Username: "ash", Password: hash, Position: "2-2"}})
+	session := &BattleSession{ID: "other", P1: "misty", P2: "brock", ConnP1: &countingConn{}, ConnP2: &countingConn{}}
+	BATTLES[session.ID] = session
+
+	client, frames := login(t, "ash", "pikachu")
+	nextWelcome(t, frames)
+	waitForLogin(t, "ash")
+
+	line, err := protocol.EncodeBattleAction(protocol.BattleAction{Player: "misty", Action: protocol.ACTION_SURRENDER})
+	if err != nil {
+		t.Fatal(err)
+	}
+	// The catches reply tells us the surrender has been handled
+	if _, err := client.Write(append(line, "catches\n"...)); err != nil {
+		t.Fatal(err)
+	}
+	for !strings.Contains(nextFrame(t, frames), `"catches"`) {
+	}
+
+	battleMu.Lock()
+	defer battleMu.Unlock()
+	if BATTLES["other"] == nil {
+		t.Error("ash surrendered misty's battle")
+	}
+}
+
+func TestSwitchRejectsOutOfRange(t *testing.T) {
+	team := []Pokemon{{ID: "25", Name: "Pikachu", Stats: battleStats(nil)}, {ID: "1", Name: "Bulbasaur", Stats: battleStats(nil)}}
+	session, _, _ := newTestBattle(t, team, team)
+
+	for _, index := range []int{-1, 2} {
+		handleBattleAction(session, protocol.BattleAction{Player: "ash", Action: protocol.ACTION_SWITCH, Index: index})
+		if session.DefIndexP1 != 0 {
+			t.Errorf("switch to %d gave DefIndexP1 %d, want 0", index, session.DefIndexP1)
+		}
+	}
+	// Only on your own turn
+	handleBattleAction(session, protocol.BattleAction{Player: "misty", Action: protocol.ACTION_SWITCH, Index: 1})
+	if session.DefIndexP2 != 0 {
+		t.Errorf("misty switched out of turn")
+	}
+	handleBattleAction(session, protocol.BattleAction{Player: "ash", Action: protocol.ACTION_SWITCH, Index: 1})
+	if session.DefIndexP1 != 1 {
+		t.Errorf("DefIndexP1 = %d, want 1", session.DefIndexP1)
+	}
+}
+
+func TestTurnTimeoutEndsBattle(t *testing.T) {
+	session, _, _ := newTestBattle(t,
+		[]Pokemon{{ID: "25", Name: "Pikachu", Stats: battleStats(map[string]string{"HP": "1000"})}},
+		[]Pokemon{{ID: "120", Name: "Staryu", Stats: battleStats(map[string]string{"HP": "1"})}},
+	)
+	session.ConnP1, session.ConnP2 = &countingConn{}, &countingConn{}
+
+	// Attacks can miss, so time out until ash's automatic attack lands
+	for i := 0; i < 100; i++ {
+		loser := session.handleTurnTimeout()
+		session.stopTurnTimer()
+		if loser != "" {
+			if loser != "misty" {
+				t.Fatalf("loser = %q, want misty", loser)
+			}
+			return
+		}
+	}
+	t.Fatal("the automatic attack never ended the battle")
+}
+
+func TestInvalidMoveKeepsTurn(t *testing.T) {
+	team := []Pokemon{{ID: "25", Name: "Pikachu", Types: []string{"electric"}, Stats: battleStats(nil)}}
+	session, _, _ := newTestBattle(t, team, team)
+	p1 := &recordingConn{}
+	session.ConnP1, session.ConnP2 = p1, &countingConn{}
+
+	// Pikachu knows Tackle and Thunder Shock
+	for _, move := range []int{-1, 2} {
+		p1.frames = nil
+		handleBattleAction(session, protocol.BattleAction{Player: "ash", Action: protocol.ACTION_ATTACK, Move: move})
+		if !session.Player1Turn {
+			t.Fatalf("move %d passed the turn on", move)
+		}
+		want := []string{`{"battle":"invalid-move"}`, `{"battle":"ash"}`}
+		if !slices.Equal(p1.frames, want) {
+			t.Errorf("move %d: ash got %v, want %v", move, p1.frames, want)
+		}
+	}
+}
+
+func TestTypeMatchupsWithWeakAttacker(t *testing.T) {
+	defer func(model DamageModel) { damageModel = model }(damageModel)
+	damageModel = SubtractiveModel{}
+
+	// Far weaker than the defender, so the base damage is negative
+	weak := battleStats(map[string]string{"Attack": "10", "Sp Atk": "10"})
+	tough := battleStats(map[string]string{"HP": "500", "Defense": "200", "Sp Def": "200"})
+	damageAgainst := func(move protocol.Move, defenderType string) int {
+		for attempt := 0; attempt < 50; attempt++ {
+			attackers := []Pokemon{{ID: "4", Name: "Charmander", Moves: []protocol.Move{move}, Stats: weak}}
+			defenders := []Pokemon{{ID: "1", Name: "Defender", Types: []string{defenderType}, Stats: tough}}
+			session, _, defenderConn := newTestBattle(t, attackers, defenders)
+			msg := attackAndCapture(t, session, defenderConn, "ash", 0)
+			if !strings.HasPrefix(msg, "missed") {
+				_, damage, _, _ := parseAttacked(t, msg)
+				return damage
+			}
+		}
+		t.Fatal("every attack missed")
+		return 0
+	}
+
+	ember := protocol.Move{Name: "Ember", Type: "fire", Power: 40}
+	super, resisted := damageAgainst(ember, "grass"), damageAgainst(ember, "water")
+	if super <= resisted {
+		t.Errorf("super-effective hit dealt %d, resisted hit %d", super, resisted)
+	}
+	if resisted < 1 {
+		t.Errorf("resisted hit dealt %d, want at least 1", resisted)
+	}
+	if immune := damageAgainst(protocol.TACKLE, "ghost"); immune != 0 {
+		t.Errorf("normal move dealt %d to a ghost, want 0", immune)
+	}
+}